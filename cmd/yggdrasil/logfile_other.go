@@ -0,0 +1,13 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+
+package main
+
+import (
+	"context"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/logging"
+)
+
+// reopenLogOnSignal does nothing on this platform, as there are no signals
+// which are used to ask for the log file to be reopened.
+func reopenLogOnSignal(ctx context.Context, file *logging.File, logger *logging.Logger) {}
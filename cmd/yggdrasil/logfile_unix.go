@@ -0,0 +1,34 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/logging"
+)
+
+// reopenLogOnSignal reopens the log file whenever SIGUSR1 or SIGHUP is
+// received, i.e. from the postrotate script of logrotate.
+func reopenLogOnSignal(ctx context.Context, file *logging.File, logger *logging.Logger) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+			}
+			if err := file.Reopen(); err != nil {
+				logger.Errorln("Failed to reopen log file:", err)
+			} else {
+				logger.Infoln("Reopened log file")
+			}
+		}
+	}()
+}
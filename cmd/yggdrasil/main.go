@@ -8,11 +8,13 @@ import (
 	"flag"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"os/signal"
 	"regexp"
 	"strings"
 	"syscall"
+	"time"
 
 	"suah.dev/protect"
 
@@ -24,10 +26,15 @@ import (
 	"github.com/yggdrasil-network/yggdrasil-go/src/address"
 	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
 	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+	"github.com/yggdrasil-network/yggdrasil-go/src/dns"
 	"github.com/yggdrasil-network/yggdrasil-go/src/ipv6rwc"
+	"github.com/yggdrasil-network/yggdrasil-go/src/logging"
 
 	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+	"github.com/yggdrasil-network/yggdrasil-go/src/metrics"
 	"github.com/yggdrasil-network/yggdrasil-go/src/multicast"
+	"github.com/yggdrasil-network/yggdrasil-go/src/netstack"
+	"github.com/yggdrasil-network/yggdrasil-go/src/radvd"
 	"github.com/yggdrasil-network/yggdrasil-go/src/tun"
 	"github.com/yggdrasil-network/yggdrasil-go/src/version"
 )
@@ -37,6 +44,10 @@ type node struct {
 	tun       *tun.TunAdapter
 	multicast *multicast.Multicast
 	admin     *admin.AdminSocket
+	metrics   *metrics.Metrics
+	netstack  *netstack.Netstack
+	dns       *dns.Server
+	radvd     *radvd.Daemon
 }
 
 // The main function is responsible for configuring and starting Yggdrasil.
@@ -54,6 +65,10 @@ func main() {
 	getsnet := flag.Bool("subnet", false, "use in combination with either -useconf or -useconffile, outputs your IPv6 subnet")
 	getpkey := flag.Bool("publickey", false, "use in combination with either -useconf or -useconffile, outputs your public key")
 	loglevel := flag.String("loglevel", "info", "loglevel to enable")
+	logformat := flag.String("logformat", "text", "log format, \"text\" or \"json\"")
+	logrotatesize := flag.Int64("logrotatesize", 0, "rotate the -logto file when it reaches this many megabytes, 0 to disable")
+	logrotateage := flag.Duration("logrotateage", 0, "rotate the -logto file when it is older than this, i.e. 24h, 0 to disable")
+	logrotatekeep := flag.Int("logrotatekeep", 5, "number of rotated -logto files to keep")
 	chuserto := flag.String("user", "", "user (and, optionally, group) to set UID/GID to")
 	notifyFd := flag.Int("notifyfd", -1, "write a newline to this file-descriptor to indicate readiness to a service manager")
 	flag.Parse()
@@ -65,33 +80,40 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 
 	// Create a new logger that logs output to stdout.
-	var logger *log.Logger
+	format, err := logging.ParseFormat(*logformat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var logger *logging.Logger
 	switch *logto {
 	case "stdout":
-		logger = log.New(os.Stdout, "", log.Flags())
+		logger = logging.New(os.Stdout, format, log.Flags())
 
 	case "syslog":
 		if syslogger, err := gsyslog.NewLogger(gsyslog.LOG_NOTICE, "DAEMON", version.BuildName()); err == nil {
-			logger = log.New(syslogger, "", log.Flags()&^(log.Ldate|log.Ltime))
+			logger = logging.New(syslogger, format, log.Flags()&^(log.Ldate|log.Ltime))
 		}
 
 	default:
-		if logfd, err := os.OpenFile(*logto, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err == nil {
-			logger = log.New(logfd, "", log.Flags())
+		if logfile, err := logging.OpenFile(*logto, *logrotatesize*1024*1024, *logrotateage, *logrotatekeep); err == nil {
+			logger = logging.New(logfile, format, log.Flags())
+			reopenLogOnSignal(ctx, logfile, logger)
 		}
 	}
 	if logger == nil {
-		logger = log.New(os.Stdout, "", log.Flags())
+		logger = logging.New(os.Stdout, format, log.Flags())
 		logger.Warnln("Logging defaulting to stdout")
 	}
 	if *normaliseconf {
-		setLogLevel("error", logger)
+		logger.SetLevel("", logging.LevelError)
+	} else if level, err := logging.ParseLevel(*loglevel); err == nil {
+		logger.SetLevel("", level)
 	} else {
-		setLogLevel(*loglevel, logger)
+		logger.Infoln("Loglevel parse failed. Set default level(info)")
 	}
 
 	cfg := config.GenerateConfig()
-	var err error
 	switch {
 	case *ver:
 		fmt.Println("Build name:", version.BuildName())
@@ -201,12 +223,26 @@ func main() {
 		options := []core.SetupOption{
 			core.NodeInfo(cfg.NodeInfo),
 			core.NodeInfoPrivacy(cfg.NodeInfoPrivacy),
+			core.AutoPeerPriority(cfg.AutoPeerPriority),
 			core.PeerFilter(func(ip net.IP) bool {
 				return !iprange.Contains(ip)
 			}),
 		}
 		for _, addr := range cfg.Listen {
 			options = append(options, core.ListenAddress(addr))
+			if !strings.HasPrefix(strings.ToLower(addr), "stdio:") {
+				continue
+			}
+			if *logto == "stdout" {
+				// Stdout is carrying the peering, so the log has to go elsewhere.
+				logger.SetOutput(os.Stderr)
+			}
+			// There is only one peering on stdin/stdout, so exit once it is
+			// gone, rather than leaving inetd or SSH instances behind.
+			options = append(options, core.StdioClosed(func() {
+				logger.Infof("Peering on stdio closed, shutting down")
+				cancel()
+			}))
 		}
 		for _, peer := range cfg.Peers {
 			options = append(options, core.Peer{URI: peer})
@@ -214,6 +250,15 @@ func main() {
 		if cfg.GroupPassword != "" {
 			options = append(options, core.GroupPassword(cfg.GroupPassword))
 		}
+		if cfg.LinkSocketMark != 0 {
+			options = append(options, core.LinkSocketMark(cfg.LinkSocketMark))
+		}
+		if cfg.LinkVRF != "" {
+			options = append(options, core.LinkVRF(cfg.LinkVRF))
+		}
+		if cfg.LinkNetNS != "" {
+			options = append(options, core.LinkNetNS(cfg.LinkNetNS))
+		}
 		for intf, peers := range cfg.InterfacePeers {
 			for _, peer := range peers {
 				options = append(options, core.Peer{URI: peer, SourceInterface: intf})
@@ -243,11 +288,12 @@ func main() {
 		if cfg.LogLookups {
 			options = append(options, admin.LogLookups{})
 		}
-		if n.admin, err = admin.New(n.core, logger, options...); err != nil {
+		if n.admin, err = admin.New(n.core, logger.Subsystem("admin"), options...); err != nil {
 			panic(err)
 		}
 		if n.admin != nil {
 			n.admin.SetupAdminHandlers()
+			logger.SetupAdminHandlers(n.admin)
 		}
 	}
 
@@ -264,7 +310,7 @@ func main() {
 				Password: intf.Password,
 			})
 		}
-		if n.multicast, err = multicast.New(n.core, logger, options...); err != nil {
+		if n.multicast, err = multicast.New(n.core, logger.Subsystem("multicast"), options...); err != nil {
 			panic(err)
 		}
 		if n.admin != nil && n.multicast != nil {
@@ -277,12 +323,110 @@ func main() {
 		options := []tun.SetupOption{
 			tun.InterfaceName(cfg.IfName),
 			tun.InterfaceMTU(cfg.IfMTU),
+			tun.InterfaceQueues(cfg.IfQueues),
+		}
+		rwc := ipv6rwc.NewReadWriteCloser(n.core)
+		for key, prefixes := range cfg.TunnelRoutes {
+			k, err := hex.DecodeString(key)
+			if err != nil {
+				panic(err)
+			}
+			for _, p := range prefixes {
+				prefix, err := netip.ParsePrefix(p)
+				if err != nil {
+					panic(err)
+				}
+				if err = rwc.AddTunnelRoute(prefix, k); err != nil {
+					panic(err)
+				}
+				options = append(options, tun.InterfaceRoute(prefix.Masked()))
+			}
+		}
+		if cfg.CaptureDirectory != "" {
+			rwc.SetCaptureDirectory(cfg.CaptureDirectory)
+		}
+		if cfg.LookupTimeout > 0 {
+			rwc.SetLookupTimeout(time.Duration(cfg.LookupTimeout) * time.Second)
+		}
+		if cfg.Firewall != nil {
+			for _, r := range cfg.Firewall {
+				rule, err := ipv6rwc.ParseFirewallRule(r.Action, r.Keys, r.Protocol, r.Ports)
+				if err != nil {
+					panic(err)
+				}
+				if err = rwc.AddFirewallRule(rule, -1); err != nil {
+					panic(err)
+				}
+			}
+			rwc.SetFirewall(true)
+		}
+		if cfg.Netstack != nil {
+			// Use a userspace network stack in place of the TUN adapter.
+			nsoptions := []netstack.SetupOption{
+				netstack.SOCKSAddress(cfg.Netstack.SOCKSListen),
+			}
+			for _, f := range cfg.Netstack.LocalForwards {
+				nsoptions = append(nsoptions, netstack.LocalForward(f))
+			}
+			for _, f := range cfg.Netstack.RemoteForwards {
+				nsoptions = append(nsoptions, netstack.RemoteForward(f))
+			}
+			if n.netstack, err = netstack.New(rwc, logger.Subsystem("netstack"), nsoptions...); err != nil {
+				panic(err)
+			}
+		} else if n.tun, err = tun.New(rwc, logger.Subsystem("tun"), options...); err != nil {
+			panic(err)
+		}
+		if n.admin != nil {
+			rwc.SetupAdminHandlers(n.admin)
+			if n.tun != nil {
+				n.tun.SetupAdminHandlers(n.admin)
+			}
+		}
+	}
+
+	// Set up router advertisements on the LAN interface.
+	{
+		options := []radvd.SetupOption{
+			radvd.LANInterface(cfg.LANInterface),
+		}
+		if n.tun != nil && n.tun.IsStarted() {
+			options = append(options, radvd.TUNInterface(n.tun.Name()))
+		}
+		if cfg.LANAdvertiseDNS {
+			for _, addr := range cfg.DNSListen {
+				options = append(options, radvd.DNSListenAddress(addr))
+			}
 		}
-		if n.tun, err = tun.New(ipv6rwc.NewReadWriteCloser(n.core), logger, options...); err != nil {
+		if n.radvd, err = radvd.New(n.core, logger.Subsystem("radvd"), options...); err != nil {
 			panic(err)
 		}
-		if n.admin != nil && n.tun != nil {
-			n.tun.SetupAdminHandlers(n.admin)
+	}
+
+	// Set up the metrics endpoint.
+	{
+		options := []metrics.SetupOption{
+			metrics.ListenAddress(cfg.MetricsListen),
+			metrics.MulticastInterfaces(n.multicast.GetInterfaces),
+		}
+		if n.tun != nil {
+			options = append(options, metrics.TUNStatistics(n.tun.Statistics))
+		}
+		if n.metrics, err = metrics.New(n.core, logger.Subsystem("metrics"), options...); err != nil {
+			panic(err)
+		}
+	}
+
+	// Set up the DNS server.
+	{
+		options := []dns.SetupOption{
+			dns.AliasFile(cfg.DNSAliasFile),
+		}
+		for _, addr := range cfg.DNSListen {
+			options = append(options, dns.ListenAddress(addr))
+		}
+		if n.dns, err = dns.New(n.core, logger.Subsystem("dns"), options...); err != nil {
+			panic(err)
 		}
 	}
 
@@ -313,6 +457,15 @@ func main() {
 	if len(cfg.MulticastInterfaces) > 0 {
 		promises = append(promises, "mcast")
 	}
+	if (*logto != "stdout" && *logto != "syslog") || cfg.CaptureDirectory != "" {
+		// The log file is opened again when it is reopened or rotated, and
+		// capture files are created whenever a capture is started.
+		promises = append(promises, "wpath")
+	}
+	if usesExecLinks(cfg) {
+		// Exec links start their command whenever they connect.
+		promises = append(promises, "proc", "exec")
+	}
 	if err := protect.Pledge(strings.Join(promises, " ")); err != nil {
 		panic(fmt.Sprintf("pledge: %v: %v", promises, err))
 	}
@@ -328,33 +481,28 @@ func main() {
 
 	// Shut down the node.
 	_ = n.admin.Stop()
+	_ = n.metrics.Stop()
+	_ = n.dns.Stop()
+	_ = n.radvd.Stop()
 	_ = n.multicast.Stop()
-	_ = n.tun.Stop()
+	if n.tun != nil {
+		_ = n.tun.Stop()
+	}
+	_ = n.netstack.Stop()
 	n.core.Stop()
 }
 
-func setLogLevel(loglevel string, logger *log.Logger) {
-	levels := [...]string{"error", "warn", "info", "debug", "trace"}
-	loglevel = strings.ToLower(loglevel)
-
-	contains := func() bool {
-		for _, l := range levels {
-			if l == loglevel {
-				return true
-			}
-		}
-		return false
-	}
-
-	if !contains() { // set default log level
-		logger.Infoln("Loglevel parse failed. Set default level(info)")
-		loglevel = "info"
+// usesExecLinks returns true if any peer or listener in the config is run by
+// an exec:// command.
+func usesExecLinks(cfg *config.NodeConfig) bool {
+	uris := append(append([]string{}, cfg.Peers...), cfg.Listen...)
+	for _, peers := range cfg.InterfacePeers {
+		uris = append(uris, peers...)
 	}
-
-	for _, l := range levels {
-		logger.EnableLevel(l)
-		if l == loglevel {
-			break
+	for _, uri := range uris {
+		if strings.HasPrefix(strings.ToLower(uri), "exec:") {
+			return true
 		}
 	}
+	return false
 }
@@ -217,6 +217,10 @@ func run() int {
 			if peer.TXRate > 0 {
 				txr = peer.TXRate.String() + "/s"
 			}
+			priority := fmt.Sprintf("%d", peer.Priority)
+			if peer.Up && peer.Priority != peer.ConfiguredPriority {
+				priority += fmt.Sprintf(" (cfg %d)", peer.ConfiguredPriority)
+			}
 			_ = table.Append([]string{
 				uristring,
 				state,
@@ -228,7 +232,7 @@ func run() int {
 				peer.TXBytes.String(),
 				rxr,
 				txr,
-				fmt.Sprintf("%d", peer.Priority),
+				priority,
 				fmt.Sprintf("%d", peer.Cost),
 				lasterr,
 			})
@@ -274,14 +278,19 @@ func run() int {
 		if err := json.Unmarshal(recv.Response, &resp); err != nil {
 			panic(err)
 		}
-		table.Header([]string{"Public Key", "IP Address", "Uptime", "RX", "TX"})
+		table.Header([]string{"Public Key", "IP Address", "Uptime", "RX", "TX", "MTU"})
 		for _, p := range resp.Sessions {
+			mtu := "-"
+			if p.MTU > 0 {
+				mtu = fmt.Sprintf("%d", p.MTU)
+			}
 			_ = table.Append([]string{
 				p.PublicKey,
 				p.IPAddress,
 				(time.Duration(p.Uptime) * time.Second).String(),
 				p.RXBytes.String(),
 				p.TXBytes.String(),
+				mtu,
 			})
 		}
 		_ = table.Render()
@@ -328,6 +337,13 @@ func run() int {
 		if resp.Enabled {
 			_ = table.Append([]string{"Interface name:", resp.Name})
 			_ = table.Append([]string{"Interface MTU:", fmt.Sprintf("%d", resp.MTU)})
+			_ = table.Append([]string{"Offload:", fmt.Sprintf("%#v", resp.Offload)})
+			for i, q := range resp.Queues {
+				_ = table.Append([]string{
+					fmt.Sprintf("Queue %d:", i),
+					fmt.Sprintf("RX %s (%s/s), TX %s (%s/s)", q.RXBytes, q.RXRate, q.TXBytes, q.TXRate),
+				})
+			}
 		}
 		_ = table.Render()
 
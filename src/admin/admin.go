@@ -1,6 +1,7 @@
 package admin
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -26,6 +27,7 @@ type AdminSocket struct {
 	config   struct {
 		listenaddr ListenAddress
 	}
+	sessionMTU func(ed25519.PublicKey) uint64
 }
 
 type AdminSocketRequest struct {
@@ -70,6 +72,13 @@ func (a *AdminSocket) AddHandler(name, desc string, args []string, handlerfunc c
 	return nil
 }
 
+// SetSessionMTU sets a function which returns the MTU to a remote node, to be
+// shown by getSessions, i.e. (*ipv6rwc.ReadWriteCloser).SessionMTU. It should
+// be called during setup, like AddHandler.
+func (a *AdminSocket) SetSessionMTU(mtu func(ed25519.PublicKey) uint64) {
+	a.sessionMTU = mtu
+}
+
 // Init runs the initial admin setup.
 func New(c *core.Core, log core.Logger, opts ...SetupOption) (*AdminSocket, error) {
 	a := &AdminSocket{
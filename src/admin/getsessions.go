@@ -21,6 +21,7 @@ type SessionEntry struct {
 	RXBytes   DataUnit `json:"bytes_recvd"`
 	TXBytes   DataUnit `json:"bytes_sent"`
 	Uptime    float64  `json:"uptime"`
+	MTU       uint64   `json:"mtu,omitempty"`
 }
 
 func (a *AdminSocket) getSessionsHandler(_ *GetSessionsRequest, res *GetSessionsResponse) error {
@@ -31,13 +32,17 @@ func (a *AdminSocket) getSessionsHandler(_ *GetSessionsRequest, res *GetSessions
 		if addr == nil {
 			continue
 		}
-		res.Sessions = append(res.Sessions, SessionEntry{
+		entry := SessionEntry{
 			IPAddress: net.IP(addr[:]).String(),
 			PublicKey: hex.EncodeToString(s.Key[:]),
 			RXBytes:   DataUnit(s.RXBytes),
 			TXBytes:   DataUnit(s.TXBytes),
 			Uptime:    s.Uptime.Seconds(),
-		})
+		}
+		if a.sessionMTU != nil {
+			entry.MTU = a.sessionMTU(s.Key)
+		}
+		res.Sessions = append(res.Sessions, entry)
 	}
 	slices.SortStableFunc(res.Sessions, func(a, b SessionEntry) int {
 		return strings.Compare(a.PublicKey, b.PublicKey)
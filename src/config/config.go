@@ -46,12 +46,27 @@ type NodeConfig struct {
 	Peers               []string                   `comment:"List of outbound peer connection strings (e.g. tls://a.b.c.d:e or\nsocks://a.b.c.d:e/f.g.h.i:j). Connection strings can contain options,\nsee https://yggdrasil-network.github.io/configurationref.html#peers.\nYggdrasil has no concept of bootstrap nodes - all network traffic\nwill transit peer connections. Therefore make sure to only peer with\nnearby nodes that have good connectivity and low latency. Avoid adding\npeers to this list from distant countries as this will worsen your\nnode's connectivity and performance considerably."`
 	InterfacePeers      map[string][]string        `comment:"List of connection strings for outbound peer connections in URI format,\narranged by source interface, e.g. { \"eth0\": [ \"tls://a.b.c.d:e\" ] }.\nYou should only use this option if your machine is multi-homed and you\nwant to establish outbound peer connections on different interfaces.\nOtherwise you should use \"Peers\"."`
 	Listen              []string                   `comment:"Listen addresses for incoming connections. You will need to add\nlisteners in order to accept incoming peerings from non-local nodes.\nThis is not required if you wish to establish outbound peerings only.\nMulticast peer discovery will work regardless of any listeners set\nhere. Each listener should be specified in URI format as above, e.g.\ntls://0.0.0.0:0 or tls://[::]:0 to listen on all interfaces."`
+	LinkSocketMark      uint32                     `json:",omitempty" comment:"Linux only. Firewall mark (SO_MARK) to set on peering sockets, i.e.\nto stop peerings from being routed through a VPN which itself runs\nover Yggdrasil. Can be overridden per peer with ?mark=X."`
+	LinkVRF             string                     `json:",omitempty" comment:"Linux only. VRF device to bind peering sockets to. Can be overridden\nper peer with ?vrf=X."`
+	LinkNetNS           string                     `json:",omitempty" comment:"Linux only. Named network namespace (or path to one) in which to\nopen peering sockets. Can be overridden per peer with ?netns=X."`
+	AutoPeerPriority    bool                       `json:",omitempty" comment:"Adjust the priority of peerings automatically, so that when there are\nmultiple peerings to the same node (i.e. wired and wireless), the one\nwith the best latency, loss and throughput is used. Changing the priority\nof a peering briefly reconnects it. Only applies to the outbound peerings\nabove and can be overridden per peer with ?autopriority=true|false."`
 	AdminListen         string                     `json:",omitempty" comment:"Listen address for admin connections. Default is to listen for local\nconnections either on TCP/9001 or a UNIX socket depending on your\nplatform. Use this value for yggdrasilctl -endpoint=X. To disable\nthe admin socket, use the value \"none\" instead."`
+	MetricsListen       string                     `json:",omitempty" comment:"Listen address for the Prometheus metrics endpoint, which serves\nstatistics about peers, sessions and routing at /metrics, e.g.\n\"[::1]:9002\". Leave empty or use \"none\" to disable it."`
+	DNSListen           []string                   `json:",omitempty" comment:"Listen addresses for a DNS server which answers for names in the\n\"ygg\" zone, e.g. [ \"[::1]:53\" ]. It answers for <key>.pk.ygg, where\nthe hex public key can be split in two labels as it is too long for\none, for names in DNSAliasFile and for the \"name\" that nearby nodes\npublish in their NodeInfo. Point your system resolver at it for .ygg."`
+	DNSAliasFile        string                     `json:",omitempty" comment:"Path to a hosts-style file of names for the DNS server, with an\naddress or public key followed by names on each line."`
 	MulticastInterfaces []MulticastInterfaceConfig `comment:"Configuration for which interfaces multicast peer discovery should be\nenabled on. Regex is a regular expression which is matched against an\ninterface name, and interfaces use the first configuration that they\nmatch against. Beacon controls whether or not your node advertises its\npresence to others, whereas Listen controls whether or not your node\nlistens out for and tries to connect to other advertising nodes. See\nhttps://yggdrasil-network.github.io/configurationref.html#multicastinterfaces\nfor more supported options."`
 	AllowedPublicKeys   []string                   `comment:"List of peer public keys to allow incoming peering connections\nfrom. If left empty/undefined then all connections will be allowed\nby default. This does not affect outgoing peerings, nor does it\naffect link-local peers discovered via multicast.\nWARNING: THIS IS NOT A FIREWALL and DOES NOT limit who can reach\nopen ports or services running on your machine, for that see the\nGroupPassword option below."`
 	GroupPassword       string                     `comment:"Traffic is only allowed to/from nodes with the same group password.\nIf you want to form a private sub-network or ensure that other public\nusers cannot connect to your machines, choose a strong group password\nand then configure the same password only with other group members.\nIf left empty or not specified, public connectivity will be permitted.\nIf specified, you WILL NOT be able to reach public services or hosts.\nThis option DOES NOT affect peering connections or traffic routing."`
+	TunnelRoutes        map[string][]string        `json:",omitempty" comment:"Additional IPv4 or IPv6 prefixes to route over Yggdrasil, arranged by\nthe public key of the remote node they are routed to, e.g.\n{ \"<key>\": [ \"10.0.1.0/24\", \"fd00:1::/64\" ] }. This allows routing a\nLAN through the network to another site. Traffic from a node is only\naccepted if its source is within the prefixes routed to that node.\nRoutes for these prefixes are added to the TUN adapter."`
+	LookupTimeout       uint64                     `json:",omitempty" comment:"Seconds to wait for a route to a destination to be found before its\npackets are dropped and ICMPv6 Destination Unreachable is returned to\nthe sender, so that connections fail quickly. This counts from the\nfirst packet queued for the destination, rather than restarting with\neach packet as the 2 minute timeout in earlier versions did. Default\nis 10."`
+	Firewall            []FirewallRuleConfig       `json:",omitempty" comment:"Firewall rules for new inbound traffic from the network, for when there\nis no firewall on the TUN adapter, e.g. with Netstack. If set, traffic\nis dropped unless it is a reply to traffic that you sent, an ICMP\nerror or allowed by the first rule that it matches. Action is \"allow\"\nor \"deny\", and the optional Keys, Protocol (\"tcp\", \"udp\" or \"icmp\")\nand destination Ports (i.e. \"22\" or \"8000-8080\") limit what matches,\ne.g. [ { Action: \"allow\", Protocol: \"tcp\", Ports: \"22\" } ]."`
+	CaptureDirectory    string                     `json:",omitempty" comment:"Directory that the startCapture admin command writes packet captures\nto, given only a file name. Captures are disabled unless this is set."`
 	IfName              string                     `comment:"Local network interface name for TUN adapter, or \"auto\" to select\nan interface automatically, or \"none\" to run without TUN."`
 	IfMTU               uint64                     `comment:"Maximum Transmission Unit (MTU) size for your local TUN interface.\nDefault is the largest supported size for your platform. The lowest\npossible value is 1280."`
+	IfQueues            uint64                     `json:",omitempty" comment:"Linux only. Number of queues for the TUN interface, so that packets\nare read and written on several CPU cores at once. Default is 1."`
+	LANInterface        string                     `json:",omitempty" comment:"Linux only. Name of a LAN interface, e.g. \"eth0\", to send IPv6 router\nadvertisements on for your node's routed 300::/64 subnet, so that hosts\non the LAN configure addresses in it and reach the network through your\nnode. Your node takes the first address in the subnet on the interface\nand IPv6 forwarding is turned on, with accept_ra set to 2 on other\ninterfaces that accept router advertisements so that they still do.\nThe network is advertised as an RFC 4191 route rather than a default\nroute, which Linux hosts only use if accept_ra_rt_info_max_plen is 7\nor more and Android hosts ignore."`
+	LANAdvertiseDNS     bool                       `json:",omitempty" comment:"Also advertise the DNS server to hosts on LANInterface, if DNSListen\nincludes port 53 of your node's address on it or of \"[::]\". It only\nanswers for .ygg names, so only turn this on if hosts have another\nresolver for everything else, i.e. one configured by hand or by DHCP."`
+	Netstack            *NetstackConfig            `json:",omitempty" comment:"Run a userspace network stack instead of a TUN adapter, so that the\nnetwork can be used without root, e.g. in a container. IfName and IfMTU\nare ignored if this is set. SOCKSListen is a loopback address to run\nan unauthenticated SOCKS5 proxy on, e.g. \"127.0.0.1:1080\". LocalForwards forward a local\nListen address to a Target on the network and RemoteForwards forward\na Port on your Yggdrasil address to a local Target, with a Protocol\nof \"tcp\" or \"udp\". Only available in builds with the netstack tag."`
 	LogLookups          bool                       `json:",omitempty"`
 	NodeInfoPrivacy     bool                       `comment:"By default, nodeinfo contains some defaults including the platform,\narchitecture and Yggdrasil version. These can help when surveying\nthe network and diagnosing network routing problems. Enabling\nnodeinfo privacy prevents this, so that only items specified in\n\"NodeInfo\" are sent back if specified."`
 	NodeInfo            map[string]interface{}     `comment:"Optional nodeinfo. This must be a { \"key\": \"value\", ... } map\nor set as null. This is entirely optional but, if set, is visible\nto the whole network on request."`
@@ -66,6 +81,31 @@ type MulticastInterfaceConfig struct {
 	Password string
 }
 
+type FirewallRuleConfig struct {
+	Action   string
+	Keys     []string `json:",omitempty"`
+	Protocol string   `json:",omitempty"`
+	Ports    string   `json:",omitempty"`
+}
+
+type NetstackConfig struct {
+	SOCKSListen    string                  `json:",omitempty"`
+	LocalForwards  []NetstackLocalForward  `json:",omitempty"`
+	RemoteForwards []NetstackRemoteForward `json:",omitempty"`
+}
+
+type NetstackLocalForward struct {
+	Protocol string
+	Listen   string
+	Target   string
+}
+
+type NetstackRemoteForward struct {
+	Protocol string
+	Port     uint16
+	Target   string
+}
+
 // Generates default configuration and returns a pointer to the resulting
 // NodeConfig. This is used when outputting the -genconf parameter and also when
 // using -autoconf.
@@ -8,6 +8,9 @@ import (
 	"io"
 	"net"
 	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	iwe "github.com/Arceliar/ironwood/encrypted"
 	iwn "github.com/Arceliar/ironwood/network"
@@ -43,8 +46,15 @@ type Core struct {
 		nodeinfoPrivacy    NodeInfoPrivacy            // immutable after startup
 		_allowedPublicKeys map[[32]byte]struct{}      // configurable after startup
 		groupPassword      string                     // immutable after startup
+		autoPriority       AutoPeerPriority           // immutable after startup
+		socket             linkSocketOptions          // immutable after startup
+		stdioClosed        func()                     // immutable after startup
 	}
 	pathNotify func(ed25519.PublicKey)
+	mtuNotify  func(ed25519.PublicKey, uint64)
+	streams    atomic.Pointer[func(ed25519.PublicKey, []byte)]
+	datagrams  datagrams
+	receiver   receiver
 }
 
 func New(cert *tls.Certificate, logger Logger, opts ...SetupOption) (*Core, error) {
@@ -55,6 +65,7 @@ func New(cert *tls.Certificate, logger Logger, opts ...SetupOption) (*Core, erro
 	if c.log == nil {
 		c.log = log.New(io.Discard, "", 0)
 	}
+	c.log = logWith(c.log, "subsystem", "core")
 
 	if name := version.BuildName(); name != "unknown" {
 		c.log.Infoln("Build name:", name)
@@ -65,6 +76,8 @@ func New(cert *tls.Certificate, logger Logger, opts ...SetupOption) (*Core, erro
 
 	var err error
 	c.config._listeners = map[ListenAddress]struct{}{}
+	c.receiver.traffic = make(chan receivedPacket)
+	c.receiver.wake = make(chan struct{})
 	c.config._allowedPublicKeys = map[[32]byte]struct{}{}
 	for _, opt := range opts {
 		switch opt.(type) {
@@ -173,38 +186,158 @@ func (c *Core) MTU() uint64 {
 }
 
 func (c *Core) ReadFrom(p []byte) (n int, from net.Addr, err error) {
+	r := &c.receiver
+	for {
+		r.mutex.Lock()
+		if !r.receiving {
+			r.readers++
+			r.mutex.Unlock()
+			break
+		}
+		// Wait for the receiver to finish reading, in case what it reads is
+		// traffic for us.
+		r.waiting++
+		wake := r.wake
+		r.mutex.Unlock()
+		select {
+		case packet := <-r.traffic:
+			// The receiver doesn't read again until we stop waiting
+			n = copy(p, packet.data)
+			r.mutex.Lock()
+			r.waiting--
+			r.lastRead = time.Now()
+			r.mutex.Unlock()
+			return n, packet.from, nil
+		case <-wake:
+			r.mutex.Lock()
+			r.waiting--
+			r.mutex.Unlock()
+		}
+	}
+	defer func() {
+		r.mutex.Lock()
+		r.readers--
+		r.lastRead = time.Now()
+		r.mutex.Unlock()
+	}()
 	buf := allocBytes(int(c.PacketConn.MTU()))
 	defer freeBytes(buf)
 	for {
-		bs := buf
-		n, from, err = c.PacketConn.ReadFrom(bs)
+		n, from, err = c.PacketConn.ReadFrom(buf)
 		if err != nil {
 			return 0, from, err
 		}
-		if n == 0 {
-			continue
-		}
-		switch bs[0] {
-		case typeSessionTraffic:
-			// This is what we want to handle here
-		case typeSessionProto:
-			var key keyArray
-			copy(key[:], from.(iwt.Addr))
-			data := append([]byte(nil), bs[1:n]...)
-			c.proto.handleProto(nil, key, data)
+		bs := c.handlePacket(buf[:n], from)
+		if bs == nil {
 			continue
-		default:
-			continue
-		}
-		bs = bs[1:n]
-		copy(p, bs)
-		if len(p) < len(bs) {
-			n = len(p)
-		} else {
-			n = len(bs)
 		}
-		return
+		return copy(p, bs), from, nil
+	}
+}
+
+// handlePacket handles a packet from the PacketConn which isn't traffic,
+// returning the traffic for ReadFrom otherwise.
+func (c *Core) handlePacket(bs []byte, from net.Addr) []byte {
+	if len(bs) == 0 {
+		return nil
+	}
+	switch bs[0] {
+	case typeSessionTraffic:
+		// This is what we want to handle here
+		return bs[1:]
+	case typeSessionProto:
+		var key keyArray
+		copy(key[:], from.(iwt.Addr))
+		data := append([]byte(nil), bs[1:]...)
+		c.proto.handleProto(nil, key, data)
+	case typeSessionStream:
+		key := append(ed25519.PublicKey(nil), from.(iwt.Addr)...)
+		data := append([]byte(nil), bs[1:]...)
+		c.Act(nil, func() {
+			if handler := c.streams.Load(); handler != nil {
+				(*handler)(key, data)
+			}
+		})
+	case typeSessionDatagram:
+		key := append(ed25519.PublicKey(nil), from.(iwt.Addr)...)
+		data := append([]byte(nil), bs[1:]...)
+		c.datagrams.deliver(key, data)
 	}
+	return nil
+}
+
+// Stream packets and datagrams arrive in the same sessions as traffic, so
+// something has to be reading from the PacketConn for them to be received.
+// Usually that is ReadFrom, i.e. the TUN adapter, which handles them as it
+// goes. Once a stream handler is set or ListenPacket is called, the receiver
+// also reads from the PacketConn, but only while nothing has called ReadFrom
+// for a while, so that applications which only use streams or datagrams
+// don't have to. Traffic that it reads is given to ReadFrom if something
+// calls it in the meantime, otherwise it is dropped and counted.
+const receiveIdle = time.Second
+
+type receiver struct {
+	once      sync.Once
+	mutex     sync.Mutex
+	receiving bool          // The receiver is reading from the PacketConn
+	wake      chan struct{} // Closed when the receiver has finished reading
+	readers   int           // ReadFrom calls reading from the PacketConn
+	waiting   int           // ReadFrom calls waiting for the receiver
+	lastRead  time.Time     // When a ReadFrom call last returned
+	traffic   chan receivedPacket
+	dropped   atomic.Uint64
+}
+
+type receivedPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// startReceiving starts the receiver, if it isn't running already. It keeps
+// running until the core is stopped.
+func (c *Core) startReceiving() {
+	r := &c.receiver
+	r.once.Do(func() {
+		go func() {
+			buf := make([]byte, c.PacketConn.MTU())
+			for {
+				r.mutex.Lock()
+				if r.readers > 0 || r.waiting > 0 || time.Since(r.lastRead) < receiveIdle {
+					r.mutex.Unlock()
+					select {
+					case <-c.ctx.Done():
+						return
+					case <-time.After(receiveIdle):
+					}
+					continue
+				}
+				r.receiving = true
+				r.mutex.Unlock()
+				n, from, err := c.PacketConn.ReadFrom(buf)
+				var bs []byte
+				if err == nil {
+					bs = c.handlePacket(buf[:n], from)
+				}
+				r.mutex.Lock()
+				if bs != nil {
+					if r.waiting > 0 {
+						// A waiting ReadFrom call only stops waiting once it
+						// has this or we have finished, so this won't block.
+						r.traffic <- receivedPacket{bs, from}
+					} else {
+						r.dropped.Add(1)
+					}
+				}
+				r.receiving = false
+				close(r.wake)
+				r.wake = make(chan struct{})
+				r.mutex.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}()
+	})
 }
 
 func (c *Core) WriteTo(p []byte, addr net.Addr) (n int, err error) {
@@ -233,6 +366,48 @@ func (c *Core) SetPathNotify(notify func(ed25519.PublicKey)) {
 	})
 }
 
+func (c *Core) doMTUNotify(key ed25519.PublicKey, mtu uint64) {
+	c.Act(nil, func() {
+		if c.mtuNotify != nil {
+			c.mtuNotify(key, mtu)
+		}
+	})
+}
+
+// SetMTUNotify sets a function to be called when a remote node advertises
+// the largest packet that it will accept, see AdvertiseMTU.
+func (c *Core) SetMTUNotify(notify func(ed25519.PublicKey, uint64)) {
+	c.Act(nil, func() {
+		c.mtuNotify = notify
+	})
+}
+
+// SetStreamHandler sets a function to be called with each stream packet that
+// is received from a remote node, in the order that they are received, see
+// the stream package. The handler is called from the core's actor, so it
+// shouldn't block. Setting a handler starts the core
+// reading from the network itself, so that stream packets are received even
+// if nothing calls ReadFrom.
+func (c *Core) SetStreamHandler(handler func(ed25519.PublicKey, []byte)) {
+	if handler == nil {
+		c.streams.Store(nil)
+		return
+	}
+	c.streams.Store(&handler)
+	c.startReceiving()
+}
+
+// WriteStream sends a stream packet to a remote node. It is subject to the
+// same MTU as WriteTo.
+func (c *Core) WriteStream(key ed25519.PublicKey, p []byte) error {
+	buf := allocBytes(0)
+	defer func() { freeBytes(buf) }()
+	buf = append(buf, typeSessionStream)
+	buf = append(buf, p...)
+	_, err := c.PacketConn.WriteTo(buf, iwt.Addr(key))
+	return err
+}
+
 type Logger interface {
 	Printf(string, ...interface{})
 	Println(...interface{})
@@ -246,3 +421,20 @@ type Logger interface {
 	Debugln(...interface{})
 	Traceln(...interface{})
 }
+
+// StructuredLogger is a Logger which can attach fields to its messages, i.e.
+// the subsystem that they came from or the peer that they are about. If the
+// Logger given to New implements it then these fields are added, otherwise
+// they only appear in the text of the messages.
+type StructuredLogger interface {
+	Logger
+	With(keyvals ...interface{}) Logger
+}
+
+// logWith adds the key and value pairs to the logger if it is structured.
+func logWith(log Logger, keyvals ...interface{}) Logger {
+	if sl, ok := log.(StructuredLogger); ok {
+		return sl.With(keyvals...)
+	}
+	return log
+}
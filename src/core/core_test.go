@@ -5,12 +5,15 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"net"
 	"net/url"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	iwt "github.com/Arceliar/ironwood/types"
 	"github.com/gologme/log"
 	"github.com/yggdrasil-network/yggdrasil-go/src/config"
 )
@@ -264,6 +267,7 @@ func TestAllowedPublicKeys(t *testing.T) {
 	require_Equal(t, len(peers), 1)
 	require_True(t, !peers[0].Up)
 	require_True(t, peers[0].LastError != nil)
+	require_True(t, nodeA.GetHandshakeFailures()["not_allowed"] > 0)
 }
 
 func TestAllowedPublicKeysLocal(t *testing.T) {
@@ -378,3 +382,204 @@ func TestGroupPassword(t *testing.T) {
 	_, _, err = connC.ReadFrom(buf[:])
 	require_Error(t, err)
 }
+
+func TestAddConn(t *testing.T) {
+	logger := GetLoggerWithPrefix("", false)
+	cfgA, cfgB := config.GenerateConfig(), config.GenerateConfig()
+	require_NoError(t, cfgA.GenerateSelfSignedCertificate())
+	require_NoError(t, cfgB.GenerateSelfSignedCertificate())
+
+	nodeA, err := New(cfgA.Certificate, logger)
+	require_NoError(t, err)
+	defer nodeA.Stop()
+
+	nodeB, err := New(cfgB.Certificate, logger)
+	require_NoError(t, err)
+	defer nodeB.Stop()
+
+	connA, connB := net.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- nodeA.AddConn(t.Context(), connA, LinkOptions{
+			PinnedKeys: []ed25519.PublicKey{nodeB.PublicKey()},
+		})
+	}()
+	require_NoError(t, nodeB.AddConn(t.Context(), connB, LinkOptions{Priority: 3}))
+	require_NoError(t, <-errs)
+
+	require_True(t, WaitConnected(nodeA, nodeB))
+	peers := nodeA.GetPeers()
+	require_Equal(t, len(peers), 1)
+	require_True(t, peers[0].Up)
+	require_True(t, peers[0].Key.Equal(nodeB.PublicKey()))
+	require_Equal(t, peers[0].Priority, 3)
+
+	// Every net.Pipe has the same address, but is still a separate link.
+	cfgC := config.GenerateConfig()
+	nodeC, err := New(cfgC.Certificate, logger)
+	require_NoError(t, err)
+	defer nodeC.Stop()
+
+	connA, connC := net.Pipe()
+	go func() {
+		errs <- nodeA.AddConn(t.Context(), connA, LinkOptions{})
+	}()
+	require_NoError(t, nodeC.AddConn(t.Context(), connC, LinkOptions{}))
+	require_NoError(t, <-errs)
+	require_Equal(t, len(nodeA.GetPeers()), 2)
+
+	// A connection to a node which doesn't match the pinned key
+	// must fail the handshake.
+	cfgD := config.GenerateConfig()
+	nodeD, err := New(cfgD.Certificate, logger)
+	require_NoError(t, err)
+	defer nodeD.Stop()
+
+	connD, connC := net.Pipe()
+	go func() {
+		errs <- nodeD.AddConn(t.Context(), connD, LinkOptions{
+			PinnedKeys: []ed25519.PublicKey{nodeB.PublicKey()},
+		})
+	}()
+	_ = nodeC.AddConn(t.Context(), connC, LinkOptions{})
+	err = <-errs
+	require_Error(t, err)
+	require_True(t, strings.Contains(err.Error(), "pinned keys"))
+}
+
+func TestServe(t *testing.T) {
+	logger := GetLoggerWithPrefix("", false)
+	cfgA, cfgB := config.GenerateConfig(), config.GenerateConfig()
+	require_NoError(t, cfgA.GenerateSelfSignedCertificate())
+	require_NoError(t, cfgB.GenerateSelfSignedCertificate())
+
+	nodeA, err := New(cfgA.Certificate, logger)
+	require_NoError(t, err)
+	defer nodeA.Stop()
+
+	nodeB, err := New(cfgB.Certificate, logger)
+	require_NoError(t, err)
+	defer nodeB.Stop()
+
+	nl, err := net.Listen("tcp", "localhost:0")
+	require_NoError(t, err)
+	l, err := nodeA.Serve(nl, LinkOptions{})
+	require_NoError(t, err)
+
+	u, err := url.Parse("tcp://" + l.Addr().String())
+	require_NoError(t, err)
+	require_NoError(t, nodeB.AddPeer(u, ""))
+
+	require_True(t, WaitConnected(nodeA, nodeB))
+	peers := nodeA.GetPeers()
+	require_Equal(t, len(peers), 1)
+	require_True(t, peers[0].Up)
+	require_True(t, peers[0].Inbound)
+
+	l.Cancel()
+	_, err = net.Dial("tcp", nl.Addr().String())
+	require_Error(t, err)
+}
+
+func TestAdvertiseMTU(t *testing.T) {
+	nodeA, nodeB := CreateAndConnectTwo(t, false)
+	defer nodeA.Stop()
+	defer nodeB.Stop()
+	require_True(t, WaitConnected(nodeA, nodeB))
+
+	type advert struct {
+		key ed25519.PublicKey
+		mtu uint64
+	}
+	adverts := make(chan advert, 16)
+	nodeB.SetMTUNotify(func(key ed25519.PublicKey, mtu uint64) {
+		adverts <- advert{key, mtu}
+	})
+	for _, node := range []*Core{nodeA, nodeB} {
+		go func() {
+			// Handshakes and protocol traffic are handled while reading
+			buf := make([]byte, node.MTU())
+			for {
+				if _, _, err := node.ReadFrom(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	// The first may only start the session, so keep sending
+	for i := 0; ; i++ {
+		nodeA.AdvertiseMTU(nodeB.PublicKey(), 1500)
+		select {
+		case a := <-adverts:
+			require_True(t, a.key.Equal(nodeA.PublicKey()))
+			require_Equal(t, a.mtu, 1500)
+			return
+		case <-time.After(500 * time.Millisecond):
+			if i == 10 {
+				t.Fatal("MTU advertisement wasn't received")
+			}
+		}
+	}
+}
+
+func TestListenPacket(t *testing.T) {
+	nodeA, nodeB := CreateAndConnectTwo(t, false)
+	defer nodeA.Stop()
+	defer nodeB.Stop()
+	require_True(t, WaitConnected(nodeA, nodeB))
+
+	pcA, err := nodeA.ListenPacket(1234)
+	require_NoError(t, err)
+	defer pcA.Close()
+	pcB, err := nodeB.ListenPacket(1234)
+	require_NoError(t, err)
+	defer pcB.Close()
+	other, err := nodeB.ListenPacket(4321)
+	require_NoError(t, err)
+	defer other.Close()
+	_, err = nodeB.ListenPacket(1234)
+	require_Error(t, err)
+
+	// The first may only start the session, so keep sending
+	msg := []byte("hello")
+	buf := make([]byte, 64)
+	for i := 0; ; i++ {
+		_, err = pcA.WriteTo(msg, iwt.Addr(nodeB.PublicKey()))
+		require_NoError(t, err)
+		require_NoError(t, pcB.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+		n, from, err := pcB.ReadFrom(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) && i < 10 {
+			continue
+		}
+		require_NoError(t, err)
+		require_True(t, bytes.Equal(buf[:n], msg))
+		require_True(t, ed25519.PublicKey(from.(iwt.Addr)).Equal(nodeA.PublicKey()))
+		break
+	}
+
+	// Datagrams only go to the same port.
+	require_NoError(t, other.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, _, err = other.ReadFrom(buf)
+	require_True(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	require_NoError(t, pcB.Close())
+	_, _, err = pcB.ReadFrom(buf)
+	require_True(t, errors.Is(err, net.ErrClosed))
+	pcB, err = nodeB.ListenPacket(1234)
+	require_NoError(t, err)
+	require_NoError(t, pcB.Close())
+
+	// Traffic still reaches ReadFrom when it is called after being idle.
+	done := CreateEchoListener(t, nodeA, 1500, 1)
+	packet := make([]byte, 1500)
+	packet[0] = 0x60
+	copy(packet[8:24], nodeB.Address())
+	copy(packet[24:40], nodeA.Address())
+	_, err = nodeB.WriteTo(packet, nodeA.LocalAddr())
+	require_NoError(t, err)
+	_, _, err = nodeB.ReadFrom(packet)
+	require_NoError(t, err)
+	<-done
+	require_Equal(t, nodeA.GetSelf().DroppedTraffic, 0)
+}
@@ -0,0 +1,192 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	iwt "github.com/Arceliar/ironwood/types"
+)
+
+const (
+	datagramHeaderSize = 2  // Port
+	datagramQueueSize  = 64 // Packets waiting to be read from each port
+)
+
+type datagram struct {
+	from ed25519.PublicKey
+	data []byte
+}
+
+// datagrams holds the PacketConns that were opened by ListenPacket.
+type datagrams struct {
+	mutex sync.Mutex
+	ports map[uint16]*datagramConn
+}
+
+// deliver passes a datagram to the PacketConn for its port. It is dropped if
+// nothing is listening on the port or if too many are waiting to be read.
+func (d *datagrams) deliver(from ed25519.PublicKey, bs []byte) {
+	if len(bs) < datagramHeaderSize {
+		return
+	}
+	port := binary.BigEndian.Uint16(bs)
+	d.mutex.Lock()
+	pc := d.ports[port]
+	d.mutex.Unlock()
+	if pc == nil {
+		return
+	}
+	select {
+	case pc.packets <- datagram{from, bs[datagramHeaderSize:]}:
+	default:
+	}
+}
+
+// ListenPacket returns a PacketConn for datagrams on the port, which are
+// sent to and received from the same port on remote nodes. Addresses are
+// iwt.Addr, i.e. the public keys of nodes. This lets applications exchange
+// their own datagrams alongside the traffic that is read with ReadFrom. Like
+// SetStreamHandler, it starts the core reading from the network itself, so
+// that datagrams are received even if nothing calls ReadFrom.
+func (c *Core) ListenPacket(port uint16) (net.PacketConn, error) {
+	c.startReceiving()
+	d := &c.datagrams
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.ports == nil {
+		d.ports = make(map[uint16]*datagramConn)
+	}
+	if d.ports[port] != nil {
+		return nil, fmt.Errorf("datagram port %d is already in use", port)
+	}
+	pc := &datagramConn{
+		core:    c,
+		port:    port,
+		packets: make(chan datagram, datagramQueueSize),
+		closed:  make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	d.ports[port] = pc
+	return pc, nil
+}
+
+type datagramConn struct {
+	core          *Core
+	port          uint16
+	packets       chan datagram
+	closed        chan struct{}
+	mutex         sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	changed       chan struct{} // Closed when the read deadline changes
+}
+
+func (pc *datagramConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		// Don't return a queued datagram once the PacketConn is closed
+		select {
+		case <-pc.closed:
+			return 0, nil, net.ErrClosed
+		default:
+		}
+		pc.mutex.Lock()
+		deadline, changed := pc.readDeadline, pc.changed
+		pc.mutex.Unlock()
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+		select {
+		case packet := <-pc.packets:
+			n, addr = copy(p, packet.data), iwt.Addr(packet.from)
+		case <-pc.closed:
+			err = net.ErrClosed
+		case <-expired:
+			err = os.ErrDeadlineExceeded
+		case <-changed:
+			// Wait again with the new deadline
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if addr != nil || err != nil {
+			return
+		}
+	}
+}
+
+func (pc *datagramConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	key, ok := addr.(iwt.Addr)
+	if !ok || len(key) != ed25519.PublicKeySize {
+		return 0, errors.New("address must be an ironwood address")
+	}
+	select {
+	case <-pc.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	pc.mutex.Lock()
+	deadline := pc.writeDeadline
+	pc.mutex.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	buf := allocBytes(0)
+	defer func() { freeBytes(buf) }()
+	buf = append(buf, typeSessionDatagram)
+	buf = binary.BigEndian.AppendUint16(buf, pc.port)
+	buf = append(buf, p...)
+	if _, err = pc.core.PacketConn.WriteTo(buf, key); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (pc *datagramConn) Close() error {
+	d := &pc.core.datagrams
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.ports[pc.port] != pc {
+		return net.ErrClosed
+	}
+	delete(d.ports, pc.port)
+	close(pc.closed)
+	return nil
+}
+
+func (pc *datagramConn) LocalAddr() net.Addr {
+	return iwt.Addr(pc.core.public)
+}
+
+func (pc *datagramConn) SetDeadline(t time.Time) error {
+	_ = pc.SetReadDeadline(t)
+	return pc.SetWriteDeadline(t)
+}
+
+func (pc *datagramConn) SetReadDeadline(t time.Time) error {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	pc.readDeadline = t
+	close(pc.changed)
+	pc.changed = make(chan struct{})
+	return nil
+}
+
+func (pc *datagramConn) SetWriteDeadline(t time.Time) error {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	pc.writeDeadline = t
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
@@ -38,16 +39,24 @@ type links struct {
 	unix  *linkUNIX  // UNIX interface support
 	socks *linkSOCKS // SOCKS interface support
 	quic  *linkQUIC  // QUIC interface support
+	wt    *linkWT    // WebTransport interface support
 	ws    *linkWS    // WS interface support
 	wss   *linkWSS   // WSS interface support
+	exec  *linkExec  // Exec interface support
+	stdio *linkStdio // Stdio interface support
+	log   Logger     // Logger for the links subsystem
 	// _links can only be modified safely from within the links actor
 	_links     map[linkInfo]*link // *link is nil if connection in progress
 	_listeners map[*Listener]context.CancelFunc
+	// _handshakeFailures counts failed handshakes by reason
+	_handshakeFailures map[string]uint64
+	// addedConns numbers the connections given to AddConn
+	addedConns atomic.Uint64
 }
 
 type linkProtocol interface {
 	dial(ctx context.Context, url *url.URL, info linkInfo, options linkOptions) (net.Conn, error)
-	listen(ctx context.Context, url *url.URL, sintf string) (net.Listener, error)
+	listen(ctx context.Context, url *url.URL, sintf string, options linkOptions) (net.Listener, error)
 }
 
 // linkInfo is used as a map key
@@ -63,10 +72,22 @@ type link struct {
 	kick      chan struct{}      // Attempt to reconnect now, if backing off
 	linkType  linkType           // Type of link, i.e. outbound/inbound, persistent/ephemeral
 	linkProto string             // Protocol carrier of link, e.g. TCP, AWDL
+	priority  uint8              // Configured priority of the link
+	// Whether the priority is adjusted automatically, see link_priority.go
+	autoPriority bool
 	// The remaining fields can only be modified safely from within the links actor
-	_conn    *linkConn // Connected link, if any, nil if not connected
-	_err     error     // Last error on the connection, if any
-	_errtime time.Time // Last time an error occurred
+	_conn      *linkConn // Connected link, if any, nil if not connected
+	_err       error     // Last error on the connection, if any
+	_errtime   time.Time // Last time an error occurred
+	_priority  uint8     // Effective priority, used for the next connection
+	_latency   float64   // Moving average of the link latency in nanoseconds
+	_loss      float64   // Moving average of the fraction of unanswered probes
+	_peakRate  uint64    // Highest combined RX and TX rate seen, in bytes per second
+	_cost      float64   // Cost combining the above, see link_priority.go
+	_samples   int       // Number of latency measurements taken
+	_preferred bool      // Whether this is the preferred link to the peer
+	_changed   time.Time // Last time the preferred link to the peer changed
+	_reconnect bool      // Reconnect without backing off, to apply a new priority
 }
 
 type linkOptions struct {
@@ -75,6 +96,14 @@ type linkOptions struct {
 	tlsSNI            string
 	password          []byte
 	maxBackoff        time.Duration
+	proxy             *url.URL // Proxy to tunnel outbound connections through
+	proxyDirect       bool     // Don't use a proxy from the environment
+	proxyEnv          bool     // Use a proxy from the environment for any scheme
+	keepAlive         time.Duration
+	idleTimeout       time.Duration
+	proxyProtocol     int         // PROXY protocol version expected on inbound connections, if any
+	httpHeaders       http.Header // Extra headers for the HTTP request when dialling ws and wss peers
+	linkSocketOptions
 }
 
 type Listener struct {
@@ -89,17 +118,23 @@ func (l *Listener) Addr() net.Addr {
 
 func (l *links) init(c *Core) error {
 	l.core = c
+	l.log = logWith(c.log, "subsystem", "links")
 	l.tcp = l.newLinkTCP()
 	l.tls = l.newLinkTLS(l.tcp)
 	l.unix = l.newLinkUNIX()
 	l.socks = l.newLinkSOCKS()
 	l.quic = l.newLinkQUIC()
+	l.wt = l.newLinkWT()
 	l.ws = l.newLinkWS()
 	l.wss = l.newLinkWSS()
+	l.exec = l.newLinkExec()
+	l.stdio = l.newLinkStdio()
 	l._links = make(map[linkInfo]*link)
 	l._listeners = make(map[*Listener]context.CancelFunc)
+	l._handshakeFailures = make(map[string]uint64)
 
 	l.Act(nil, l._updateAverages)
+	time.AfterFunc(autoPriorityInterval, l.updatePriorities)
 	return nil
 }
 
@@ -153,9 +188,19 @@ const ErrLinkPinnedKeyInvalid = linkError("pinned public key is invalid")
 const ErrLinkPasswordInvalid = linkError("invalid password supplied")
 const ErrLinkUnrecognisedSchema = linkError("link schema unknown")
 const ErrLinkMaxBackoffInvalid = linkError("max backoff duration invalid")
+const ErrLinkAutoPriorityInvalid = linkError("automatic priority value is invalid")
 const ErrLinkSNINotSupported = linkError("SNI not supported on this link type")
 const ErrLinkNoSuitableIPs = linkError("peer has no suitable addresses")
 const ErrLinkToSelf = linkError("node cannot connect to self")
+const ErrLinkSocketMarkInvalid = linkError("socket mark value is invalid")
+const ErrLinkTimeoutInvalid = linkError("keepalive or idle timeout value is invalid")
+const ErrLinkProxyProtocolInvalid = linkError("PROXY protocol version is invalid")
+const ErrLinkProxyProtocolNotSupported = linkError("PROXY protocol not supported on this link type")
+const ErrLinkHeaderInvalid = linkError("HTTP header is invalid")
+const ErrLinkProxyInvalid = linkError("proxy URL is invalid")
+const ErrLinkProxyNotSupported = linkError("proxy not supported on this link type")
+const ErrLinkExecNotAllowed = linkError("exec peers can only be configured at startup")
+const ErrLinkSocketOptionsUnsupported = linkError("socket mark, VRF and network namespace options are not supported on this platform")
 
 func (l *links) add(u *url.URL, sintf string, linkType linkType) error {
 	if _, err := l.dialerFor(u); err != nil {
@@ -212,6 +257,34 @@ func (l *links) add(u *url.URL, sintf string, linkType linkType) error {
 			}
 			options.maxBackoff = d
 		}
+		autoPriority, err := l.parseAutoPriority(u.Query().Get("autopriority"))
+		if err != nil {
+			retErr = err
+			return
+		}
+		if p := u.Query().Get("proxy"); p != "" {
+			switch strings.ToLower(u.Scheme) {
+			case "tcp", "tls", "ws", "wss":
+			default:
+				retErr = ErrLinkProxyNotSupported
+				return
+			}
+			if options.proxy, options.proxyDirect, options.proxyEnv, retErr = parseLinkProxy(p); retErr != nil {
+				return
+			}
+		}
+		if options.keepAlive, options.idleTimeout, retErr = linkTimeoutsFor(u); retErr != nil {
+			return
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "ws", "wss":
+			if options.httpHeaders, retErr = parseWSHeaders(u); retErr != nil {
+				return
+			}
+		}
+		if options.linkSocketOptions, retErr = l.socketOptionsFor(u); retErr != nil {
+			return
+		}
 		// SNI headers must contain hostnames and not IP addresses, so we must make sure
 		// that we do not populate the SNI with an IP literal. We do this by splitting
 		// the host-port combo from the query option and then seeing if it parses to an
@@ -250,6 +323,11 @@ func (l *links) add(u *url.URL, sintf string, linkType linkType) error {
 			linkType:  linkType,
 			linkProto: strings.ToUpper(u.Scheme),
 			kick:      make(chan struct{}),
+			priority:  options.priority,
+			_priority: options.priority,
+			// Only persistent links are reconnected by us, so those are
+			// the only ones whose priority can be changed.
+			autoPriority: autoPriority && linkType == linkTypePersistent,
 		}
 		state.ctx, state.cancel = context.WithCancel(l.core.ctx)
 
@@ -325,7 +403,7 @@ func (l *links) add(u *url.URL, sintf string, linkType linkType) error {
 				conn, err := l.connect(state.ctx, u, info, options)
 				if err != nil || conn == nil {
 					if err == nil && conn == nil {
-						l.core.log.Warnf("Link %q reached inconsistent error state", u.String())
+						l.log.Warnf("Link %q reached inconsistent error state", info.uri)
 					}
 					if linkType == linkTypePersistent {
 						// If the link is a persistent configured peering,
@@ -360,8 +438,10 @@ func (l *links) add(u *url.URL, sintf string, linkType linkType) error {
 				}
 
 				// Update the link state with our newly wrapped connection.
-				// Clear the error state.
+				// Clear the error state. The priority may have been changed
+				// automatically since the link was configured.
 				var doRet bool
+				connOptions := options
 				phony.Block(l, func() {
 					if state._conn != nil {
 						// If a peering has come up in this time, abort this one.
@@ -370,6 +450,7 @@ func (l *links) add(u *url.URL, sintf string, linkType linkType) error {
 					state._conn = lc
 					state._err = nil
 					state._errtime = time.Now()
+					connOptions.priority = state._priority
 				})
 				if doRet {
 					return
@@ -377,7 +458,7 @@ func (l *links) add(u *url.URL, sintf string, linkType linkType) error {
 
 				// Give the connection to the handler. The handler will block
 				// for the lifetime of the connection.
-				switch err = l.handler(linkType, options, lc, resetBackoff, false); {
+				switch err = l.handler(linkType, connOptions, lc, resetBackoff, false); {
 				case errors.Is(err, ErrLinkToSelf):
 					// This is a pretty permanent error, don't retry.
 					backoff = -1
@@ -385,13 +466,14 @@ func (l *links) add(u *url.URL, sintf string, linkType linkType) error {
 				case errors.Is(err, io.EOF):
 				case errors.Is(err, net.ErrClosed):
 				default:
-					l.core.log.Debugf("Link %s error: %s\n", u.Host, err)
+					l.log.Debugf("Link %s error: %s\n", u.Host, err)
 				}
 
 				// The handler has stopped running so the connection is dead,
 				// try to close the underlying socket just in case and then
 				// update the link state.
 				_ = lc.Close()
+				var reconnect bool
 				phony.Block(l, func() {
 					state._conn = nil
 					if err == nil {
@@ -399,12 +481,15 @@ func (l *links) add(u *url.URL, sintf string, linkType linkType) error {
 					}
 					state._err = err
 					state._errtime = time.Now()
+					reconnect, state._reconnect = state._reconnect, false
 				})
 
 				// If the link is persistently configured, back off if needed
-				// and then try reconnecting. Otherwise, exit out.
+				// and then try reconnecting. Otherwise, exit out. If we closed
+				// the link ourselves to change the priority then reconnect
+				// straight away.
 				if linkType == linkTypePersistent {
-					if backoffNow() {
+					if reconnect || backoffNow() {
 						continue
 					}
 				}
@@ -455,24 +540,68 @@ func (l *links) listen(u *url.URL, sintf string, local bool) (*Listener, error)
 		protocol = l.unix
 	case "quic":
 		protocol = l.quic
+	case "wt":
+		protocol = l.wt
 	case "ws":
 		protocol = l.ws
 	case "wss":
 		protocol = l.wss
+	case "stdio":
+		protocol = l.stdio
 	default:
 		ctxcancel()
 		return nil, ErrLinkUnrecognisedSchema
 	}
-	listener, err := protocol.listen(ctx, u, sintf)
+	var options linkOptions
+	if p := u.Query().Get("priority"); p != "" {
+		pi, err := strconv.ParseUint(p, 10, 8)
+		if err != nil {
+			ctxcancel()
+			return nil, ErrLinkPriorityInvalid
+		}
+		options.priority = uint8(pi)
+	}
+	if p := u.Query().Get("password"); p != "" {
+		if len(p) > blake2b.Size {
+			ctxcancel()
+			return nil, ErrLinkPasswordInvalid
+		}
+		options.password = []byte(p)
+	}
+	var err error
+	if options.keepAlive, options.idleTimeout, err = linkTimeoutsFor(u); err != nil {
+		ctxcancel()
+		return nil, err
+	}
+	if options.proxyProtocol, err = parseLinkProxyProtocol(u.Scheme, u.Query().Get("proxyprotocol")); err != nil {
+		ctxcancel()
+		return nil, err
+	}
+	if options.linkSocketOptions, err = l.socketOptionsFor(u); err != nil {
+		ctxcancel()
+		return nil, err
+	}
+	var listener net.Listener
+	err = options.inNetNS(func() (err error) {
+		listener, err = protocol.listen(ctx, u, sintf, options)
+		return
+	})
 	if err != nil {
 		ctxcancel()
 		return nil, err
 	}
+	return l.serve(ctx, ctxcancel, listener, u, sintf, options, local), nil
+}
+
+// serve accepts connections from the listener until either it fails or the
+// context is cancelled, running the handler for each of them. The listener
+// is tracked so that it is closed at shutdown.
+func (l *links) serve(ctx context.Context, ctxcancel context.CancelFunc, listener net.Listener, u *url.URL, sintf string, options linkOptions, local bool) *Listener {
 	addr := listener.Addr()
 	cancel := func() {
 		ctxcancel()
 		if err := listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
-			l.core.log.Warnf("Error closing %s listener %s: %s", strings.ToUpper(u.Scheme), addr, err)
+			l.log.Warnf("Error closing %s listener %s: %s", strings.ToUpper(u.Scheme), addr, err)
 		}
 	}
 	li := &Listener{
@@ -481,31 +610,16 @@ func (l *links) listen(u *url.URL, sintf string, local bool) (*Listener, error)
 		Cancel:   cancel,
 	}
 
-	var options linkOptions
-	if p := u.Query().Get("priority"); p != "" {
-		pi, err := strconv.ParseUint(p, 10, 8)
-		if err != nil {
-			return nil, ErrLinkPriorityInvalid
-		}
-		options.priority = uint8(pi)
-	}
-	if p := u.Query().Get("password"); p != "" {
-		if len(p) > blake2b.Size {
-			return nil, ErrLinkPasswordInvalid
-		}
-		options.password = []byte(p)
-	}
-
 	phony.Block(l, func() {
 		l._listeners[li] = cancel
 	})
 
 	go func() {
-		l.core.log.Infof("%s listener started on %s", strings.ToUpper(u.Scheme), addr)
+		l.log.Infof("%s listener started on %s", strings.ToUpper(u.Scheme), addr)
 		defer phony.Block(l, func() {
 			cancel()
 			delete(l._listeners, li)
-			l.core.log.Infof("%s listener stopped on %s", strings.ToUpper(u.Scheme), addr)
+			l.log.Infof("%s listener stopped on %s", strings.ToUpper(u.Scheme), addr)
 		})
 		for {
 			conn, err := li.listener.Accept()
@@ -526,71 +640,126 @@ func (l *links) listen(u *url.URL, sintf string, local bool) (*Listener, error)
 					sintf: sintf,
 				}
 
-				// If there's an existing link state for this link, get it.
-				// If this node is already connected to us, just drop the
-				// connection. This prevents duplicate peerings.
-				var lc *linkConn
-				var state *link
-				phony.Block(l, func() {
-					var ok bool
-					state, ok = l._links[info]
-					if !ok || state == nil {
-						state = &link{
-							linkType:  linkTypeIncoming,
-							linkProto: strings.ToUpper(u.Scheme),
-							kick:      make(chan struct{}),
-						}
-					}
-					if state._conn != nil {
-						// If a connection has come up in this time, abort
-						// this one.
-						return
-					}
-
-					// The linkConn wrapper allows us to track the number of
-					// bytes written to and read from this connection without
-					// the help of ironwood.
-					lc = &linkConn{
-						Conn: conn,
-						up:   time.Now(),
-					}
-
-					// Update the link state with our newly wrapped connection.
-					// Clear the error state.
-					state._conn = lc
-					state._err = nil
-					state._errtime = time.Time{}
-
-					// Store the state of the link so that it can be queried later.
-					l._links[info] = state
-				})
-				defer phony.Block(l, func() {
-					if l._links[info] == state {
-						delete(l._links, info)
-					}
-				})
-				if lc == nil {
-					return
-				}
-
-				// Give the connection to the handler. The handler will block
-				// for the lifetime of the connection.
-				switch err = l.handler(linkTypeIncoming, options, lc, nil, local); {
+				// Give the connection to the handler. This will block for
+				// the lifetime of the connection.
+				switch err := l.serveConn(conn, info, linkTypeIncoming, strings.ToUpper(u.Scheme), options, nil, local); {
 				case err == nil:
 				case errors.Is(err, io.EOF):
 				case errors.Is(err, net.ErrClosed):
+				case errors.Is(err, ErrLinkAlreadyConfigured):
 				default:
-					l.core.log.Debugf("Link %s error: %s\n", u.Host, err)
+					l.log.Debugf("Link %s error: %s\n", u.Host, err)
 				}
-
-				// The handler has stopped running so the connection is dead,
-				// try to close the underlying socket just in case and then
-				// drop the link state.
-				_ = lc.Close()
 			}(conn)
 		}
 	}()
-	return li, nil
+	return li
+}
+
+// serveConn runs the handler for a connection which has already been
+// established, i.e. accepted by a listener or given to us through AddConn.
+// It blocks for the lifetime of the connection.
+func (l *links) serveConn(conn net.Conn, info linkInfo, linkType linkType, linkProto string, options linkOptions, success func(), local bool) error {
+	// If there's an existing link state for this link, get it.
+	// If this node is already connected to us, just drop the
+	// connection. This prevents duplicate peerings.
+	var lc *linkConn
+	var state *link
+	phony.Block(l, func() {
+		var ok bool
+		state, ok = l._links[info]
+		if !ok || state == nil {
+			state = &link{
+				linkType:  linkType,
+				linkProto: linkProto,
+				kick:      make(chan struct{}),
+				priority:  options.priority,
+				_priority: options.priority,
+			}
+		}
+		if state._conn != nil {
+			// If a connection has come up in this time, abort
+			// this one.
+			return
+		}
+
+		// The linkConn wrapper allows us to track the number of
+		// bytes written to and read from this connection without
+		// the help of ironwood.
+		lc = &linkConn{
+			Conn: conn,
+			up:   time.Now(),
+		}
+
+		// Update the link state with our newly wrapped connection.
+		// Clear the error state.
+		state._conn = lc
+		state._err = nil
+		state._errtime = time.Time{}
+
+		// Store the state of the link so that it can be queried later.
+		l._links[info] = state
+	})
+	if lc == nil {
+		return ErrLinkAlreadyConfigured
+	}
+	defer phony.Block(l, func() {
+		if l._links[info] == state {
+			delete(l._links, info)
+		}
+	})
+
+	// Give the connection to the handler. The handler will block
+	// for the lifetime of the connection.
+	err := l.handler(linkType, options, lc, success, local)
+
+	// The handler has stopped running so the connection is dead,
+	// try to close the underlying socket just in case and then
+	// drop the link state.
+	_ = lc.Close()
+	return err
+}
+
+// addConn runs the handler for a connection that was established outside
+// of the links, returning once the handshake has completed or failed. The
+// link is closed when the context is cancelled.
+func (l *links) addConn(ctx context.Context, conn net.Conn, u *url.URL, options linkOptions) error {
+	// Connections from the caller don't necessarily have unique addresses,
+	// i.e. every net.Pipe is "pipe", so each is numbered to tell them apart.
+	lu := urlForLinkInfo(*u)
+	lu.Fragment = strconv.FormatUint(l.addedConns.Add(1), 10)
+	info := linkInfo{
+		uri: lu.String(),
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-l.core.ctx.Done():
+		}
+		_ = conn.Close()
+	}()
+	handshake := make(chan error, 1)
+	success := func() {
+		handshake <- nil
+	}
+	go func() {
+		defer cancel()
+		err := l.serveConn(conn, info, linkTypeEphemeral, strings.ToUpper(u.Scheme), options, success, false)
+		select {
+		case handshake <- err:
+		default:
+		}
+		switch {
+		case err == nil:
+		case errors.Is(err, io.EOF):
+		case errors.Is(err, net.ErrClosed):
+		case errors.Is(err, ErrLinkAlreadyConfigured):
+		default:
+			l.log.Debugf("Link %s error: %s\n", u.Host, err)
+		}
+	}()
+	return <-handshake
 }
 
 func (l *links) connect(ctx context.Context, u *url.URL, info linkInfo, options linkOptions) (net.Conn, error) {
@@ -598,7 +767,14 @@ func (l *links) connect(ctx context.Context, u *url.URL, info linkInfo, options
 	if err != nil {
 		return nil, err
 	}
-	return dialer.dial(ctx, u, info, options)
+	// Any sockets created while dialling will be created in the network
+	// namespace given in the options, if any.
+	var conn net.Conn
+	err = options.inNetNS(func() (err error) {
+		conn, err = dialer.dial(ctx, u, info, options)
+		return
+	})
+	return conn, err
 }
 
 func (l *links) dialerFor(u *url.URL) (linkProtocol, error) {
@@ -614,10 +790,14 @@ func (l *links) dialerFor(u *url.URL) (linkProtocol, error) {
 		dialer = l.unix
 	case "quic":
 		dialer = l.quic
+	case "wt":
+		dialer = l.wt
 	case "ws":
 		dialer = l.ws
 	case "wss":
 		dialer = l.wss
+	case "exec":
+		dialer = l.exec
 	default:
 		return nil, ErrLinkUnrecognisedSchema
 	}
@@ -635,20 +815,33 @@ func (l *links) handler(linkType linkType, options linkOptions, conn net.Conn, s
 	if err := conn.SetDeadline(time.Now().Add(time.Second * 6)); err != nil {
 		return fmt.Errorf("failed to set handshake deadline: %w", err)
 	}
-	n, err := conn.Write(metaBytes)
-	switch {
-	case err != nil:
-		return fmt.Errorf("write handshake: %w", err)
-	case n != len(metaBytes):
-		return fmt.Errorf("incomplete handshake send")
-	}
+	// The handshake is sent while we read the remote side's handshake, as
+	// unbuffered connections (i.e. net.Pipe) would otherwise deadlock.
+	sent := make(chan error, 1)
+	go func() {
+		n, err := conn.Write(metaBytes)
+		switch {
+		case err != nil:
+			sent <- fmt.Errorf("write handshake: %w", err)
+		case n != len(metaBytes):
+			sent <- fmt.Errorf("incomplete handshake send")
+		default:
+			sent <- nil
+		}
+	}()
 	meta = version_metadata{}
 	base := version_getBaseMetadata()
 	if err := meta.decode(conn, options.password); err != nil {
 		_ = conn.Close()
+		l.handshakeFailed(handshakeFailureReason(err))
+		return err
+	}
+	if err := <-sent; err != nil {
+		l.handshakeFailed(handshakeFailureReason(err))
 		return err
 	}
 	if !meta.check() {
+		l.handshakeFailed("version")
 		return fmt.Errorf("remote node incompatible version (local %s, remote %s)",
 			fmt.Sprintf("%d.%d", base.majorVer, base.minorVer),
 			fmt.Sprintf("%d.%d", meta.majorVer, meta.minorVer),
@@ -659,6 +852,7 @@ func (l *links) handler(linkType linkType, options linkOptions, conn net.Conn, s
 	}
 	// Check that the node isn't trying to connect to itself.
 	if meta.publicKey.Equal(l.core.public) {
+		l.handshakeFailed("self")
 		return ErrLinkToSelf
 	}
 	// Check if the remote side matches the keys we expected. This is a bit of a weak
@@ -667,6 +861,7 @@ func (l *links) handler(linkType linkType, options linkOptions, conn net.Conn, s
 		var key keyArray
 		copy(key[:], meta.publicKey)
 		if _, allowed := pinned[key]; !allowed {
+			l.handshakeFailed("pinned_key")
 			return fmt.Errorf("node public key that does not match pinned keys")
 		}
 	}
@@ -684,6 +879,7 @@ func (l *links) handler(linkType linkType, options linkOptions, conn net.Conn, s
 			}
 		}
 		if linkType == linkTypeIncoming && !isallowed {
+			l.handshakeFailed("not_allowed")
 			return fmt.Errorf("node public key %q is not in AllowedPublicKeys", hex.EncodeToString(meta.publicKey))
 		}
 	}
@@ -699,7 +895,13 @@ func (l *links) handler(linkType linkType, options linkOptions, conn net.Conn, s
 	if meta.priority > priority {
 		priority = meta.priority
 	}
-	l.core.log.Infof("Connected %s: %s, source %s",
+	log := logWith(l.log,
+		"key", hex.EncodeToString(meta.publicKey),
+		"address", remoteAddr,
+		"remote", conn.RemoteAddr().String(),
+		"direction", dir,
+	)
+	log.Infof("Connected %s: %s, source %s",
 		dir, remoteStr, localStr)
 	if success != nil {
 		success()
@@ -708,15 +910,41 @@ func (l *links) handler(linkType linkType, options linkOptions, conn net.Conn, s
 	err = l.core.HandleConn(meta.publicKey, conn, priority)
 	switch err {
 	case io.EOF, net.ErrClosed, nil:
-		l.core.log.Infof("Disconnected %s: %s, source %s",
+		log.Infof("Disconnected %s: %s, source %s",
 			dir, remoteStr, localStr)
 	default:
-		l.core.log.Infof("Disconnected %s: %s, source %s; error: %s",
+		log.Infof("Disconnected %s: %s, source %s; error: %s",
 			dir, remoteStr, localStr, err)
 	}
 	return err
 }
 
+// handshakeFailed records a failed handshake, so that it can be reported
+// through GetHandshakeFailures.
+func (l *links) handshakeFailed(reason string) {
+	l.Act(nil, func() {
+		l._handshakeFailures[reason]++
+	})
+}
+
+// handshakeFailureReason sorts errors from reading or writing the handshake
+// into a small number of reasons.
+func handshakeFailureReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrHandshakeInvalidPreamble):
+		return "preamble"
+	case errors.Is(err, ErrHandshakeInvalidLength):
+		return "length"
+	case errors.Is(err, ErrHandshakeInvalidPassword), errors.Is(err, ErrHandshakeIncorrectPassword), errors.Is(err, ErrHandshakeHashFailure):
+		return "password"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "io"
+	}
+}
+
 func (l *links) findSuitableIP(url *url.URL, fn func(hostname string, ip net.IP, port int) (net.Conn, error)) (net.Conn, error) {
 	host, p, err := net.SplitHostPort(url.Host)
 	if err != nil {
@@ -755,7 +983,7 @@ func (l *links) findSuitableIP(url *url.URL, fn func(hostname string, ip net.IP,
 		if conn, err = fn(host, ip, port); err != nil {
 			url := *url
 			url.RawQuery = ""
-			l.core.log.Debugln("Dialling", url.Redacted(), "reported error:", err)
+			l.log.Debugln("Dialling", url.Redacted(), "reported error:", err)
 			continue
 		}
 		return conn, nil
@@ -763,8 +991,22 @@ func (l *links) findSuitableIP(url *url.URL, fn func(hostname string, ip net.IP,
 	return nil, err
 }
 
+// urlForLinkInfo returns the URI that identifies a peering, which is shown
+// in GetPeers and in logs, so any credentials are removed from it.
 func urlForLinkInfo(u url.URL) url.URL {
-	u.RawQuery = ""
+	u.User = nil
+	switch strings.ToLower(u.Scheme) {
+	case "exec":
+		// The command arguments identify the peering just as much as the
+		// command itself does, so keep them, but only them.
+		args := url.Values{"arg": u.Query()["arg"]}
+		u.RawQuery = ""
+		if len(args["arg"]) > 0 {
+			u.RawQuery = args.Encode()
+		}
+	default:
+		u.RawQuery = ""
+	}
 	return u
 }
 
@@ -0,0 +1,165 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+type linkExec struct {
+	phony.Inbox
+	*links
+}
+
+func (l *links) newLinkExec() *linkExec {
+	lt := &linkExec{
+		links: l,
+	}
+	return lt
+}
+
+// The command to run is taken from the host and path of the URI, so that
+// both exec:///usr/bin/ssh and exec://ssh (searched for in $PATH) work.
+// Each "arg" query parameter is passed to the command in order.
+func (l *linkExec) dial(ctx context.Context, url *url.URL, info linkInfo, options linkOptions) (net.Conn, error) {
+	name := url.Host + url.Path
+	if name == "" {
+		return nil, fmt.Errorf("exec link requires a command")
+	}
+	args := url.Query()["arg"]
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &linkExecStderr{log: l.log, name: name}
+
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stdin pipe: %w", err)
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		_ = stdinR.Close()
+		_ = stdinW.Close()
+		return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+	if err = cmd.Start(); err != nil {
+		_ = stdinR.Close()
+		_ = stdinW.Close()
+		_ = stdoutR.Close()
+		_ = stdoutW.Close()
+		return nil, fmt.Errorf("failed to start %q: %w", name, err)
+	}
+	// The child process has its own copies of these ends now.
+	_ = stdinR.Close()
+	_ = stdoutW.Close()
+
+	return &linkPipeConn{
+		reader: stdoutR,
+		writer: stdinW,
+		local:  linkPipeAddr("exec"),
+		remote: linkPipeAddr(strings.Join(append([]string{name}, args...), " ")),
+		closer: func() error {
+			if cmd.Process != nil {
+				_ = cmd.Process.Kill()
+			}
+			return cmd.Wait()
+		},
+	}, nil
+}
+
+func (l *linkExec) listen(ctx context.Context, url *url.URL, _ string, options linkOptions) (net.Listener, error) {
+	return nil, fmt.Errorf("exec listener not supported, use the stdio listener in the executed command instead")
+}
+
+// linkExecStderr forwards anything the command writes to stderr into the
+// debug log, as there is nowhere else for it to go.
+type linkExecStderr struct {
+	log  Logger
+	name string
+}
+
+func (s *linkExecStderr) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSpace(string(p)), "\n") {
+		s.log.Debugf("Exec %s: %s", s.name, line)
+	}
+	return len(p), nil
+}
+
+// linkPipeConn turns a pair of unidirectional pipes into a net.Conn, which
+// is used by both the exec and stdio link types.
+type linkPipeConn struct {
+	reader *os.File
+	writer *os.File
+	local  net.Addr
+	remote net.Addr
+	closer func() error
+	once   sync.Once
+}
+
+type linkPipeAddr string
+
+func (a linkPipeAddr) Network() string { return "pipe" }
+func (a linkPipeAddr) String() string  { return string(a) }
+
+func (c *linkPipeConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *linkPipeConn) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
+}
+
+func (c *linkPipeConn) Close() error {
+	err := net.ErrClosed
+	c.once.Do(func() {
+		_ = c.writer.Close()
+		_ = c.reader.Close()
+		err = nil
+		if c.closer != nil {
+			// Errors from the process exiting are not interesting, as we
+			// are the ones asking it to stop.
+			_ = c.closer()
+		}
+	})
+	return err
+}
+
+func (c *linkPipeConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *linkPipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Not all pipes support deadlines (e.g. blocking stdin/stdout or pipes on
+// Windows), in which case the handshake just runs without a timeout.
+func (c *linkPipeConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *linkPipeConn) SetReadDeadline(t time.Time) error {
+	if err := c.reader.SetReadDeadline(t); err != nil && !errors.Is(err, os.ErrNoDeadline) {
+		return err
+	}
+	return nil
+}
+
+func (c *linkPipeConn) SetWriteDeadline(t time.Time) error {
+	if err := c.writer.SetWriteDeadline(t); err != nil && !errors.Is(err, os.ErrNoDeadline) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+)
+
+// TestExecLinkHelper is not a real test, it is run as the child process of
+// an exec link and relays stdin/stdout to the address in the environment,
+// much like "ssh -W" or "nc" would.
+func TestExecLinkHelper(t *testing.T) {
+	addr := os.Getenv("YGG_TEST_EXEC_HELPER_ADDR")
+	if addr == "" {
+		t.Skip("only run as a helper process")
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		os.Exit(1)
+	}
+	go func() {
+		_, _ = io.Copy(conn, os.Stdin)
+		_ = conn.Close()
+	}()
+	_, _ = io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+func TestExecLink(t *testing.T) {
+	logger := GetLoggerWithPrefix("", false)
+	cfgA, cfgB := config.GenerateConfig(), config.GenerateConfig()
+	require_NoError(t, cfgA.GenerateSelfSignedCertificate())
+	require_NoError(t, cfgB.GenerateSelfSignedCertificate())
+
+	nodeA, err := New(cfgA.Certificate, logger)
+	require_NoError(t, err)
+	defer nodeA.Stop()
+
+	u, err := url.Parse("tcp://localhost:0")
+	require_NoError(t, err)
+
+	l, err := nodeA.Listen(u, "")
+	require_NoError(t, err)
+
+	t.Setenv("YGG_TEST_EXEC_HELPER_ADDR", l.Addr().String())
+	u = &url.URL{
+		Scheme:   "exec",
+		Path:     os.Args[0],
+		RawQuery: url.Values{"arg": {"-test.run=^TestExecLinkHelper$"}}.Encode(),
+	}
+
+	// Exec peers can only come from the startup configuration.
+	nodeB, err := New(cfgB.Certificate, logger, Peer{URI: u.String()})
+	require_NoError(t, err)
+	defer nodeB.Stop()
+	require_True(t, errors.Is(nodeB.AddPeer(u, ""), ErrLinkExecNotAllowed))
+	require_True(t, errors.Is(nodeB.CallPeer(u, ""), ErrLinkExecNotAllowed))
+
+	var peers []PeerInfo
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if peers = nodeB.GetPeers(); len(peers) == 1 && peers[0].Up {
+			break
+		}
+	}
+	require_Equal(t, len(peers), 1)
+	require_True(t, peers[0].Up)
+	require_True(t, peers[0].Key.Equal(nodeA.PublicKey()))
+	require_Equal(t, peers[0].URI, u.String())
+}
+
+func TestExecLinkInfoKeepsArgs(t *testing.T) {
+	a, _ := url.Parse("exec:///usr/bin/ssh?arg=-W&arg=a:1&arg=jump&priority=1")
+	b, _ := url.Parse("exec:///usr/bin/ssh?arg=-W&arg=b:1&arg=jump")
+	la, lb := urlForLinkInfo(*a), urlForLinkInfo(*b)
+	require_True(t, la.String() != lb.String())
+	require_Equal(t, la.Query().Get("priority"), "")
+	require_Equal(t, len(la.Query()["arg"]), 3)
+}
+
+func TestStdioLinkClosed(t *testing.T) {
+	stdinR, stdinW, err := os.Pipe()
+	require_NoError(t, err)
+	stdoutR, stdoutW, err := os.Pipe()
+	require_NoError(t, err)
+	defer stdoutR.Close()
+	stdin, stdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = stdinR, stdoutW
+	defer func() { os.Stdin, os.Stdout = stdin, stdout }()
+
+	cfg := config.GenerateConfig()
+	require_NoError(t, cfg.GenerateSelfSignedCertificate())
+	closed := make(chan struct{})
+	node, err := New(cfg.Certificate, GetLoggerWithPrefix("", false),
+		ListenAddress("stdio://"), StdioClosed(func() { close(closed) }))
+	require_NoError(t, err)
+	defer node.Stop()
+
+	// The remote end going away ends the only peering there will be.
+	require_NoError(t, stdinW.Close())
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stdio peering closing wasn't notified")
+	}
+}
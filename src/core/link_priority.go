@@ -0,0 +1,161 @@
+package core
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Arceliar/ironwood/network"
+	"github.com/Arceliar/phony"
+)
+
+// Automatic priority only ever chooses between the configured priority and
+// one above it, for links which lead to the same neighbour. The preferred
+// link keeps its configured priority and the others are demoted, so that
+// ironwood sends traffic over the preferred one.
+//
+// Links are compared by a cost which starts from the measured latency and is
+// then scaled up by packet loss and down by throughput. Ironwood doesn't
+// report loss directly, so it is estimated from how often the latest probe
+// on a link has gone unanswered when it is measured. Throughput is the
+// highest rate the link has been seen to carry, as there's no way to know
+// what an idle link could carry without sending traffic over it.
+//
+// Ironwood only takes the priority of a link in HandleConn and has no way to
+// change it for a connected peer, so changing it means that the link has to
+// be reconnected. This is why the thresholds are conservative.
+const (
+	autoPriorityInterval   = time.Second * 15 // How often links are measured
+	autoPrioritySamples    = 4                // Measurements needed before a link is considered
+	autoPriorityMargin     = 0.8              // Cost ratio a link must beat to take over
+	autoPriorityHold       = time.Minute * 2  // Minimum time between changes for a neighbour
+	autoPrioritySmooth     = 0.25             // Weight of new measurements in the average
+	autoPriorityLossWeight = 10               // Cost multiplier at 100% loss, on top of the latency
+	autoPriorityRateWeight = 0.5              // Cost multiplier for a link which hasn't carried traffic
+	autoPriorityRateScale  = 1 << 20          // Rate, in bytes per second, at which half of that applies
+)
+
+// parseAutoPriority checks the "autopriority" query parameter of a peering
+// URI, falling back to the node-wide default if it isn't set.
+func (l *links) parseAutoPriority(p string) (bool, error) {
+	if p == "" {
+		return bool(l.core.config.autoPriority), nil
+	}
+	auto, err := strconv.ParseBool(p)
+	if err != nil {
+		return false, ErrLinkAutoPriorityInvalid
+	}
+	return auto, nil
+}
+
+func (l *links) updatePriorities() {
+	select {
+	case <-l.core.ctx.Done():
+		return
+	default:
+	}
+	peers := map[net.Conn]network.DebugPeerInfo{}
+	for _, p := range l.core.PacketConn.PacketConn.Debug.GetPeers() {
+		peers[p.Conn] = p
+	}
+	phony.Block(l, func() {
+		l._updatePriorities(peers, time.Now())
+	})
+	time.AfterFunc(autoPriorityInterval, l.updatePriorities)
+}
+
+// _updatePriorities takes a new measurement of every connected link which
+// has automatic priority enabled and then decides, for each neighbour with
+// more than one such link, which of them should be preferred. Links are only
+// ever changed when one is clearly better than the other, and not more than
+// once per hold period, so that a pair of similar links doesn't flap.
+func (l *links) _updatePriorities(peers map[net.Conn]network.DebugPeerInfo, now time.Time) {
+	groups := map[keyArray][]*link{}
+	for _, state := range l._links {
+		if !state.autoPriority || state._conn == nil {
+			continue
+		}
+		p, ok := peers[state._conn]
+		if !ok {
+			continue
+		}
+		switch {
+		case p.Latency > 0:
+			sample := float64(p.Latency)
+			if state._samples == 0 {
+				state._latency = sample
+			} else {
+				state._latency += autoPrioritySmooth * (sample - state._latency)
+				state._loss -= autoPrioritySmooth * state._loss
+			}
+			state._samples++
+		case state._samples > 0 && now.Sub(state._conn.up) > autoPriorityInterval:
+			// The probe went unanswered, or the latency would be known by
+			// now, so count it as lost. New connections are left alone as
+			// they won't have had a chance to answer yet.
+			state._loss += autoPrioritySmooth * (1 - state._loss)
+		default:
+			continue
+		}
+		rate := atomic.LoadUint64(&state._conn.rxrate) + atomic.LoadUint64(&state._conn.txrate)
+		if rate > state._peakRate {
+			state._peakRate = rate
+		}
+		state._cost = state._latency * (1 + autoPriorityLossWeight*state._loss) *
+			(1 + autoPriorityRateWeight*autoPriorityRateScale/(autoPriorityRateScale+float64(state._peakRate)))
+		if state._samples < autoPrioritySamples {
+			continue
+		}
+		var key keyArray
+		copy(key[:], p.Key)
+		groups[key] = append(groups[key], state)
+	}
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		var leader, best *link
+		var changed time.Time
+		for _, state := range group {
+			if state._preferred {
+				leader = state
+			}
+			if best == nil || state._cost < best._cost {
+				best = state
+			}
+			if state._changed.After(changed) {
+				changed = state._changed
+			}
+		}
+		if best == leader || now.Sub(changed) < autoPriorityHold {
+			continue
+		}
+		// The best link must beat the current leader, or every other link
+		// if there isn't a leader yet, by the margin.
+		clear := true
+		for _, state := range group {
+			if state != best && (leader == nil || state == leader) && best._cost >= autoPriorityMargin*state._cost {
+				clear = false
+			}
+		}
+		if !clear {
+			continue
+		}
+		for _, state := range group {
+			priority := state.priority
+			if state != best && priority < 255 {
+				priority++
+			}
+			state._preferred = state == best
+			state._changed = now
+			if state._priority != priority {
+				// See above for why the link can't be changed in place.
+				l.log.Infof("Changing priority of link %s from %d to %d", state._conn.RemoteAddr(), state._priority, priority)
+				state._priority = priority
+				state._reconnect = true
+				_ = state._conn.Close()
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/ironwood/network"
+	"github.com/Arceliar/phony"
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+)
+
+func TestAutoPriority(t *testing.T) {
+	cfg := config.GenerateConfig()
+	node, err := New(cfg.Certificate, GetLoggerWithPrefix("", false))
+	require_NoError(t, err)
+	defer node.Stop()
+
+	key, _, err := ed25519.GenerateKey(nil)
+	require_NoError(t, err)
+
+	// Two links to the same peer, i.e. wired and wireless, and a third
+	// with automatic priority turned off.
+	newLink := func(uri string, auto bool) (*link, net.Conn) {
+		local, remote := net.Pipe()
+		t.Cleanup(func() { _ = remote.Close() })
+		state := &link{
+			linkType:     linkTypePersistent,
+			priority:     2,
+			autoPriority: auto,
+			_priority:    2,
+			_conn:        &linkConn{Conn: local},
+		}
+		phony.Block(&node.links, func() {
+			node.links._links[linkInfo{uri: uri}] = state
+		})
+		return state, remote
+	}
+	wired, _ := newLink("tcp://wired", true)
+	wireless, wirelessRemote := newLink("tcp://wireless", true)
+	manual, _ := newLink("tcp://manual", false)
+
+	now := time.Now()
+	measure := func(latencies map[*link]time.Duration) {
+		peers := map[net.Conn]network.DebugPeerInfo{}
+		for state, latency := range latencies {
+			peers[state._conn] = network.DebugPeerInfo{Key: key, Latency: latency}
+		}
+		phony.Block(&node.links, func() {
+			node.links._updatePriorities(peers, now)
+		})
+	}
+	priorities := func() (a, b, c uint8) {
+		phony.Block(&node.links, func() {
+			a, b, c = wired._priority, wireless._priority, manual._priority
+		})
+		return
+	}
+
+	// Nothing changes until there are enough measurements.
+	latencies := map[*link]time.Duration{
+		wired:    time.Millisecond,
+		wireless: 10 * time.Millisecond,
+		manual:   100 * time.Microsecond,
+	}
+	for i := 0; i < autoPrioritySamples-1; i++ {
+		measure(latencies)
+	}
+	a, b, c := priorities()
+	require_True(t, a == 2 && b == 2 && c == 2)
+
+	// Then the wireless link is demoted and reconnected, while the wired
+	// link and the manual link stay as they are.
+	measure(latencies)
+	a, b, c = priorities()
+	require_True(t, a == 2 && b == 3 && c == 2)
+	_, err = wirelessRemote.Read(make([]byte, 1))
+	require_Error(t, err)
+	phony.Block(&node.links, func() {
+		require_True(t, wireless._reconnect && !wired._reconnect)
+		wireless._reconnect = false
+		wireless._conn = &linkConn{Conn: wireless._conn.Conn}
+	})
+
+	// A link which is only a little better doesn't take over.
+	latencies[wired] = 10 * time.Millisecond
+	latencies[wireless] = 9 * time.Millisecond
+	for i := 0; i < 20; i++ {
+		measure(latencies)
+	}
+	a, b, _ = priorities()
+	require_True(t, a == 2 && b == 3)
+
+	// A link which is much better doesn't take over within the hold time
+	// either, but does once it has passed.
+	latencies[wireless] = time.Millisecond
+	for i := 0; i < 20; i++ {
+		measure(latencies)
+	}
+	a, b, _ = priorities()
+	require_True(t, a == 2 && b == 3)
+
+	now = now.Add(autoPriorityHold)
+	measure(latencies)
+	a, b, _ = priorities()
+	require_True(t, a == 3 && b == 2)
+}
+
+func TestAutoPriorityLossAndThroughput(t *testing.T) {
+	cfg := config.GenerateConfig()
+	node, err := New(cfg.Certificate, GetLoggerWithPrefix("", false))
+	require_NoError(t, err)
+	defer node.Stop()
+
+	key, _, err := ed25519.GenerateKey(nil)
+	require_NoError(t, err)
+
+	now := time.Now()
+	newLink := func(uri string) *link {
+		local, remote := net.Pipe()
+		t.Cleanup(func() { _ = remote.Close() })
+		state := &link{
+			linkType:     linkTypePersistent,
+			priority:     2,
+			autoPriority: true,
+			_priority:    2,
+			_conn:        &linkConn{Conn: local, up: now.Add(-time.Hour)},
+		}
+		phony.Block(&node.links, func() {
+			node.links._links[linkInfo{uri: uri}] = state
+		})
+		return state
+	}
+	busy, idle := newLink("tcp://busy"), newLink("tcp://idle")
+	lossy, steady := newLink("tcp://lossy"), newLink("tcp://steady")
+	lossyKey, _, err := ed25519.GenerateKey(nil)
+	require_NoError(t, err)
+
+	// All of the links have the same latency, but one link to each peer
+	// has either carried more traffic or has stopped answering probes.
+	atomic.StoreUint64(&busy._conn.rxrate, 4<<20)
+	for i := 0; i < autoPrioritySamples+10; i++ {
+		peers := map[net.Conn]network.DebugPeerInfo{
+			busy._conn:   {Key: key, Latency: time.Millisecond},
+			idle._conn:   {Key: key, Latency: time.Millisecond},
+			steady._conn: {Key: lossyKey, Latency: time.Millisecond},
+			lossy._conn:  {Key: lossyKey, Latency: time.Millisecond},
+		}
+		if i >= autoPrioritySamples {
+			peers[lossy._conn] = network.DebugPeerInfo{Key: lossyKey}
+		}
+		phony.Block(&node.links, func() {
+			node.links._updatePriorities(peers, now)
+		})
+		now = now.Add(autoPriorityHold)
+	}
+	phony.Block(&node.links, func() {
+		require_True(t, busy._priority == 2 && idle._priority == 3)
+		require_True(t, steady._priority == 2 && lossy._priority == 3)
+	})
+}
+
+func TestAutoPriorityOption(t *testing.T) {
+	cfg := config.GenerateConfig()
+	node, err := New(cfg.Certificate, GetLoggerWithPrefix("", false), AutoPeerPriority(true))
+	require_NoError(t, err)
+	defer node.Stop()
+
+	for uri, expected := range map[string]error{
+		"tcp://127.0.0.1:1":                    nil,
+		"tcp://127.0.0.2:1?autopriority=false": nil,
+		"tcp://127.0.0.3:1?autopriority=maybe": ErrLinkAutoPriorityInvalid,
+	} {
+		u, err := url.Parse(uri)
+		require_NoError(t, err)
+		require_Equal(t, node.AddPeer(u, ""), expected)
+	}
+	auto := map[string]bool{}
+	for _, peer := range node.GetPeers() {
+		auto[peer.URI] = peer.AutoPriority
+	}
+	require_True(t, auto["tcp://127.0.0.1:1"])
+	require_True(t, !auto["tcp://127.0.0.2:1"])
+}
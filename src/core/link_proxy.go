@@ -0,0 +1,225 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// proxyHandshakeTimeout bounds how long we wait for the proxy to set up the
+// tunnel, as the dial timeout only covers the connection to the proxy itself.
+const proxyHandshakeTimeout = time.Second * 10
+
+// parseLinkProxy checks the "proxy" query parameter of a peering URI. A nil
+// URL with no error means that nothing was set and that the environment
+// should be consulted at dial time. "none" or "direct" never use a proxy and
+// "env" uses one from the environment for any type of peering.
+func parseLinkProxy(p string) (via *url.URL, direct, env bool, err error) {
+	switch strings.ToLower(p) {
+	case "":
+		return nil, false, false, nil
+	case "none", "direct":
+		return nil, true, false, nil
+	case "env":
+		return nil, false, true, nil
+	}
+	via, err = url.Parse(p)
+	if err != nil || via.Host == "" {
+		return nil, false, false, ErrLinkProxyInvalid
+	}
+	switch strings.ToLower(via.Scheme) {
+	case "http", "https", "socks5", "socks5h":
+		return via, false, false, nil
+	default:
+		return nil, false, false, ErrLinkProxyInvalid
+	}
+}
+
+// proxyFor returns the proxy that a connection to the peer should be made
+// through, or nil for a direct connection. If the peering URI doesn't name
+// one then ws:// and wss:// peerings use HTTP_PROXY and HTTPS_PROXY from the
+// environment respectively, respecting NO_PROXY, as they always have. Other
+// peerings only use the environment with "proxy=env", so that proxy settings
+// meant for other programs don't change how existing peerings connect, and
+// then use HTTPS_PROXY or failing that ALL_PROXY. Peerings on a specific
+// interface or to link-local addresses never use the environment, as they
+// are local by definition.
+func (l *links) proxyFor(u *url.URL, info linkInfo, options linkOptions) (*url.URL, error) {
+	switch {
+	case options.proxy != nil:
+		return options.proxy, nil
+	case options.proxyDirect, info.sintf != "":
+		return nil, nil
+	}
+	env := httpproxy.FromEnvironment()
+	var scheme string
+	switch strings.ToLower(u.Scheme) {
+	case "ws":
+		scheme = "http"
+	case "wss":
+		scheme = "https"
+	default:
+		if !options.proxyEnv {
+			return nil, nil
+		}
+		scheme = "https"
+		if env.HTTPSProxy == "" {
+			for _, name := range []string{"ALL_PROXY", "all_proxy"} {
+				if env.HTTPSProxy = os.Getenv(name); env.HTTPSProxy != "" {
+					break
+				}
+			}
+		}
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && ip.IsLinkLocalUnicast() {
+		return nil, nil
+	}
+	via, err := env.ProxyFunc()(&url.URL{Scheme: scheme, Host: u.Host})
+	if err != nil {
+		return nil, fmt.Errorf("proxy from environment is invalid: %w", err)
+	}
+	if via != nil {
+		if _, _, _, err = parseLinkProxy(via.String()); err != nil {
+			return nil, fmt.Errorf("proxy from environment is invalid: %w", err)
+		}
+	}
+	return via, nil
+}
+
+// dialProxy opens a TCP connection to the address through the proxy. The
+// address is passed to the proxy as-is, so that hostnames are resolved by
+// the proxy, which may be the only thing able to resolve them.
+func (l *links) dialProxy(ctx context.Context, via *url.URL, address string, options linkOptions) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil && l.core.config.peerFilter != nil && !l.core.config.peerFilter(ip) {
+		return nil, ErrLinkNoSuitableIPs
+	}
+	forward := options.dialContext(&net.Dialer{
+		Timeout:   time.Second * 5,
+		KeepAlive: -1,
+		Control:   options.control(l.tcp.tcpContext),
+	})
+	switch strings.ToLower(via.Scheme) {
+	case "http", "https":
+		return dialHTTPConnect(ctx, forward, via, address)
+	default:
+		return dialSOCKS5(ctx, forward, via, address)
+	}
+}
+
+func proxyHostPort(via *url.URL) string {
+	if via.Port() != "" {
+		return via.Host
+	}
+	switch strings.ToLower(via.Scheme) {
+	case "http":
+		return net.JoinHostPort(via.Hostname(), "80")
+	case "https":
+		return net.JoinHostPort(via.Hostname(), "443")
+	default:
+		return net.JoinHostPort(via.Hostname(), "1080")
+	}
+}
+
+func dialHTTPConnect(ctx context.Context, forward linkDialer, via *url.URL, address string) (net.Conn, error) {
+	conn, err := forward(ctx, "tcp", proxyHostPort(via))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %w", via.Host, err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+	if strings.EqualFold(via.Scheme, "https") {
+		tlsconn := tls.Client(conn, &tls.Config{
+			ServerName: via.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		})
+		if err = tlsconn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("TLS handshake with proxy %s failed: %w", via.Host, err)
+		}
+		conn = tlsconn
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if via.User != nil {
+		password, _ := via.User.Password()
+		creds := via.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(creds)))
+	}
+	if err = req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to proxy %s: %w", via.Host, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response from proxy %s: %w", via.Host, err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", via.Host, address, resp.Status)
+	}
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if br.Buffered() > 0 {
+		// The remote side may well have started talking already, in which
+		// case we must not lose what has been buffered.
+		return &linkProxyConn{Conn: conn, reader: br}, nil
+	}
+	return conn, nil
+}
+
+func dialSOCKS5(ctx context.Context, forward linkDialer, via *url.URL, address string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if via.User != nil && via.User.Username() != "" {
+		auth = &proxy.Auth{
+			User: via.User.Username(),
+		}
+		auth.Password, _ = via.User.Password()
+	}
+	dialer, err := proxy.SOCKS5("tcp", proxyHostPort(via), auth, forward)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", via.Host, err)
+	}
+	conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s failed to connect to %s: %w", via.Host, address, err)
+	}
+	return conn, nil
+}
+
+// linkProxyConn returns any data that was read past the end of the
+// CONNECT response before reading from the connection again.
+type linkProxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *linkProxyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
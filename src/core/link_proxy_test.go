@@ -0,0 +1,178 @@
+package core
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+)
+
+// testConnectProxy is a minimal HTTP CONNECT proxy which requires the
+// given basic auth credentials.
+func testConnectProxy(t *testing.T, credentials string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require_NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+				if req.Header.Get("Proxy-Authorization") != auth {
+					_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go func() {
+					_, _ = io.Copy(upstream, br)
+					_ = upstream.Close()
+				}()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestProxyLinks(t *testing.T) {
+	proxy := testConnectProxy(t, "user:pass")
+
+	logger := GetLoggerWithPrefix("", false)
+	cfgA, cfgB := config.GenerateConfig(), config.GenerateConfig()
+	require_NoError(t, cfgA.GenerateSelfSignedCertificate())
+	require_NoError(t, cfgB.GenerateSelfSignedCertificate())
+
+	nodeA, err := New(cfgA.Certificate, logger)
+	require_NoError(t, err)
+	defer nodeA.Stop()
+
+	nodeB, err := New(cfgB.Certificate, logger)
+	require_NoError(t, err)
+	defer nodeB.Stop()
+
+	for _, scheme := range []string{"tcp", "tls", "ws"} {
+		t.Run(scheme, func(t *testing.T) {
+			l, err := nodeA.ListenLocal(&url.URL{Scheme: scheme, Host: "localhost:0"}, "")
+			require_NoError(t, err)
+			defer l.Cancel()
+
+			_, port, _ := net.SplitHostPort(l.Addr().String())
+			query := url.Values{"proxy": {"http://user:pass@" + proxy.Addr().String()}}
+			u := &url.URL{Scheme: scheme, Host: "localhost:" + port, RawQuery: query.Encode()}
+			require_NoError(t, nodeB.CallPeer(u, ""))
+
+			var up bool
+			for i := 0; i < 50 && !up; i++ {
+				time.Sleep(100 * time.Millisecond)
+				for _, peer := range nodeB.GetPeers() {
+					up = up || (peer.Up && strings.HasPrefix(peer.URI, scheme+"://"))
+				}
+			}
+			require_True(t, up)
+		})
+	}
+
+	t.Run("refused", func(t *testing.T) {
+		query := url.Values{"proxy": {"http://user:wrong@" + proxy.Addr().String()}}
+		u := &url.URL{Scheme: "tcp", Host: "127.0.0.1:1", RawQuery: query.Encode()}
+		require_NoError(t, nodeB.AddPeer(u, ""))
+		defer func() { _ = nodeB.RemovePeer(u, "") }()
+
+		var lastErr error
+		for i := 0; i < 50 && lastErr == nil; i++ {
+			time.Sleep(100 * time.Millisecond)
+			for _, peer := range nodeB.GetPeers() {
+				if peer.URI == "tcp://127.0.0.1:1" {
+					lastErr = peer.LastError
+				}
+			}
+		}
+		require_Error(t, lastErr)
+		require_True(t, strings.Contains(lastErr.Error(), "407"))
+	})
+}
+
+func TestProxyInvalid(t *testing.T) {
+	cfg := config.GenerateConfig()
+	node, err := New(cfg.Certificate, GetLoggerWithPrefix("", false))
+	require_NoError(t, err)
+	defer node.Stop()
+
+	for uri, expected := range map[string]error{
+		"tcp://127.0.0.1:1?proxy=ftp://127.0.0.1:21":  ErrLinkProxyInvalid,
+		"tcp://127.0.0.1:1?proxy=127.0.0.1:3128":      ErrLinkProxyInvalid,
+		"quic://127.0.0.1:1?proxy=http://127.0.0.1:1": ErrLinkProxyNotSupported,
+	} {
+		u, err := url.Parse(uri)
+		require_NoError(t, err)
+		require_Equal(t, node.AddPeer(u, ""), expected)
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	t.Setenv("HTTP_PROXY", "http://plain.example:3128")
+	t.Setenv("HTTPS_PROXY", "http://secure.example:3128")
+	t.Setenv("ALL_PROXY", "socks5://all.example:1080")
+	t.Setenv("NO_PROXY", "")
+
+	// Only WebSocket peerings use the environment, as they always have.
+	var l links
+	for uri, expected := range map[string]string{
+		"tcp://peer.example:1234": "",
+		"tls://peer.example:1234": "",
+		"ws://peer.example:80":    "http://plain.example:3128",
+		"wss://peer.example:443":  "http://secure.example:3128",
+		"ws://[fe80::1]:80":       "",
+	} {
+		u, err := url.Parse(uri)
+		require_NoError(t, err)
+		via, err := l.proxyFor(u, linkInfo{}, linkOptions{})
+		require_NoError(t, err)
+		if via == nil {
+			require_Equal(t, expected, "")
+		} else {
+			require_Equal(t, via.String(), expected)
+		}
+	}
+	u, _ := url.Parse("ws://peer.example:80")
+	via, err := l.proxyFor(u, linkInfo{sintf: "eth0"}, linkOptions{})
+	require_NoError(t, err)
+	require_True(t, via == nil)
+
+	// Other peerings use it when asked to, with ALL_PROXY as a fallback.
+	env := linkOptions{proxyEnv: true}
+	u, _ = url.Parse("tls://peer.example:1234")
+	via, err = l.proxyFor(u, linkInfo{}, env)
+	require_NoError(t, err)
+	require_Equal(t, via.String(), "http://secure.example:3128")
+	t.Setenv("HTTPS_PROXY", "")
+	via, err = l.proxyFor(u, linkInfo{}, env)
+	require_NoError(t, err)
+	require_Equal(t, via.String(), "socks5://all.example:1080")
+	u, _ = url.Parse("tcp://[fe80::1]:1234")
+	via, err = l.proxyFor(u, linkInfo{}, env)
+	require_NoError(t, err)
+	require_True(t, via == nil)
+}
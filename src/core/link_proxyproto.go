@@ -0,0 +1,243 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// linkProxyProtocolSignature starts every version 2 PROXY protocol header.
+var linkProxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// parseLinkProxyProtocol checks the "proxyprotocol" query parameter of a
+// listener URI, returning the PROXY protocol version to expect.
+func parseLinkProxyProtocol(scheme, p string) (int, error) {
+	if p == "" {
+		return 0, nil
+	}
+	switch strings.ToLower(scheme) {
+	case "tcp", "tls", "ws":
+	default:
+		return 0, ErrLinkProxyProtocolNotSupported
+	}
+	switch strings.ToLower(p) {
+	case "v1", "1":
+		return 1, nil
+	case "v2", "2":
+		return 2, nil
+	default:
+		return 0, ErrLinkProxyProtocolInvalid
+	}
+}
+
+// linkProxyProtocolListener reads the PROXY protocol header from each
+// accepted connection before handing it out, so that everything from then
+// on sees the address of the real remote side rather than that of the load
+// balancer. The header is read in its own goroutine so that slow or broken
+// connections can't hold up others. It must wrap the raw TCP listener, as
+// the header comes before any TLS or HTTP.
+type linkProxyProtocolListener struct {
+	net.Listener
+	log     Logger
+	version int
+	ch      chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+	err     error // set before closed is closed
+}
+
+func (l *links) proxyProtocolListener(listener net.Listener, options linkOptions) net.Listener {
+	if options.proxyProtocol == 0 {
+		return listener
+	}
+	pl := &linkProxyProtocolListener{
+		Listener: listener,
+		log:      l.log,
+		version:  options.proxyProtocol,
+		ch:       make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	go pl.acceptLoop()
+	return pl
+}
+
+func (l *linkProxyProtocolListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.close(err)
+			return
+		}
+		go func() {
+			pc, err := readProxyProtocolHeader(conn, l.version)
+			if err != nil {
+				l.log.Debugf("Dropping connection from %s: %s", conn.RemoteAddr(), err)
+				_ = conn.Close()
+				return
+			}
+			select {
+			case l.ch <- pc:
+			case <-l.closed:
+				_ = pc.Close()
+			}
+		}()
+	}
+}
+
+func (l *linkProxyProtocolListener) close(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.closed)
+	})
+}
+
+func (l *linkProxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ch:
+		return conn, nil
+	case <-l.closed:
+		return nil, l.err
+	}
+}
+
+func (l *linkProxyProtocolListener) Close() error {
+	l.close(net.ErrClosed)
+	return l.Listener.Close()
+}
+
+// linkProxyProtocolConn replaces the remote address of the connection with
+// the one from the PROXY protocol header, if there was one.
+type linkProxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *linkProxyProtocolConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *linkProxyProtocolConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func readProxyProtocolHeader(conn net.Conn, version int) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHandshakeTimeout)); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	var remote net.Addr
+	var err error
+	switch version {
+	case 1:
+		remote, err = readProxyProtocolV1(br)
+	case 2:
+		remote, err = readProxyProtocolV2(br)
+	default:
+		err = fmt.Errorf("unsupported version %d", version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol header: %w", err)
+	}
+	if err = conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &linkProxyProtocolConn{
+		Conn:   conn,
+		reader: br,
+		remote: remote,
+	}, nil
+}
+
+// readProxyProtocolV1 parses the human-readable header, e.g.
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n". The source address is nil
+// for "UNKNOWN" connections, i.e. health checks from the load balancer.
+func readProxyProtocolV1(br *bufio.Reader) (net.Addr, error) {
+	// The longest possible header is 107 bytes, so don't read any further
+	// than that looking for the end of it.
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 {
+			return nil, fmt.Errorf("header too long")
+		}
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	switch {
+	case len(fields) < 2 || fields[0] != "PROXY":
+		return nil, fmt.Errorf("not a version 1 header")
+	case fields[1] == "UNKNOWN":
+		return nil, nil
+	case fields[1] != "TCP4" && fields[1] != "TCP6":
+		return nil, fmt.Errorf("unknown protocol %q", fields[1])
+	case len(fields) != 6:
+		return nil, fmt.Errorf("wrong number of fields")
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 parses the binary header. The source address is nil
+// for LOCAL connections, i.e. health checks from the load balancer, and for
+// address families other than IPv4 and IPv6. Any TLVs are skipped.
+func readProxyProtocolV2(br *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], linkProxyProtocolSignature) || header[12]>>4 != 2 {
+		return nil, fmt.Errorf("not a version 2 header")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	switch header[12] & 0x0f {
+	case 0x00: // LOCAL
+		return nil, nil
+	case 0x01: // PROXY
+	default:
+		return nil, fmt.Errorf("unknown command %#x", header[12]&0x0f)
+	}
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("address block too short")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:4]),
+			Port: int(binary.BigEndian.Uint16(body[8:10])),
+		}, nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("address block too short")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:16]),
+			Port: int(binary.BigEndian.Uint16(body[32:34])),
+		}, nil
+	default:
+		return nil, nil
+	}
+}
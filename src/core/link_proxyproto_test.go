@@ -0,0 +1,139 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+)
+
+func TestProxyProtocolV1(t *testing.T) {
+	for header, expected := range map[string]string{
+		"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n":     "192.0.2.1:56324",
+		"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n": "[2001:db8::1]:56324",
+		"PROXY UNKNOWN\r\n": "",
+	} {
+		addr, err := readProxyProtocolV1(bufio.NewReader(strings.NewReader(header)))
+		require_NoError(t, err)
+		if expected == "" {
+			require_True(t, addr == nil)
+		} else {
+			require_Equal(t, addr.String(), expected)
+		}
+	}
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 2001:db8::1 192.0.2.2 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 99999 443\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+	} {
+		_, err := readProxyProtocolV1(bufio.NewReader(strings.NewReader(header)))
+		require_Error(t, err)
+	}
+}
+
+func proxyProtocolV2Header(command byte, family byte, addrs []byte) []byte {
+	header := append([]byte{}, linkProxyProtocolSignature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb}
+	addr, err := readProxyProtocolV2(bufio.NewReader(strings.NewReader(string(proxyProtocolV2Header(0x1, 0x11, ipv4)))))
+	require_NoError(t, err)
+	require_Equal(t, addr.String(), "192.0.2.1:56324")
+
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0x01, 0xbb)
+	addr, err = readProxyProtocolV2(bufio.NewReader(strings.NewReader(string(proxyProtocolV2Header(0x1, 0x21, ipv6)))))
+	require_NoError(t, err)
+	require_Equal(t, addr.String(), "[2001:db8::1]:56324")
+
+	addr, err = readProxyProtocolV2(bufio.NewReader(strings.NewReader(string(proxyProtocolV2Header(0x0, 0x00, nil)))))
+	require_NoError(t, err)
+	require_True(t, addr == nil)
+
+	_, err = readProxyProtocolV2(bufio.NewReader(strings.NewReader(string(proxyProtocolV2Header(0x1, 0x11, ipv4[:6])))))
+	require_Error(t, err)
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	cfgA, cfgB := config.GenerateConfig(), config.GenerateConfig()
+	logger := GetLoggerWithPrefix("", false)
+	nodeA, err := New(cfgA.Certificate, logger)
+	require_NoError(t, err)
+	defer nodeA.Stop()
+	nodeB, err := New(cfgB.Certificate, logger)
+	require_NoError(t, err)
+	defer nodeB.Stop()
+
+	l, err := nodeA.Listen(&url.URL{Scheme: "tcp", Host: "127.0.0.1:0", RawQuery: "proxyprotocol=v1"}, "")
+	require_NoError(t, err)
+	defer l.Cancel()
+
+	// The balancer sits in front of node A and tells it that node B is
+	// connecting from 192.0.2.1.
+	balancer, err := net.Listen("tcp", "127.0.0.1:0")
+	require_NoError(t, err)
+	defer balancer.Close()
+	go func() {
+		conn, err := balancer.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		upstream, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		_, _ = fmt.Fprintf(upstream, "PROXY TCP4 192.0.2.1 127.0.0.1 40000 %d\r\n", l.Addr().(*net.TCPAddr).Port)
+		go func() { _, _ = io.Copy(upstream, conn) }()
+		_, _ = io.Copy(conn, upstream)
+	}()
+
+	require_NoError(t, nodeB.CallPeer(&url.URL{Scheme: "tcp", Host: balancer.Addr().String()}, ""))
+	var peers []PeerInfo
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if peers = nodeA.GetPeers(); len(peers) == 1 && peers[0].Up {
+			break
+		}
+	}
+	require_Equal(t, len(peers), 1)
+	require_True(t, peers[0].Up)
+	require_Equal(t, peers[0].URI, "tcp://192.0.2.1:40000")
+}
+
+func TestProxyProtocolInvalidOption(t *testing.T) {
+	cfg := config.GenerateConfig()
+	node, err := New(cfg.Certificate, GetLoggerWithPrefix("", false))
+	require_NoError(t, err)
+	defer node.Stop()
+
+	_, err = node.Listen(&url.URL{Scheme: "tcp", Host: "127.0.0.1:0", RawQuery: "proxyprotocol=v3"}, "")
+	require_Equal(t, err, error(ErrLinkProxyProtocolInvalid))
+	_, err = node.Listen(&url.URL{Scheme: "quic", Host: "127.0.0.1:0", RawQuery: "proxyprotocol=v1"}, "")
+	require_Equal(t, err, error(ErrLinkProxyProtocolNotSupported))
+}
+
+func TestWSForwardedFor(t *testing.T) {
+	conn := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+	r := &http.Request{Header: http.Header{}}
+	require_True(t, wsForwardedFor(r, conn) == nil)
+
+	r.Header.Add("X-Forwarded-For", "198.51.100.7, 192.0.2.1")
+	require_Equal(t, wsForwardedFor(r, conn).String(), "192.0.2.1:40000")
+
+	r.Header.Add("X-Forwarded-For", "not-an-address")
+	require_True(t, wsForwardedFor(r, conn) == nil)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/Arceliar/phony"
@@ -22,11 +23,48 @@ type linkQUIC struct {
 type linkQUICStream struct {
 	*quic.Conn
 	*quic.Stream
+	mutex      sync.Mutex
+	closed     bool
+	transports []*quic.Transport // Owned by the stream, i.e. when dialling
+}
+
+func (s *linkQUICStream) Close() error {
+	err := s.Stream.Close()
+	_ = s.Conn.CloseWithError(0, "")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for _, tr := range s.transports {
+		_ = tr.Close()
+		_ = tr.Conn.Close()
+	}
+	s.transports = nil
+	return err
+}
+
+// addTransport hands ownership of a transport to the stream, returning false
+// if the stream has already been closed, in which case the caller must close
+// it instead.
+func (s *linkQUICStream) addTransport(tr *quic.Transport) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	s.transports = append(s.transports, tr)
+	return true
 }
 
 type linkQUICListener struct {
 	*quic.Listener
-	ch <-chan *linkQUICStream
+	pconn net.PacketConn
+	ch    <-chan *linkQUICStream
+}
+
+func (l *linkQUICListener) Close() error {
+	err := l.Listener.Close()
+	_ = l.pconn.Close()
+	return err
 }
 
 func (l *linkQUICListener) Accept() (net.Conn, error) {
@@ -50,36 +88,202 @@ func (l *links) newLinkQUIC() *linkQUIC {
 	return lt
 }
 
+// linkTimeoutsFor parses the "keepalive" and "idletimeout" query parameters.
+// These are only used by QUIC links, as the other link types rely on the
+// keepalives of the Yggdrasil protocol itself.
+func linkTimeoutsFor(u *url.URL) (keepAlive, idleTimeout time.Duration, err error) {
+	for name, d := range map[string]*time.Duration{
+		"keepalive":   &keepAlive,
+		"idletimeout": &idleTimeout,
+	} {
+		if p := u.Query().Get(name); p != "" {
+			if *d, err = time.ParseDuration(p); err != nil || *d <= 0 {
+				return 0, 0, ErrLinkTimeoutInvalid
+			}
+		}
+	}
+	return keepAlive, idleTimeout, nil
+}
+
+func (l *linkQUIC) configFor(options linkOptions) *quic.Config {
+	quicconfig := l.quicconfig.Clone()
+	if options.keepAlive > 0 {
+		quicconfig.KeepAlivePeriod = options.keepAlive
+	}
+	if options.idleTimeout > 0 {
+		quicconfig.MaxIdleTimeout = options.idleTimeout
+	}
+	return quicconfig
+}
+
 func (l *linkQUIC) dial(ctx context.Context, url *url.URL, info linkInfo, options linkOptions) (net.Conn, error) {
-	tlsconfig := l.tlsconfig.Clone()
 	return l.findSuitableIP(url, func(hostname string, ip net.IP, port int) (net.Conn, error) {
+		tlsconfig := l.tlsconfig.Clone()
 		tlsconfig.ServerName = hostname
 		tlsconfig.MinVersion = tls.VersionTLS12
 		tlsconfig.MaxVersion = tls.VersionTLS13
-		hostport := net.JoinHostPort(ip.String(), fmt.Sprintf("%d", port))
-		qc, err := quic.DialAddr(ctx, hostport, l.tlsconfig, l.quicconfig)
+		if sni := options.tlsSNI; sni != "" {
+			tlsconfig.ServerName = sni
+		}
+		// The source address and interface binding are chosen in exactly
+		// the same way as for TCP, which also fills in the zone for
+		// link-local addresses.
+		dst := &net.TCPAddr{
+			IP:   ip,
+			Port: port,
+		}
+		dialer, err := l.tcp.dialerFor(dst, info.sintf, options.linkSocketOptions)
+		if err != nil {
+			return nil, err
+		}
+		laddr := ":0"
+		if src, ok := dialer.LocalAddr.(*net.TCPAddr); ok {
+			laddr = (&net.UDPAddr{IP: src.IP, Zone: src.Zone}).String()
+		}
+		pconn, err := options.listenPacket(ctx, dialer.Control, "udp", laddr)
 		if err != nil {
 			return nil, err
 		}
+		addr := &net.UDPAddr{
+			IP:   dst.IP,
+			Port: dst.Port,
+			Zone: dst.Zone,
+		}
+		tr := &quic.Transport{Conn: pconn}
+		qc, err := tr.Dial(ctx, addr, tlsconfig, l.configFor(options))
+		if err != nil {
+			_ = tr.Close()
+			_ = pconn.Close()
+			return nil, err
+		}
 		qs, err := qc.OpenStreamSync(ctx)
 		if err != nil {
+			_ = qc.CloseWithError(1, fmt.Sprintf("stream error: %s", err))
+			_ = tr.Close()
+			_ = pconn.Close()
 			return nil, err
 		}
-		return &linkQUICStream{
-			Conn:   qc,
-			Stream: qs,
-		}, nil
+		stream := &linkQUICStream{
+			Conn:       qc,
+			Stream:     qs,
+			transports: []*quic.Transport{tr},
+		}
+		// Connections bound to an interface or a link-local address have
+		// nowhere else to go, and we can't tell where packets would be
+		// routed from inside another namespace or through a custom
+		// PacketListener, so only migrate when none of those apply.
+		if info.sintf == "" && laddr == ":0" && !addr.IP.IsLinkLocalUnicast() && options.netns == "" && options.packetListener == nil {
+			go l.migrate(stream, addr, options)
+		}
+		return stream, nil
 	})
 }
 
-func (l *linkQUIC) listen(ctx context.Context, url *url.URL, _ string) (net.Listener, error) {
-	ql, err := quic.ListenAddr(url.Host, l.tlsconfig, l.quicconfig)
+// quicMigrationInterval is how often a dialled QUIC connection checks
+// whether the source address for the peer has changed.
+const quicMigrationInterval = time.Second * 5
+
+// migrate watches for the source address that the OS would use to reach the
+// peer changing, i.e. because a mobile device switched networks, and moves
+// the connection onto a new socket when it does. The peer validates the new
+// path before it is used, so the link survives without a new handshake.
+func (l *linkQUIC) migrate(stream *linkQUICStream, remote *net.UDPAddr, options linkOptions) {
+	ctx := stream.Conn.Context()
+	source := l.sourceFor(remote, options)
+	ticker := time.NewTicker(quicMigrationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := l.sourceFor(remote, options)
+		if current == nil || current.Equal(source) {
+			continue
+		}
+		if err := l.migrateStream(ctx, stream, options); err != nil {
+			l.log.Debugf("QUIC connection migration to %s for %s failed: %s", current, remote, err)
+		} else {
+			l.log.Debugf("QUIC connection to %s migrated from %s to %s", remote, source, current)
+		}
+		source = current
+	}
+}
+
+func (l *linkQUIC) migrateStream(ctx context.Context, stream *linkQUICStream, options linkOptions) error {
+	pconn, err := options.listenPacket(ctx, nil, "udp", ":0")
+	if err != nil {
+		return err
+	}
+	tr := &quic.Transport{Conn: pconn}
+	closeTransport := func() {
+		_ = tr.Close()
+		_ = pconn.Close()
+	}
+	path, err := stream.Conn.AddPath(tr)
+	if err != nil {
+		closeTransport()
+		return err
+	}
+	probectx, cancel := context.WithTimeout(ctx, quicMigrationInterval)
+	defer cancel()
+	if err = path.Probe(probectx); err != nil {
+		_ = path.Close()
+		closeTransport()
+		return err
+	}
+	if err = path.Switch(); err != nil {
+		_ = path.Close()
+		closeTransport()
+		return err
+	}
+	// The old transports can't be closed yet without killing the whole
+	// connection, so they are kept until the stream is closed.
+	if !stream.addTransport(tr) {
+		closeTransport()
+		return net.ErrClosed
+	}
+	return nil
+}
+
+// sourceFor returns the source address that would currently be used to
+// reach the remote address, without sending anything.
+func (l *linkQUIC) sourceFor(remote *net.UDPAddr, options linkOptions) net.IP {
+	dialer := &net.Dialer{
+		Control: options.control(nil),
+	}
+	conn, err := dialer.Dial("udp", remote.String())
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+func (l *linkQUIC) listen(ctx context.Context, url *url.URL, sintf string, options linkOptions) (net.Listener, error) {
+	hostport := url.Host
+	if sintf != "" {
+		if host, port, err := net.SplitHostPort(hostport); err == nil {
+			hostport = fmt.Sprintf("[%s%%%s]:%s", host, sintf, port)
+		}
+	}
+	pconn, err := options.listenPacket(ctx, nil, "udp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	ql, err := quic.Listen(pconn, l.tlsconfig, l.configFor(options))
 	if err != nil {
+		_ = pconn.Close()
 		return nil, err
 	}
 	ch := make(chan *linkQUICStream)
 	lql := &linkQUICListener{
 		Listener: ql,
+		pconn:    pconn,
 		ch:       ch,
 	}
 	go func() {
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+)
+
+func TestQUICTimeoutOptions(t *testing.T) {
+	for uri, expected := range map[string]error{
+		"quic://127.0.0.1:1?keepalive=5s&idletimeout=30s": nil,
+		"quic://127.0.0.1:1?keepalive=0s":                 ErrLinkTimeoutInvalid,
+		"quic://127.0.0.1:1?idletimeout=soon":             ErrLinkTimeoutInvalid,
+	} {
+		u, err := url.Parse(uri)
+		require_NoError(t, err)
+		_, _, err = linkTimeoutsFor(u)
+		require_Equal(t, err, expected)
+	}
+}
+
+func TestQUICMigration(t *testing.T) {
+	cfgA, cfgB := config.GenerateConfig(), config.GenerateConfig()
+	require_NoError(t, cfgA.GenerateSelfSignedCertificate())
+	require_NoError(t, cfgB.GenerateSelfSignedCertificate())
+
+	logger := GetLoggerWithPrefix("", false)
+	nodeA, err := New(cfgA.Certificate, logger)
+	require_NoError(t, err)
+	defer nodeA.Stop()
+	nodeB, err := New(cfgB.Certificate, logger)
+	require_NoError(t, err)
+	defer nodeB.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	listener, err := nodeA.links.quic.listen(ctx, &url.URL{Scheme: "quic", Host: "127.0.0.1:0"}, "", linkOptions{})
+	require_NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	u := &url.URL{Scheme: "quic", Host: listener.Addr().String()}
+	conn, err := nodeB.links.quic.dial(ctx, u, linkInfo{}, linkOptions{})
+	require_NoError(t, err)
+	defer conn.Close()
+
+	echo := func(msg string) {
+		_, err := conn.Write([]byte(msg))
+		require_NoError(t, err)
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, buf)
+		require_NoError(t, err)
+		require_Equal(t, string(buf), msg)
+	}
+	echo("before")
+
+	stream := conn.(*linkQUICStream)
+	require_NoError(t, nodeB.links.quic.migrateStream(ctx, stream, linkOptions{}))
+	require_Equal(t, len(stream.transports), 2)
+	echo("after")
+}
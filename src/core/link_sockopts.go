@@ -0,0 +1,91 @@
+package core
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"syscall"
+)
+
+// linkSocketOptions are applied to the sockets used by network-based
+// links. They start out with the node-wide defaults and can be overridden
+// per peer or per listener using URI query parameters.
+type linkSocketOptions struct {
+	mark           uint32         // SO_MARK/fwmark to set on the socket, 0 to leave unset
+	vrf            string         // VRF device to bind the socket to
+	netns          string         // Named network namespace, or path, to open the socket in
+	dialer         Dialer         // Replaces all of the above for outbound connections, if set
+	packetListener PacketListener // Replaces all of the above for UDP sockets, if set
+}
+
+func (l *links) socketOptionsFor(u *url.URL) (linkSocketOptions, error) {
+	opts := l.core.config.socket
+	if p := u.Query().Get("mark"); p != "" {
+		mark, err := strconv.ParseUint(p, 0, 32)
+		if err != nil {
+			return opts, ErrLinkSocketMarkInvalid
+		}
+		opts.mark = uint32(mark)
+	}
+	if p := u.Query().Get("vrf"); p != "" {
+		opts.vrf = p
+	}
+	if p := u.Query().Get("netns"); p != "" {
+		opts.netns = p
+	}
+	return opts, nil
+}
+
+// linkDialer is a dial function which also satisfies the dialer interfaces
+// from golang.org/x/net/proxy, so it can be used as a forwarding dialer.
+type linkDialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (d linkDialer) Dial(network, address string) (net.Conn, error) {
+	return d(context.Background(), network, address)
+}
+
+func (d linkDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d(ctx, network, address)
+}
+
+// dialContext returns the function that all outbound link connections must
+// be made with. If a custom Dialer was given as a setup option then it is
+// used, otherwise the connection is made with the given dialer in the
+// configured network namespace. The namespace is entered here as well as
+// around the whole dial, as HTTP transports dial from their own goroutines.
+func (o linkSocketOptions) dialContext(dialer *net.Dialer) linkDialer {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if o.dialer != nil {
+			if dialer.Timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+				defer cancel()
+			}
+			return o.dialer(ctx, network, address)
+		}
+		var conn net.Conn
+		err := o.inNetNS(func() (err error) {
+			conn, err = dialer.DialContext(ctx, network, address)
+			return
+		})
+		return conn, err
+	}
+}
+
+// listenPacket opens a UDP socket, i.e. for QUIC, either using the custom
+// PacketListener if one was given as a setup option or with the configured
+// socket options applied. If control is nil then the socket options alone
+// are applied, otherwise control must already include them.
+func (o linkSocketOptions) listenPacket(ctx context.Context, control func(string, string, syscall.RawConn) error, network, address string) (net.PacketConn, error) {
+	if o.packetListener != nil {
+		return o.packetListener(ctx, network, address)
+	}
+	if control == nil {
+		control = o.control(nil)
+	}
+	listenconfig := &net.ListenConfig{
+		Control: control,
+	}
+	return listenconfig.ListenPacket(ctx, network, address)
+}
@@ -0,0 +1,85 @@
+//go:build linux
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func (o linkSocketOptions) control(next func(string, string, syscall.RawConn) error) func(string, string, syscall.RawConn) error {
+	if o.mark == 0 && o.vrf == "" {
+		return next
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			if o.mark != 0 {
+				if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(o.mark)); err != nil {
+					err = fmt.Errorf("failed to set SO_MARK %d: %w", o.mark, err)
+					return
+				}
+			}
+			if o.vrf != "" {
+				if err = unix.BindToDevice(int(fd), o.vrf); err != nil {
+					err = fmt.Errorf("failed to bind to VRF %q: %w", o.vrf, err)
+					return
+				}
+			}
+		})
+		switch {
+		case cerr != nil:
+			return cerr
+		case err != nil:
+			return err
+		case next != nil:
+			return next(network, address, c)
+		default:
+			return nil
+		}
+	}
+}
+
+// inNetNS runs fn with the current OS thread switched into the configured
+// network namespace, so that any sockets created synchronously by fn are
+// created in that namespace. Sockets keep their namespace after that.
+func (o linkSocketOptions) inNetNS(fn func() error) error {
+	if o.netns == "" {
+		return fn()
+	}
+	path := o.netns
+	if !filepath.IsAbs(path) {
+		path = filepath.Join("/var/run/netns", path)
+	}
+	target, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace %q: %w", o.netns, err)
+	}
+	defer unix.Close(target) // nolint:errcheck
+
+	runtime.LockOSThread()
+	self := fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid())
+	origin, err := unix.Open(self, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open current network namespace: %w", err)
+	}
+	defer unix.Close(origin) // nolint:errcheck
+	if err = unix.Setns(target, unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter network namespace %q: %w", o.netns, err)
+	}
+	defer func() {
+		// If we can't get back to where we started then the thread stays
+		// locked, so that the runtime throws it away instead of reusing it.
+		if unix.Setns(origin, unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package core
+
+import (
+	"syscall"
+)
+
+func (o linkSocketOptions) control(next func(string, string, syscall.RawConn) error) func(string, string, syscall.RawConn) error {
+	if o.mark == 0 && o.vrf == "" {
+		return next
+	}
+	return func(_, _ string, _ syscall.RawConn) error {
+		return ErrLinkSocketOptionsUnsupported
+	}
+}
+
+func (o linkSocketOptions) inNetNS(fn func() error) error {
+	if o.netns == "" {
+		return fn()
+	}
+	return ErrLinkSocketOptionsUnsupported
+}
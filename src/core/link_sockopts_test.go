@@ -0,0 +1,34 @@
+package core
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+)
+
+func TestSocketOptionsFor(t *testing.T) {
+	cfg := config.GenerateConfig()
+	c, err := New(cfg.Certificate, nil, LinkSocketMark(0x51), LinkVRF("vrf-blue"))
+	require_NoError(t, err)
+	defer c.Stop()
+
+	u, _ := url.Parse("tcp://1.2.3.4:5678")
+	opts, err := c.links.socketOptionsFor(u)
+	require_NoError(t, err)
+	require_Equal(t, opts.mark, 0x51)
+	require_Equal(t, opts.vrf, "vrf-blue")
+	require_Equal(t, opts.netns, "")
+
+	u, _ = url.Parse("tcp://1.2.3.4:5678?mark=0x100&vrf=vrf-red&netns=underlay")
+	opts, err = c.links.socketOptionsFor(u)
+	require_NoError(t, err)
+	require_Equal(t, opts.mark, 0x100)
+	require_Equal(t, opts.vrf, "vrf-red")
+	require_Equal(t, opts.netns, "underlay")
+
+	u, _ = url.Parse("tcp://1.2.3.4:5678?mark=red")
+	_, err = c.links.socketOptionsFor(u)
+	require_Equal(t, err, error(ErrLinkSocketMarkInvalid))
+	require_Error(t, c.AddPeer(u, ""))
+}
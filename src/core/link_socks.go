@@ -36,11 +36,11 @@ func (l *linkSOCKS) dial(_ context.Context, url *url.URL, info linkInfo, options
 		dialer, err := l.tcp.dialerFor(&net.TCPAddr{
 			IP:   ip,
 			Port: port,
-		}, info.sintf)
+		}, info.sintf, options.linkSocketOptions)
 		if err != nil {
 			return nil, err
 		}
-		proxy, err := proxy.SOCKS5("tcp", hostport, proxyAuth, dialer)
+		proxy, err := proxy.SOCKS5("tcp", hostport, proxyAuth, options.dialContext(dialer))
 		if err != nil {
 			return nil, err
 		}
@@ -62,6 +62,6 @@ func (l *linkSOCKS) dial(_ context.Context, url *url.URL, info linkInfo, options
 	})
 }
 
-func (l *linkSOCKS) listen(ctx context.Context, url *url.URL, _ string) (net.Listener, error) {
+func (l *linkSOCKS) listen(ctx context.Context, url *url.URL, _ string, options linkOptions) (net.Listener, error) {
 	return nil, fmt.Errorf("SOCKS listener not supported")
 }
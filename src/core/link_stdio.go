@@ -0,0 +1,115 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Arceliar/phony"
+)
+
+type linkStdio struct {
+	phony.Inbox
+	*links
+	used atomic.Bool // stdin/stdout can only be handed out once
+}
+
+type linkStdioListener struct {
+	ch     chan net.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+// linkStdioConn is the stdin/stdout connection. Closing it stops the
+// listener, as there won't be another, and calls the StdioClosed option.
+type linkStdioConn struct {
+	net.Conn
+	once   sync.Once
+	closed func()
+}
+
+func (l *links) newLinkStdio() *linkStdio {
+	lt := &linkStdio{
+		links: l,
+	}
+	return lt
+}
+
+func (l *linkStdio) dial(ctx context.Context, url *url.URL, info linkInfo, options linkOptions) (net.Conn, error) {
+	return nil, fmt.Errorf("stdio links can only be used as a listener")
+}
+
+// The stdio listener accepts exactly one peering on the process stdin and
+// stdout, i.e. when started from inetd or as the remote end of an exec link
+// over SSH. Logging must not be sent to stdout when this is in use. Once the
+// peering closes, the listener stops and the StdioClosed option is called so
+// that the process can exit.
+func (l *linkStdio) listen(ctx context.Context, url *url.URL, _ string, options linkOptions) (net.Listener, error) {
+	if !l.used.CompareAndSwap(false, true) {
+		return nil, fmt.Errorf("stdio listener can only be started once")
+	}
+	var conn net.Conn
+	if fc, err := net.FileConn(os.Stdin); err == nil {
+		// If stdin is a socket, as it will be under inetd, then we can use it
+		// directly and get a real remote address for the link info.
+		conn = fc
+	} else {
+		conn = &linkPipeConn{
+			reader: os.Stdin,
+			writer: os.Stdout,
+			local:  linkPipeAddr("stdio"),
+			remote: linkPipeAddr("stdio"),
+		}
+	}
+	li := &linkStdioListener{
+		ch: make(chan net.Conn, 1),
+	}
+	li.ctx, li.cancel = context.WithCancel(ctx)
+	li.ch <- &linkStdioConn{
+		Conn: conn,
+		closed: func() {
+			_ = li.Close()
+			if closed := l.core.config.stdioClosed; closed != nil {
+				closed()
+			}
+		},
+	}
+	return li, nil
+}
+
+func (c *linkStdioConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.closed)
+	return err
+}
+
+func (l *linkStdioListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ch:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *linkStdioListener) Addr() net.Addr {
+	return linkPipeAddr("stdio")
+}
+
+func (l *linkStdioListener) Close() error {
+	l.once.Do(func() {
+		l.cancel()
+		select {
+		case conn := <-l.ch:
+			// It was never accepted, so this isn't the peering closing
+			_ = conn.(*linkStdioConn).Conn.Close()
+		default:
+		}
+	})
+	return nil
+}
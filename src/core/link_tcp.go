@@ -28,30 +28,41 @@ func (l *links) newLinkTCP() *linkTCP {
 }
 
 func (l *linkTCP) dial(ctx context.Context, url *url.URL, info linkInfo, options linkOptions) (net.Conn, error) {
+	if via, err := l.proxyFor(url, info, options); err != nil {
+		return nil, err
+	} else if via != nil {
+		return l.dialProxy(ctx, via, url.Host, options)
+	}
 	return l.findSuitableIP(url, func(hostname string, ip net.IP, port int) (net.Conn, error) {
 		addr := &net.TCPAddr{
 			IP:   ip,
 			Port: port,
 		}
-		dialer, err := l.tcp.dialerFor(addr, info.sintf)
+		dialer, err := l.tcp.dialerFor(addr, info.sintf, options.linkSocketOptions)
 		if err != nil {
 			return nil, err
 		}
-		return dialer.DialContext(ctx, "tcp", addr.String())
+		return options.dialContext(dialer)(ctx, "tcp", addr.String())
 	})
 }
 
-func (l *linkTCP) listen(ctx context.Context, url *url.URL, sintf string) (net.Listener, error) {
+func (l *linkTCP) listen(ctx context.Context, url *url.URL, sintf string, options linkOptions) (net.Listener, error) {
 	hostport := url.Host
 	if sintf != "" {
 		if host, port, err := net.SplitHostPort(hostport); err == nil {
 			hostport = fmt.Sprintf("[%s%%%s]:%s", host, sintf, port)
 		}
 	}
-	return l.listenconfig.Listen(ctx, "tcp", hostport)
+	listenconfig := *l.listenconfig
+	listenconfig.Control = options.control(listenconfig.Control)
+	listener, err := listenconfig.Listen(ctx, "tcp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	return l.proxyProtocolListener(listener, options), nil
 }
 
-func (l *linkTCP) dialerFor(dst *net.TCPAddr, sintf string) (*net.Dialer, error) {
+func (l *linkTCP) dialerFor(dst *net.TCPAddr, sintf string, sopts linkSocketOptions) (*net.Dialer, error) {
 	if dst.IP.IsLinkLocalUnicast() {
 		if sintf != "" {
 			dst.Zone = sintf
@@ -63,10 +74,13 @@ func (l *linkTCP) dialerFor(dst *net.TCPAddr, sintf string) (*net.Dialer, error)
 	dialer := &net.Dialer{
 		Timeout:   time.Second * 5,
 		KeepAlive: -1,
-		Control:   l.tcpContext,
+		Control:   sopts.control(l.tcpContext),
 	}
 	if sintf != "" {
-		dialer.Control = l.getControl(sintf)
+		// Binding to the source interface takes the place of binding
+		// to the VRF device, as only one can be set on a socket.
+		sopts.vrf = ""
+		dialer.Control = sopts.control(l.getControl(sintf))
 		ief, err := net.InterfaceByName(sintf)
 		if err != nil {
 			// On mobile platforms (Android/iOS), InterfaceByName may fail due to
@@ -22,7 +22,7 @@ func (t *linkTCP) getControl(sintf string) func(string, string, syscall.RawConn)
 		}
 		_ = c.Control(btd)
 		if err != nil {
-			t.core.log.Debugln("Failed to set SO_BINDTODEVICE:", sintf)
+			t.log.Debugln("Failed to set SO_BINDTODEVICE:", sintf)
 		}
 		return t.tcpContext(network, address, c)
 	}
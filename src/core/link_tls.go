@@ -32,41 +32,61 @@ func (l *links) newLinkTLS(tcp *linkTCP) *linkTLS {
 }
 
 func (l *linkTLS) dial(ctx context.Context, url *url.URL, info linkInfo, options linkOptions) (net.Conn, error) {
-	tlsconfig := l.config.Clone()
-	return l.findSuitableIP(url, func(hostname string, ip net.IP, port int) (net.Conn, error) {
-		tlsconfig.ServerName = hostname
-		tlsconfig.MinVersion = tls.VersionTLS12
-		tlsconfig.MaxVersion = tls.VersionTLS13
-		if sni := options.tlsSNI; sni != "" {
-			tlsconfig.ServerName = sni
+	if via, err := l.proxyFor(url, info, options); err != nil {
+		return nil, err
+	} else if via != nil {
+		conn, err := l.dialProxy(ctx, via, url.Host, options)
+		if err != nil {
+			return nil, err
 		}
+		return l.handshake(ctx, conn, url.Hostname(), options)
+	}
+	return l.findSuitableIP(url, func(hostname string, ip net.IP, port int) (net.Conn, error) {
 		addr := &net.TCPAddr{
 			IP:   ip,
 			Port: port,
 		}
-		dialer, err := l.tcp.dialerFor(addr, info.sintf)
+		dialer, err := l.tcp.dialerFor(addr, info.sintf, options.linkSocketOptions)
 		if err != nil {
 			return nil, err
 		}
-		tlsdialer := &tls.Dialer{
-			NetDialer: dialer,
-			Config:    tlsconfig,
+		conn, err := options.dialContext(dialer)(ctx, "tcp", addr.String())
+		if err != nil {
+			return nil, err
 		}
-		return tlsdialer.DialContext(ctx, "tcp", addr.String())
+		return l.handshake(ctx, conn, hostname, options)
 	})
 }
 
-func (l *linkTLS) listen(ctx context.Context, url *url.URL, sintf string) (net.Listener, error) {
+func (l *linkTLS) handshake(ctx context.Context, conn net.Conn, hostname string, options linkOptions) (net.Conn, error) {
+	tlsconfig := l.config.Clone()
+	tlsconfig.ServerName = hostname
+	tlsconfig.MinVersion = tls.VersionTLS12
+	tlsconfig.MaxVersion = tls.VersionTLS13
+	if sni := options.tlsSNI; sni != "" {
+		tlsconfig.ServerName = sni
+	}
+	tlsconn := tls.Client(conn, tlsconfig)
+	if err := tlsconn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsconn, nil
+}
+
+func (l *linkTLS) listen(ctx context.Context, url *url.URL, sintf string, options linkOptions) (net.Listener, error) {
 	hostport := url.Host
 	if sintf != "" {
 		if host, port, err := net.SplitHostPort(hostport); err == nil {
 			hostport = fmt.Sprintf("[%s%%%s]:%s", host, sintf, port)
 		}
 	}
-	listener, err := l.listener.Listen(ctx, "tcp", hostport)
+	listenconfig := *l.listener
+	listenconfig.Control = options.control(listenconfig.Control)
+	listener, err := listenconfig.Listen(ctx, "tcp", hostport)
 	if err != nil {
 		return nil, err
 	}
-	tlslistener := tls.NewListener(listener, l.config)
+	tlslistener := tls.NewListener(l.proxyProtocolListener(listener, options), l.config)
 	return tlslistener, nil
 }
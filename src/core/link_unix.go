@@ -35,9 +35,9 @@ func (l *linkUNIX) dial(ctx context.Context, url *url.URL, info linkInfo, option
 	if err != nil {
 		return nil, err
 	}
-	return l.dialer.DialContext(ctx, "unix", addr.String())
+	return options.dialContext(l.dialer)(ctx, "unix", addr.String())
 }
 
-func (l *linkUNIX) listen(ctx context.Context, url *url.URL, _ string) (net.Listener, error) {
+func (l *linkUNIX) listen(ctx context.Context, url *url.URL, _ string, options linkOptions) (net.Listener, error) {
 	return l.listener.Listen(ctx, "unix", url.Path)
 }
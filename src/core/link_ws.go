@@ -2,14 +2,17 @@ package core
 
 import (
 	"context"
-	"fmt"
+	"crypto/subtle"
+	"encoding/base64"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/Arceliar/phony"
 	"github.com/coder/websocket"
+	"golang.org/x/net/http/httpguts"
 )
 
 type linkWS struct {
@@ -20,6 +23,14 @@ type linkWS struct {
 
 type linkWSConn struct {
 	net.Conn
+	remote net.Addr // From X-Forwarded-For, if trusted
+}
+
+func (c *linkWSConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
 }
 
 type linkWSListener struct {
@@ -30,9 +41,13 @@ type linkWSListener struct {
 }
 
 type wsServer struct {
-	ch            chan *linkWSConn
-	ctx           context.Context
-	acceptOptions *websocket.AcceptOptions
+	ch             chan *linkWSConn
+	ctx            context.Context
+	acceptOptions  *websocket.AcceptOptions
+	trustForwarded bool
+	path           string        // Only accept upgrades on this path, if set
+	token          string        // Bearer token that clients must send, if set
+	basicAuth      *url.Userinfo // Basic auth credentials that clients must send, if set
 }
 
 func (l *linkWSListener) Accept() (net.Conn, error) {
@@ -61,6 +76,19 @@ func (s *wsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.path != "" && strings.TrimSuffix(r.URL.Path, "/") != s.path {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !s.authorised(r) {
+		if s.basicAuth != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="yggdrasil"`)
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
 	c, err := websocket.Accept(w, r, s.acceptOptions)
 	if err != nil {
 		return
@@ -71,9 +99,60 @@ func (s *wsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.ch <- &linkWSConn{
+	conn := &linkWSConn{
 		Conn: websocket.NetConn(s.ctx, c, websocket.MessageBinary),
 	}
+	if s.trustForwarded {
+		conn.remote = wsForwardedFor(r, conn.Conn.RemoteAddr())
+	}
+	s.ch <- conn
+}
+
+// authorised checks the credentials sent by the client, if the listener
+// requires any. When both a token and basic auth are configured then either
+// of them is accepted.
+func (s *wsServer) authorised(r *http.Request) bool {
+	if s.token == "" && s.basicAuth == nil {
+		return true
+	}
+	if s.token != "" {
+		expected := []byte("Bearer " + s.token)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1 {
+			return true
+		}
+	}
+	if s.basicAuth != nil {
+		username, password, ok := r.BasicAuth()
+		expected, _ := s.basicAuth.Password()
+		userOK := subtle.ConstantTimeCompare([]byte(username), []byte(s.basicAuth.Username()))
+		passOK := subtle.ConstantTimeCompare([]byte(password), []byte(expected))
+		if ok && userOK&passOK == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// wsForwardedFor returns the client address from the X-Forwarded-For header
+// if there is one. Only the last entry can be trusted, as that is the one
+// added by the reverse proxy in front of us. The port from the connection to
+// the reverse proxy is kept, so that each connection still has a distinct
+// address.
+func wsForwardedFor(r *http.Request, addr net.Addr) net.Addr {
+	values := r.Header.Values("X-Forwarded-For")
+	if len(values) == 0 {
+		return nil
+	}
+	entries := strings.Split(values[len(values)-1], ",")
+	ip := net.ParseIP(strings.TrimSpace(entries[len(entries)-1]))
+	if ip == nil {
+		return nil
+	}
+	forwarded := &net.TCPAddr{IP: ip}
+	if tcpaddr, ok := addr.(*net.TCPAddr); ok {
+		forwarded.Port = tcpaddr.Port
+	}
+	return forwarded
 }
 
 func (l *links) newLinkWS() *linkWS {
@@ -106,50 +185,106 @@ func wsAcceptOptions(url *url.URL) *websocket.AcceptOptions {
 }
 
 func (l *linkWS) dial(ctx context.Context, url *url.URL, info linkInfo, options linkOptions) (net.Conn, error) {
+	if via, err := l.proxyFor(url, info, options); err != nil {
+		return nil, err
+	} else if via != nil {
+		return wsDial(ctx, wsDialURL(url, url.Host), url.Hostname(), options.httpHeaders, &http.Transport{
+			DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+				return l.dialProxy(ctx, via, address, options)
+			},
+		})
+	}
 	return l.findSuitableIP(url, func(hostname string, ip net.IP, port int) (net.Conn, error) {
-		u := *url
-		u.Host = net.JoinHostPort(ip.String(), fmt.Sprintf("%d", port))
 		addr := &net.TCPAddr{
 			IP:   ip,
 			Port: port,
 		}
-		dialer, err := l.tcp.dialerFor(addr, info.sintf)
+		dialer, err := l.tcp.dialerFor(addr, info.sintf, options.linkSocketOptions)
 		if err != nil {
 			return nil, err
 		}
-		wsconn, _, err := websocket.Dial(ctx, u.String(), &websocket.DialOptions{
-			HTTPClient: &http.Client{
-				Transport: &http.Transport{
-					Proxy:       http.ProxyFromEnvironment,
-					Dial:        dialer.Dial,
-					DialContext: dialer.DialContext,
-				},
-			},
-			Subprotocols: []string{"ygg-ws"},
-			Host:         hostname,
+		return wsDial(ctx, wsDialURL(url, addr.String()), hostname, options.httpHeaders, &http.Transport{
+			DialContext: options.dialContext(dialer),
 		})
-		if err != nil {
-			return nil, err
+	})
+}
+
+// wsDialURL returns the URL to request from the remote side. Only the path
+// is kept, as the query holds our peering options, i.e. the password, which
+// the remote side and any gateways in between have no business seeing.
+func wsDialURL(url *url.URL, host string) string {
+	u := *url
+	u.Host = host
+	u.User = nil
+	u.RawQuery, u.ForceQuery, u.Fragment, u.RawFragment = "", false, "", ""
+	return u.String()
+}
+
+// parseWSHeaders builds the headers to send when dialling a ws or wss peer.
+// Credentials in the URI are sent as basic auth, a "token" is sent as a
+// bearer token and each "header" is added as "Name: value", so that the
+// peering can pass through gateways which require authentication.
+func parseWSHeaders(u *url.URL) (http.Header, error) {
+	headers := http.Header{}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		creds := u.User.Username() + ":" + password
+		headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(creds)))
+	}
+	if token := u.Query().Get("token"); token != "" {
+		headers.Set("Authorization", "Bearer "+token)
+	}
+	for _, header := range u.Query()["header"] {
+		name, value, ok := strings.Cut(header, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return nil, ErrLinkHeaderInvalid
 		}
-		return &linkWSConn{
-			Conn: websocket.NetConn(ctx, wsconn, websocket.MessageBinary),
-		}, nil
+		headers.Add(name, strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+// wsDial is used by both the ws and wss link types. Proxies are handled by
+// the transport's dial function, so that they are always tunnelled with
+// CONNECT, hence the transport must not have a proxy of its own.
+func wsDial(ctx context.Context, u, hostname string, headers http.Header, transport *http.Transport) (net.Conn, error) {
+	wsconn, _, err := websocket.Dial(ctx, u, &websocket.DialOptions{
+		HTTPClient: &http.Client{
+			Transport: transport,
+		},
+		HTTPHeader:   headers,
+		Subprotocols: []string{"ygg-ws"},
+		Host:         hostname,
 	})
+	if err != nil {
+		return nil, err
+	}
+	return &linkWSConn{
+		Conn: websocket.NetConn(ctx, wsconn, websocket.MessageBinary),
+	}, nil
 }
 
-func (l *linkWS) listen(ctx context.Context, url *url.URL, _ string) (net.Listener, error) {
-	nl, err := l.listenconfig.Listen(ctx, "tcp", url.Host)
+func (l *linkWS) listen(ctx context.Context, url *url.URL, _ string, options linkOptions) (net.Listener, error) {
+	listenconfig := *l.listenconfig
+	listenconfig.Control = options.control(listenconfig.Control)
+	nl, err := listenconfig.Listen(ctx, "tcp", url.Host)
 	if err != nil {
 		return nil, err
 	}
+	nl = l.proxyProtocolListener(nl, options)
 
 	ch := make(chan *linkWSConn)
 
 	httpServer := &http.Server{
 		Handler: &wsServer{
-			ch:            ch,
-			ctx:           ctx,
-			acceptOptions: wsAcceptOptions(url),
+			ch:             ch,
+			ctx:            ctx,
+			acceptOptions:  wsAcceptOptions(url),
+			trustForwarded: url.Query().Get("xforwardedfor") == "true",
+			path:           strings.TrimSuffix(url.Path, "/"),
+			token:          url.Query().Get("token"),
+			basicAuth:      url.User,
 		},
 		BaseContext:  func(_ net.Listener) context.Context { return ctx },
 		ReadTimeout:  time.Second * 10,
@@ -9,7 +9,6 @@ import (
 	"net/url"
 
 	"github.com/Arceliar/phony"
-	"github.com/coder/websocket"
 )
 
 type linkWSS struct {
@@ -18,10 +17,6 @@ type linkWSS struct {
 	tlsconfig *tls.Config
 }
 
-type linkWSSConn struct {
-	net.Conn
-}
-
 func (l *links) newLinkWSS() *linkWSS {
 	lwss := &linkWSS{
 		links:     l,
@@ -31,42 +26,40 @@ func (l *links) newLinkWSS() *linkWSS {
 }
 
 func (l *linkWSS) dial(ctx context.Context, url *url.URL, info linkInfo, options linkOptions) (net.Conn, error) {
-	tlsconfig := l.tlsconfig.Clone()
+	if via, err := l.proxyFor(url, info, options); err != nil {
+		return nil, err
+	} else if via != nil {
+		return wsDial(ctx, wsDialURL(url, url.Host), url.Hostname(), options.httpHeaders, &http.Transport{
+			DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+				return l.dialProxy(ctx, via, address, options)
+			},
+			TLSClientConfig: l.clientConfig(url.Hostname()),
+		})
+	}
 	return l.findSuitableIP(url, func(hostname string, ip net.IP, port int) (net.Conn, error) {
-		tlsconfig.ServerName = hostname
-		tlsconfig.MinVersion = tls.VersionTLS12
-		tlsconfig.MaxVersion = tls.VersionTLS13
-		u := *url
-		u.Host = net.JoinHostPort(ip.String(), fmt.Sprintf("%d", port))
 		addr := &net.TCPAddr{
 			IP:   ip,
 			Port: port,
 		}
-		dialer, err := l.tcp.dialerFor(addr, info.sintf)
+		dialer, err := l.tcp.dialerFor(addr, info.sintf, options.linkSocketOptions)
 		if err != nil {
 			return nil, err
 		}
-		wsconn, _, err := websocket.Dial(ctx, u.String(), &websocket.DialOptions{
-			HTTPClient: &http.Client{
-				Transport: &http.Transport{
-					Proxy:           http.ProxyFromEnvironment,
-					Dial:            dialer.Dial,
-					DialContext:     dialer.DialContext,
-					TLSClientConfig: tlsconfig,
-				},
-			},
-			Subprotocols: []string{"ygg-ws"},
-			Host:         hostname,
+		return wsDial(ctx, wsDialURL(url, addr.String()), hostname, options.httpHeaders, &http.Transport{
+			DialContext:     options.dialContext(dialer),
+			TLSClientConfig: l.clientConfig(hostname),
 		})
-		if err != nil {
-			return nil, err
-		}
-		return &linkWSSConn{
-			Conn: websocket.NetConn(ctx, wsconn, websocket.MessageBinary),
-		}, nil
 	})
 }
 
-func (l *linkWSS) listen(ctx context.Context, url *url.URL, _ string) (net.Listener, error) {
+func (l *linkWSS) clientConfig(hostname string) *tls.Config {
+	tlsconfig := l.tlsconfig.Clone()
+	tlsconfig.ServerName = hostname
+	tlsconfig.MinVersion = tls.VersionTLS12
+	tlsconfig.MaxVersion = tls.VersionTLS13
+	return tlsconfig
+}
+
+func (l *linkWSS) listen(ctx context.Context, url *url.URL, _ string, options linkOptions) (net.Listener, error) {
 	return nil, fmt.Errorf("WSS listener not supported, use WS listener behind reverse proxy instead")
 }
@@ -0,0 +1,276 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/Arceliar/phony"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// The WebTransport link type carries a peering over a single bidirectional
+// stream of a WebTransport session, i.e. HTTP/3, so that it can pass through
+// networks and CDNs which only allow QUIC for HTTP/3.
+type linkWT struct {
+	phony.Inbox
+	*links
+	tlsconfig  *tls.Config
+	quicconfig *quic.Config
+}
+
+type linkWTConn struct {
+	*webtransport.Stream
+	session *webtransport.Session
+}
+
+func (c *linkWTConn) Close() error {
+	err := c.Stream.Close()
+	_ = c.session.CloseWithError(0, "")
+	return err
+}
+
+func (c *linkWTConn) LocalAddr() net.Addr {
+	return c.session.LocalAddr()
+}
+
+func (c *linkWTConn) RemoteAddr() net.Addr {
+	return c.session.RemoteAddr()
+}
+
+type linkWTListener struct {
+	server *webtransport.Server
+	pconn  net.PacketConn
+	ch     chan *linkWTConn
+	ctx    context.Context
+}
+
+func (l *linkWTListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ch:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, context.Canceled
+	}
+}
+
+func (l *linkWTListener) Addr() net.Addr {
+	return l.pconn.LocalAddr()
+}
+
+func (l *linkWTListener) Close() error {
+	err := l.server.Close()
+	_ = l.pconn.Close()
+	return err
+}
+
+type wtServer struct {
+	server *webtransport.Server
+	ch     chan *linkWTConn
+	ctx    context.Context
+}
+
+func (s *wtServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health" || r.URL.Path == "/healthz" {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("OK"))
+		return
+	}
+
+	session, err := s.server.Upgrade(w, r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if session.SessionState().ApplicationProtocol != "ygg-wt" {
+		_ = session.CloseWithError(0, "client must speak the ygg-wt protocol")
+		return
+	}
+
+	stream, err := session.AcceptStream(s.ctx)
+	if err != nil {
+		_ = session.CloseWithError(0, "")
+		return
+	}
+	select {
+	case s.ch <- &linkWTConn{Stream: stream, session: session}:
+	case <-s.ctx.Done():
+		_ = session.CloseWithError(0, "")
+	}
+}
+
+func (l *links) newLinkWT() *linkWT {
+	lt := &linkWT{
+		links:     l,
+		tlsconfig: l.core.config.tls.Clone(),
+		quicconfig: &quic.Config{
+			MaxIdleTimeout:                   l.quic.quicconfig.MaxIdleTimeout,
+			KeepAlivePeriod:                  l.quic.quicconfig.KeepAlivePeriod,
+			EnableDatagrams:                  true,
+			EnableStreamResetPartialDelivery: true,
+		},
+	}
+	return lt
+}
+
+// wtCheckOrigin works like the origin handling of the WebSocket listener.
+// If no origins are given then the default same-origin check applies.
+func wtCheckOrigin(u *url.URL) func(r *http.Request) bool {
+	var patterns []string
+	for _, origin := range u.Query()["origin"] {
+		switch origin {
+		case "":
+			continue
+		case "*":
+			return func(r *http.Request) bool { return true }
+		default:
+			patterns = append(patterns, strings.ToLower(origin))
+		}
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, strings.ToLower(u.Host)); matched {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (l *linkWT) configFor(options linkOptions) *quic.Config {
+	quicconfig := l.quicconfig.Clone()
+	if options.keepAlive > 0 {
+		quicconfig.KeepAlivePeriod = options.keepAlive
+	}
+	if options.idleTimeout > 0 {
+		quicconfig.MaxIdleTimeout = options.idleTimeout
+	}
+	return quicconfig
+}
+
+func (l *linkWT) dial(ctx context.Context, url *url.URL, info linkInfo, options linkOptions) (net.Conn, error) {
+	return l.findSuitableIP(url, func(hostname string, ip net.IP, port int) (net.Conn, error) {
+		tlsconfig := l.tlsconfig.Clone()
+		tlsconfig.ServerName = hostname
+		tlsconfig.MinVersion = tls.VersionTLS13
+		tlsconfig.MaxVersion = tls.VersionTLS13
+		tlsconfig.NextProtos = []string{http3.NextProtoH3}
+		if sni := options.tlsSNI; sni != "" {
+			tlsconfig.ServerName = sni
+		}
+		dst := &net.TCPAddr{
+			IP:   ip,
+			Port: port,
+		}
+		dialer, err := l.tcp.dialerFor(dst, info.sintf, options.linkSocketOptions)
+		if err != nil {
+			return nil, err
+		}
+		laddr := ":0"
+		if src, ok := dialer.LocalAddr.(*net.TCPAddr); ok {
+			laddr = (&net.UDPAddr{IP: src.IP, Zone: src.Zone}).String()
+		}
+		pconn, err := options.listenPacket(ctx, dialer.Control, "udp", laddr)
+		if err != nil {
+			return nil, err
+		}
+		tr := &quic.Transport{Conn: pconn}
+		closeTransport := func() {
+			_ = tr.Close()
+			_ = pconn.Close()
+		}
+		// The request goes to the hostname, so that the Host header and
+		// authority are correct for any HTTP/3 infrastructure in the way,
+		// but the QUIC connection is made to the address we picked. None of
+		// our own options are included, as they may contain passwords.
+		target := "https://" + net.JoinHostPort(hostname, fmt.Sprintf("%d", port)) + url.EscapedPath()
+		wtdialer := &webtransport.Dialer{
+			TLSClientConfig:      tlsconfig,
+			QUICConfig:           l.configFor(options),
+			ApplicationProtocols: []string{"ygg-wt"},
+			DialAddr: func(ctx context.Context, _ string, tlsconfig *tls.Config, quicconfig *quic.Config) (*quic.Conn, error) {
+				return tr.DialEarly(ctx, &net.UDPAddr{IP: dst.IP, Port: dst.Port, Zone: dst.Zone}, tlsconfig, quicconfig)
+			},
+		}
+		resp, session, err := wtdialer.Dial(ctx, target, nil)
+		if err != nil {
+			closeTransport()
+			if resp != nil {
+				return nil, fmt.Errorf("WebTransport request failed: %s", resp.Status)
+			}
+			return nil, err
+		}
+		context.AfterFunc(session.Context(), closeTransport)
+		if protocol := session.SessionState().ApplicationProtocol; protocol != "ygg-wt" {
+			_ = session.CloseWithError(0, "")
+			return nil, fmt.Errorf("remote side does not speak the ygg-wt protocol")
+		}
+		stream, err := session.OpenStreamSync(ctx)
+		if err != nil {
+			_ = session.CloseWithError(0, "")
+			return nil, err
+		}
+		return &linkWTConn{
+			Stream:  stream,
+			session: session,
+		}, nil
+	})
+}
+
+func (l *linkWT) listen(ctx context.Context, url *url.URL, sintf string, options linkOptions) (net.Listener, error) {
+	hostport := url.Host
+	if sintf != "" {
+		if host, port, err := net.SplitHostPort(hostport); err == nil {
+			hostport = fmt.Sprintf("[%s%%%s]:%s", host, sintf, port)
+		}
+	}
+	pconn, err := options.listenPacket(ctx, nil, "udp", hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *linkWTConn)
+	h3 := &http3.Server{
+		TLSConfig:  http3.ConfigureTLSConfig(l.tlsconfig),
+		QUICConfig: l.configFor(options),
+	}
+	webtransport.ConfigureHTTP3Server(h3)
+	server := &webtransport.Server{
+		H3:                   h3,
+		ApplicationProtocols: []string{"ygg-wt"},
+		CheckOrigin:          wtCheckOrigin(url),
+	}
+	h3.Handler = &wtServer{
+		server: server,
+		ch:     ch,
+		ctx:    ctx,
+	}
+
+	lwl := &linkWTListener{
+		server: server,
+		pconn:  pconn,
+		ch:     ch,
+		ctx:    ctx,
+	}
+	go server.Serve(pconn) // nolint:errcheck
+	return lwl, nil
+}
@@ -0,0 +1,64 @@
+package core
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+)
+
+func TestWebTransportLink(t *testing.T) {
+	cfgA, cfgB := config.GenerateConfig(), config.GenerateConfig()
+	require_NoError(t, cfgA.GenerateSelfSignedCertificate())
+	require_NoError(t, cfgB.GenerateSelfSignedCertificate())
+
+	logger := GetLoggerWithPrefix("", false)
+	nodeA, err := New(cfgA.Certificate, logger)
+	require_NoError(t, err)
+	defer nodeA.Stop()
+	nodeB, err := New(cfgB.Certificate, logger)
+	require_NoError(t, err)
+	defer nodeB.Stop()
+
+	l, err := nodeA.ListenLocal(&url.URL{Scheme: "wt", Host: "127.0.0.1:0"}, "")
+	require_NoError(t, err)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	t.Run("health", func(t *testing.T) {
+		client := &http.Client{
+			Transport: &http3.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+			Timeout: time.Second * 5,
+		}
+		resp, err := client.Get("https://127.0.0.1:" + port + "/health")
+		require_NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require_NoError(t, err)
+		require_Equal(t, resp.StatusCode, http.StatusOK)
+		require_Equal(t, string(body), "OK")
+	})
+
+	t.Run("peering", func(t *testing.T) {
+		u := &url.URL{Scheme: "wt", Host: "localhost:" + port, Path: "/ygg"}
+		require_NoError(t, nodeB.CallPeer(u, ""))
+
+		var peers []PeerInfo
+		for i := 0; i < 50; i++ {
+			time.Sleep(100 * time.Millisecond)
+			if peers = nodeB.GetPeers(); len(peers) == 1 && peers[0].Up {
+				break
+			}
+		}
+		require_Equal(t, len(peers), 1)
+		require_True(t, peers[0].Up)
+		require_True(t, peers[0].Key.Equal(nodeA.PublicKey()))
+	})
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"crypto/ed25519"
 	"encoding/hex"
 	"encoding/json"
@@ -18,7 +19,7 @@ type nodeinfo struct {
 	phony.Inbox
 	proto      *protoHandler
 	myNodeInfo json.RawMessage
-	callbacks  map[keyArray]nodeinfoCallback
+	callbacks  map[keyArray][]nodeinfoCallback
 }
 
 type nodeinfoCallback struct {
@@ -36,14 +37,22 @@ func (m *nodeinfo) init(proto *protoHandler) {
 
 func (m *nodeinfo) _init(proto *protoHandler) {
 	m.proto = proto
-	m.callbacks = make(map[keyArray]nodeinfoCallback)
+	m.callbacks = make(map[keyArray][]nodeinfoCallback)
 	m._cleanup()
 }
 
 func (m *nodeinfo) _cleanup() {
-	for boxPubKey, callback := range m.callbacks {
-		if time.Since(callback.created) > time.Minute {
+	for boxPubKey, callbacks := range m.callbacks {
+		fresh := callbacks[:0]
+		for _, callback := range callbacks {
+			if time.Since(callback.created) <= time.Minute {
+				fresh = append(fresh, callback)
+			}
+		}
+		if len(fresh) == 0 {
 			delete(m.callbacks, boxPubKey)
+		} else {
+			m.callbacks[boxPubKey] = fresh
 		}
 	}
 	time.AfterFunc(time.Second*30, func() {
@@ -52,18 +61,19 @@ func (m *nodeinfo) _cleanup() {
 }
 
 func (m *nodeinfo) _addCallback(sender keyArray, call func(nodeinfo json.RawMessage)) {
-	m.callbacks[sender] = nodeinfoCallback{
+	m.callbacks[sender] = append(m.callbacks[sender], nodeinfoCallback{
 		created: time.Now(),
 		call:    call,
-	}
+	})
 }
 
-// Handles the callback, if there is one
+// Handles the callbacks, if there are any, as several requests for the same
+// node can be waiting for the same response
 func (m *nodeinfo) _callback(sender keyArray, nodeinfo json.RawMessage) {
-	if callback, ok := m.callbacks[sender]; ok {
+	for _, callback := range m.callbacks[sender] {
 		callback.call(nodeinfo)
-		delete(m.callbacks, sender)
 	}
+	delete(m.callbacks, sender)
 }
 
 func (m *nodeinfo) _getNodeInfo() json.RawMessage {
@@ -131,6 +141,22 @@ func (m *nodeinfo) _sendRes(key keyArray) {
 	_, _ = m.proto.core.PacketConn.WriteTo(bs, iwt.Addr(key[:]))
 }
 
+// request sends a nodeinfo request to the node and waits for the response.
+// Any number of requests can wait for the same node at once, and are all
+// answered by the first response.
+func (m *nodeinfo) request(ctx context.Context, key keyArray) (json.RawMessage, error) {
+	ch := make(chan json.RawMessage, 1)
+	m.sendReq(nil, key, func(info json.RawMessage) {
+		ch <- info
+	})
+	select {
+	case <-ctx.Done():
+		return nil, errors.New("timed out waiting for response")
+	case info := <-ch:
+		return info, nil
+	}
+}
+
 // Admin socket stuff
 
 type GetNodeInfoRequest struct {
@@ -156,22 +182,16 @@ func (m *nodeinfo) nodeInfoAdminHandler(in json.RawMessage) (interface{}, error)
 		return nil, fmt.Errorf("invalid public key length")
 	}
 	copy(key[:], kbs)
-	ch := make(chan []byte, 1)
-	m.sendReq(nil, key, func(info json.RawMessage) {
-		ch <- info
-	})
-	timer := time.NewTimer(6 * time.Second)
-	defer timer.Stop()
-	select {
-	case <-timer.C:
-		return nil, errors.New("timed out waiting for response")
-	case info := <-ch:
-		var msg json.RawMessage
-		if err := msg.UnmarshalJSON(info); err != nil {
-			return nil, err
-		}
-		key := hex.EncodeToString(kbs[:])
-		res := GetNodeInfoResponse{key: msg}
-		return res, nil
+	ctx, cancel := context.WithTimeout(context.Background(), 6*time.Second)
+	defer cancel()
+	info, err := m.request(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var msg json.RawMessage
+	if err := msg.UnmarshalJSON(info); err != nil {
+		return nil, err
 	}
+	res := GetNodeInfoResponse{hex.EncodeToString(kbs[:]): msg}
+	return res, nil
 }
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestGetNodeInfoConcurrent(t *testing.T) {
+	nodeA, nodeB := CreateAndConnectTwo(t, false)
+	defer nodeA.Stop()
+	defer nodeB.Stop()
+	require_NoError(t, nodeB.proto.nodeinfo.setNodeInfo(map[string]interface{}{"name": "b"}, true))
+
+	// Protocol traffic is handled while reading from the nodes.
+	for _, node := range []*Core{nodeA, nodeB} {
+		go func(node *Core) {
+			buf := make([]byte, 65535)
+			for {
+				if _, _, err := node.ReadFrom(buf); err != nil {
+					return
+				}
+			}
+		}(node)
+	}
+	if !WaitConnected(nodeA, nodeB) {
+		t.Fatal("nodes did not connect")
+	}
+
+	// Both requests are waiting for the same node at once, and both of them
+	// should get the response rather than the second replacing the first.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			info, err := nodeA.GetNodeInfo(ctx, nodeB.PublicKey())
+			if err == nil {
+				var decoded map[string]string
+				if err = json.Unmarshal(info, &decoded); err == nil && decoded["name"] != "b" {
+					err = fmt.Errorf("unexpected nodeinfo %s", info)
+				}
+			}
+			results <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		require_NoError(t, <-results)
+	}
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"crypto/ed25519"
 	"fmt"
 	"net"
@@ -31,12 +32,26 @@ func (c *Core) _applyOption(opt SetupOption) (err error) {
 		c.config.nodeinfo = v
 	case NodeInfoPrivacy:
 		c.config.nodeinfoPrivacy = v
+	case AutoPeerPriority:
+		c.config.autoPriority = v
 	case AllowedPublicKey:
 		pk := [32]byte{}
 		copy(pk[:], v)
 		c.config._allowedPublicKeys[pk] = struct{}{}
 	case GroupPassword:
 		c.config.groupPassword = string(v)
+	case LinkSocketMark:
+		c.config.socket.mark = uint32(v)
+	case LinkVRF:
+		c.config.socket.vrf = string(v)
+	case LinkNetNS:
+		c.config.socket.netns = string(v)
+	case Dialer:
+		c.config.socket.dialer = v
+	case PacketListener:
+		c.config.socket.packetListener = v
+	case StdioClosed:
+		c.config.stdioClosed = v
 	}
 	return
 }
@@ -56,6 +71,33 @@ type AllowedPublicKey ed25519.PublicKey
 type PeerFilter func(net.IP) bool
 type GroupPassword string
 
+// AutoPeerPriority enables automatic priority for persistent peerings, so
+// that when there are multiple links to the same peer, the one with the
+// best combination of latency, loss and throughput is preferred. It can be
+// overridden for each peering with the "autopriority" URI parameter.
+type AutoPeerPriority bool
+
+// LinkSocketMark, LinkVRF and LinkNetNS set the defaults for the
+// sockets used by peerings and listeners. They are only supported on Linux
+// and can be overridden with the "mark", "vrf" and "netns" URI parameters.
+type LinkSocketMark uint32
+type LinkVRF string
+type LinkNetNS string
+
+// Dialer and PacketListener replace the way that links open their sockets,
+// i.e. so that an embedder can protect them from a VPN or route them through
+// a userspace network stack. Dialer is used for all stream-based outbound
+// links and PacketListener for the UDP sockets used by QUIC, both outbound
+// and inbound. When set, the socket mark, VRF and network namespace options
+// are not used for those sockets.
+type Dialer func(ctx context.Context, network, address string) (net.Conn, error)
+type PacketListener func(ctx context.Context, network, address string) (net.PacketConn, error)
+
+// StdioClosed is called once the peering on a stdio:// listener has closed,
+// which also stops the listener. A process started by inetd or over SSH only
+// serves that one peering, so it would usually use this to exit.
+type StdioClosed func()
+
 func (a ListenAddress) isSetupOption()    {}
 func (a Peer) isSetupOption()             {}
 func (a NodeInfo) isSetupOption()         {}
@@ -63,3 +105,10 @@ func (a NodeInfoPrivacy) isSetupOption()  {}
 func (a AllowedPublicKey) isSetupOption() {}
 func (a PeerFilter) isSetupOption()       {}
 func (a GroupPassword) isSetupOption()    {}
+func (a AutoPeerPriority) isSetupOption() {}
+func (a LinkSocketMark) isSetupOption()   {}
+func (a LinkVRF) isSetupOption()          {}
+func (a LinkNetNS) isSetupOption()        {}
+func (a Dialer) isSetupOption()           {}
+func (a PacketListener) isSetupOption()   {}
+func (a StdioClosed) isSetupOption()      {}
@@ -1,8 +1,12 @@
 package core
 
 import (
+	"context"
+	"net"
 	"net/url"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/yggdrasil-network/yggdrasil-go/src/config"
 )
@@ -51,3 +55,50 @@ func TestAddEmptyPeer(t *testing.T) {
 		t.Fatalf("Expected error on empty URL: %s", err)
 	}
 }
+
+// Tests that the Dialer and PacketListener setup options are used
+// in place of the built-in socket handling.
+func TestDialerAndPacketListener(t *testing.T) {
+	logger := GetLoggerWithPrefix("", false)
+	cfgA, cfgB := config.GenerateConfig(), config.GenerateConfig()
+
+	var dials, listens atomic.Int32
+	dialer := Dialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials.Add(1)
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	})
+	listener := PacketListener(func(ctx context.Context, network, address string) (net.PacketConn, error) {
+		listens.Add(1)
+		return (&net.ListenConfig{}).ListenPacket(ctx, network, address)
+	})
+
+	nodeA, err := New(cfgA.Certificate, logger)
+	require_NoError(t, err)
+	defer nodeA.Stop()
+
+	nodeB, err := New(cfgB.Certificate, logger, dialer, listener)
+	require_NoError(t, err)
+	defer nodeB.Stop()
+
+	for _, scheme := range []string{"tcp", "tls", "quic"} {
+		u, _ := url.Parse(scheme + "://localhost:0")
+		l, err := nodeA.Listen(u, "")
+		require_NoError(t, err)
+		u, _ = url.Parse(scheme + "://" + l.Addr().String())
+		require_NoError(t, nodeB.AddPeer(u, ""))
+	}
+
+	up := 0
+	for i := 0; i < 50 && up != 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		up = 0
+		for _, p := range nodeB.GetPeers() {
+			if p.Up {
+				up++
+			}
+		}
+	}
+	require_Equal(t, up, 3)
+	require_Equal(t, dials.Load(), 2)
+	require_Equal(t, listens.Load(), 1)
+}
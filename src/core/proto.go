@@ -2,6 +2,7 @@ package core
 
 import (
 	"crypto/ed25519"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -64,11 +65,31 @@ func (p *protoHandler) handleProto(from phony.Actor, key keyArray, bs []byte) {
 		p.nodeinfo.handleReq(p, key)
 	case typeProtoNodeInfoResponse:
 		p.nodeinfo.handleRes(p, key, bs[1:])
+	case typeProtoMTU:
+		p.handleMTU(key, bs[1:])
 	case typeProtoDebug:
 		p.handleDebug(from, key, bs[1:])
 	}
 }
 
+// MTU advertisements
+
+func (p *protoHandler) sendMTU(key keyArray, mtu uint64) {
+	if mtu > 65535 {
+		mtu = 65535
+	}
+	bs := []byte{typeSessionProto, typeProtoMTU, 0, 0}
+	binary.BigEndian.PutUint16(bs[2:], uint16(mtu))
+	_, _ = p.core.PacketConn.WriteTo(bs, iwt.Addr(key[:]))
+}
+
+func (p *protoHandler) handleMTU(key keyArray, bs []byte) {
+	if len(bs) < 2 {
+		return
+	}
+	p.core.doMTUNotify(ed25519.PublicKey(key[:]), uint64(binary.BigEndian.Uint16(bs)))
+}
+
 func (p *protoHandler) handleDebug(from phony.Actor, key keyArray, bs []byte) {
 	p.Act(from, func() {
 		p._handleDebug(key, bs)
@@ -5,6 +5,8 @@ const (
 	typeSessionDummy = iota // nolint:deadcode,varcheck
 	typeSessionTraffic
 	typeSessionProto
+	typeSessionStream
+	typeSessionDatagram
 )
 
 // Protocol packet types
@@ -12,5 +14,6 @@ const (
 	typeProtoDummy = iota
 	typeProtoNodeInfoRequest
 	typeProtoNodeInfoResponse
+	typeProtoMTU
 	typeProtoDebug = 255
 )
@@ -0,0 +1,201 @@
+// Package dns runs a small DNS server for names in the "ygg" zone, so that
+// nodes can be reached by name rather than by address. It answers for:
+//
+//   - <key>.pk.ygg, where <key> is the hex public key of a node, which may be
+//     split across labels as a whole key is too long for one
+//   - names given to addresses or keys in a hosts-style alias file
+//   - names that nearby nodes publish as "name" in their nodeinfo
+//
+// The system resolver can then be told to forward the "ygg" zone to it.
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+const answerTTL = 60 // Seconds
+
+type Server struct {
+	core          *core.Core
+	log           core.Logger
+	cancel        context.CancelFunc
+	conns         []net.PacketConn
+	mutex         sync.Mutex
+	aliases       map[string]netip.Addr
+	aliasChecked  time.Time
+	aliasModified time.Time
+	nodeInfoNames map[keyArray]nodeInfoName
+	config        struct {
+		listen  []ListenAddress
+		aliases AliasFile
+	}
+}
+
+// New starts the DNS server on the listen addresses. If none are given then
+// the server isn't started and nil is returned.
+func New(c *core.Core, log core.Logger, opts ...SetupOption) (*Server, error) {
+	s := &Server{
+		core:          c,
+		log:           log,
+		nodeInfoNames: make(map[keyArray]nodeInfoName),
+	}
+	for _, opt := range opts {
+		s._applyOption(opt)
+	}
+	if len(s.config.listen) == 0 {
+		return nil, nil
+	}
+	for _, addr := range s.config.listen {
+		pc, err := net.ListenPacket("udp", string(addr))
+		if err != nil {
+			_ = s.Stop()
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		s.conns = append(s.conns, pc)
+	}
+	s.checkAliases()
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	go s.nodeInfoLoop(ctx)
+	for _, pc := range s.conns {
+		s.log.Infof("DNS server listening on %s", pc.LocalAddr())
+		go s.serve(pc)
+	}
+	return s, nil
+}
+
+// Stop stops the DNS server.
+func (s *Server) Stop() error {
+	if s == nil {
+		return nil
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+	for _, pc := range s.conns {
+		_ = pc.Close()
+	}
+	return nil
+}
+
+func (s *Server) nodeInfoLoop(ctx context.Context) {
+	// Give the node a little time to find peers before asking for names.
+	timer := time.NewTimer(10 * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		s.updateNodeInfoNames(ctx)
+		timer.Reset(nodeInfoInterval)
+	}
+}
+
+func (s *Server) serve(pc net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if res := s.handle(buf[:n]); res != nil {
+			_, _ = pc.WriteTo(res, from)
+		}
+	}
+}
+
+// handle returns the response to the query, or nil if it isn't a query that
+// can be answered at all.
+func (s *Server) handle(query []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil
+	}
+	res := dnsmessage.Header{
+		ID:               h.ID,
+		Response:         true,
+		OpCode:           h.OpCode,
+		Authoritative:    true,
+		RecursionDesired: h.RecursionDesired,
+	}
+	q, err := p.Question()
+	switch {
+	case err != nil:
+		res.RCode = dnsmessage.RCodeFormatError
+		return s.response(res, nil, netip.Addr{})
+	case h.OpCode != 0:
+		res.RCode = dnsmessage.RCodeNotImplemented
+		return s.response(res, &q, netip.Addr{})
+	}
+	name := strings.ToLower(q.Name.String())
+	if q.Class != dnsmessage.ClassINET || (name != zone && !strings.HasSuffix(name, "."+zone)) {
+		res.Authoritative = false
+		res.RCode = dnsmessage.RCodeRefused
+		return s.response(res, &q, netip.Addr{})
+	}
+	addr, ok := s.lookup(name)
+	switch {
+	case !ok && name != zone && name != keyZone:
+		res.RCode = dnsmessage.RCodeNameError
+	case q.Type == dnsmessage.TypeALL:
+	case q.Type == dnsmessage.TypeAAAA && addr.Is6():
+	case q.Type == dnsmessage.TypeA && addr.Is4():
+	default:
+		addr = netip.Addr{} // The name exists, but there's nothing of this type
+	}
+	return s.response(res, &q, addr)
+}
+
+// response builds the response, with an A or AAAA record if an address is
+// given. Aliases can be IPv4 addresses, i.e. for routed prefixes.
+func (s *Server) response(h dnsmessage.Header, q *dnsmessage.Question, addr netip.Addr) []byte {
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), h)
+	b.EnableCompression()
+	if q == nil {
+		bs, _ := b.Finish()
+		return bs
+	}
+	if err := b.StartQuestions(); err != nil {
+		return nil
+	}
+	if err := b.Question(*q); err != nil {
+		return nil
+	}
+	if addr.IsValid() {
+		var err error
+		if err = b.StartAnswers(); err != nil {
+			return nil
+		}
+		rh := dnsmessage.ResourceHeader{
+			Name:  q.Name,
+			Class: dnsmessage.ClassINET,
+			TTL:   answerTTL,
+		}
+		if addr.Is4() {
+			err = b.AResource(rh, dnsmessage.AResource{A: addr.As4()})
+		} else {
+			err = b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: addr.As16()})
+		}
+		if err != nil {
+			return nil
+		}
+	}
+	bs, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return bs
+}
@@ -0,0 +1,116 @@
+package dns
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func query(t *testing.T, s *Server, name string, qtype dnsmessage.Type) (dnsmessage.RCode, []netip.Addr) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1234, RecursionDesired: true})
+	_ = b.StartQuestions()
+	_ = b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	})
+	q, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(s.handle(q)); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 1234 || !msg.Response {
+		t.Fatalf("unexpected header %+v", msg.Header)
+	}
+	var addrs []netip.Addr
+	for _, a := range msg.Answers {
+		switch r := a.Body.(type) {
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(r.AAAA))
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(r.A))
+		}
+	}
+	return msg.RCode, addrs
+}
+
+func TestLookup(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	other, _, _ := ed25519.GenerateKey(nil)
+	key := hex.EncodeToString(pub)
+
+	aliases := filepath.Join(t.TempDir(), "aliases")
+	contents := "# Comment\n" + key + " Laptop laptop.home.ygg\n200:1::1 server # Comment\n10.0.0.1 printer\n"
+	if err := os.WriteFile(aliases, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		log:           log.New(io.Discard, "", 0),
+		nodeInfoNames: make(map[keyArray]nodeInfoName),
+	}
+	s.config.aliases = AliasFile(aliases)
+	expires := time.Now().Add(time.Hour)
+	s.nodeInfoNames[keyArray(pub)] = nodeInfoName{name: "desktop.ygg.", expires: expires}
+	s.nodeInfoNames[keyArray(other)] = nodeInfoName{name: "clash.ygg.", expires: expires}
+	var third keyArray
+	third[0] = 1
+	s.nodeInfoNames[third] = nodeInfoName{name: "clash.ygg.", expires: expires}
+
+	addr := addressForKey(pub)
+	for _, test := range []struct {
+		name  string
+		qtype dnsmessage.Type
+		rcode dnsmessage.RCode
+		addrs []netip.Addr
+	}{
+		{key[:32] + "." + key[32:] + ".pk.ygg.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []netip.Addr{addr}},
+		{key[:32] + "." + key[32:] + ".pk.ygg.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, nil},
+		{key[:32] + ".pk.ygg.", dnsmessage.TypeAAAA, dnsmessage.RCodeNameError, nil},
+		{"LAPTOP.ygg.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []netip.Addr{addr}},
+		{"laptop.home.ygg.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []netip.Addr{addr}},
+		{"server.ygg.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []netip.Addr{netip.MustParseAddr("200:1::1")}},
+		{"printer.ygg.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []netip.Addr{netip.MustParseAddr("10.0.0.1")}},
+		{"desktop.ygg.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []netip.Addr{addr}},
+		{"clash.ygg.", dnsmessage.TypeAAAA, dnsmessage.RCodeNameError, nil},
+		{"missing.ygg.", dnsmessage.TypeAAAA, dnsmessage.RCodeNameError, nil},
+		{"ygg.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, nil},
+		{"example.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeRefused, nil},
+	} {
+		rcode, addrs := query(t, s, test.name, test.qtype)
+		if rcode != test.rcode || len(addrs) != len(test.addrs) {
+			t.Fatalf("%s %s: expected %s %v, got %s %v", test.name, test.qtype, test.rcode, test.addrs, rcode, addrs)
+		}
+		for i := range addrs {
+			if addrs[i] != test.addrs[i] {
+				t.Fatalf("%s: expected %v, got %v", test.name, test.addrs, addrs)
+			}
+		}
+	}
+}
+
+func TestNameFromNodeInfo(t *testing.T) {
+	for info, expected := range map[string]string{
+		`{"name":"Desktop"}`:        "desktop.ygg.",
+		`{"name":"desktop.ygg"}`:    "desktop.ygg.",
+		`{"name":"my desktop"}`:     "",
+		`{"name":"x.pk.ygg"}`:       "",
+		`{"name":1}`:                "",
+		`{"buildname":"yggdrasil"}`: "",
+		`not json`:                  "",
+	} {
+		if name := nameFromNodeInfo([]byte(info)); name != expected {
+			t.Fatalf("%s: expected %q, got %q", info, expected, name)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+const (
+	zone             = "ygg."
+	keyZone          = "pk." + zone
+	nodeInfoNameKey  = "name"
+	nodeInfoTTL      = 30 * time.Minute // How long a name from nodeinfo is kept for
+	nodeInfoInterval = 5 * time.Minute  // How often the known nodes are asked for names
+	nodeInfoTimeout  = 10 * time.Second
+	aliasCheck       = 5 * time.Second // How often the alias file is checked for changes
+)
+
+type keyArray [ed25519.PublicKeySize]byte
+
+type nodeInfoName struct {
+	name    string
+	expires time.Time
+}
+
+// canonicalName lowercases the name and puts it in the zone, so that names
+// can be written with or without ".ygg" in the alias file and in nodeinfo.
+func canonicalName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" || name+"." == zone {
+		return ""
+	}
+	if !strings.HasSuffix(name+".", "."+zone) {
+		name += "." + zone
+	} else {
+		name += "."
+	}
+	return name
+}
+
+// validName returns true if the name can be looked up, i.e. it is made of
+// letters, digits and hyphens in labels of the right length.
+func validName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// keyForName decodes a name in the pk.ygg zone. A key in hex is 64
+// characters, which is longer than a DNS label can be, so it can be split
+// across labels, i.e. "<first 32>.<last 32>.pk.ygg".
+func keyForName(name string) (ed25519.PublicKey, bool) {
+	if !strings.HasSuffix(name, "."+keyZone) {
+		return nil, false
+	}
+	labels := strings.TrimSuffix(name, "."+keyZone)
+	key, err := hex.DecodeString(strings.ReplaceAll(labels, ".", ""))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, false
+	}
+	return key, true
+}
+
+// addressForKey returns the Yggdrasil address of the node with the key.
+func addressForKey(key ed25519.PublicKey) netip.Addr {
+	return netip.AddrFrom16(*address.AddrForKey(key))
+}
+
+// loadAliases reads the alias file. Each line has an address or public key
+// followed by one or more names, and anything after a "#" is a comment.
+func loadAliases(path string) (map[string]netip.Addr, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	aliases := make(map[string]netip.Addr)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			key, err := hex.DecodeString(fields[0])
+			if err != nil || len(key) != ed25519.PublicKeySize {
+				continue
+			}
+			addr = addressForKey(key)
+		}
+		for _, name := range fields[1:] {
+			if name = canonicalName(name); validName(name) {
+				aliases[name] = addr.Unmap()
+			}
+		}
+	}
+	return aliases, scanner.Err()
+}
+
+// checkAliases reloads the alias file if it has changed since it was last
+// loaded, but doesn't check more often than every few seconds.
+func (s *Server) checkAliases() {
+	if s.config.aliases == "" {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if time.Since(s.aliasChecked) < aliasCheck {
+		return
+	}
+	s.aliasChecked = time.Now()
+	info, err := os.Stat(string(s.config.aliases))
+	if err != nil {
+		if !os.IsNotExist(err) || s.aliases != nil {
+			s.log.Warnf("Failed to check DNS alias file: %s", err)
+		}
+		s.aliases = nil
+		return
+	}
+	if info.ModTime().Equal(s.aliasModified) && s.aliases != nil {
+		return
+	}
+	aliases, err := loadAliases(string(s.config.aliases))
+	if err != nil {
+		s.log.Warnf("Failed to load DNS alias file: %s", err)
+		return
+	}
+	s.aliases, s.aliasModified = aliases, info.ModTime()
+	s.log.Infof("Loaded %d DNS aliases from %s", len(aliases), s.config.aliases)
+}
+
+// nameFromNodeInfo returns the name that the node published in its nodeinfo,
+// if there is one.
+func nameFromNodeInfo(info json.RawMessage) string {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(info, &fields); err != nil {
+		return ""
+	}
+	name, _ := fields[nodeInfoNameKey].(string)
+	if name = canonicalName(name); !validName(name) || strings.HasSuffix(name, "."+keyZone) {
+		return ""
+	}
+	return name
+}
+
+// updateNodeInfoNames asks the nodes that we know about, i.e. peers and nodes
+// that we have sessions or paths to, for their names if we haven't asked
+// them recently. Asking every node in the tree would be too much traffic.
+func (s *Server) updateNodeInfoNames(ctx context.Context) {
+	known := make(map[keyArray]struct{})
+	for _, p := range s.core.GetPeers() {
+		if p.Up {
+			known[keyArray(p.Key)] = struct{}{}
+		}
+	}
+	for _, p := range s.core.GetPaths() {
+		known[keyArray(p.Key)] = struct{}{}
+	}
+	for _, ss := range s.core.GetSessions() {
+		known[keyArray(ss.Key)] = struct{}{}
+	}
+	now := time.Now()
+	s.mutex.Lock()
+	for key, entry := range s.nodeInfoNames {
+		if now.After(entry.expires) {
+			delete(s.nodeInfoNames, key)
+		}
+	}
+	for key := range known {
+		if _, ok := s.nodeInfoNames[key]; ok {
+			delete(known, key)
+		}
+	}
+	s.mutex.Unlock()
+	for key := range known {
+		if ctx.Err() != nil {
+			return
+		}
+		rctx, cancel := context.WithTimeout(ctx, nodeInfoTimeout)
+		info, err := s.core.GetNodeInfo(rctx, key[:])
+		cancel()
+		if err != nil {
+			continue
+		}
+		// Remember nodes without names too, so that they aren't asked again
+		// until the entry expires.
+		s.mutex.Lock()
+		s.nodeInfoNames[key] = nodeInfoName{
+			name:    nameFromNodeInfo(info),
+			expires: time.Now().Add(nodeInfoTTL),
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// lookup returns the address for the name, which is already canonical. Names
+// in nodeinfo aren't authenticated, so if more than one node claims the same
+// name then it isn't answered at all.
+func (s *Server) lookup(name string) (netip.Addr, bool) {
+	if key, ok := keyForName(name); ok {
+		return addressForKey(key), true
+	}
+	s.checkAliases()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if addr, ok := s.aliases[name]; ok {
+		return addr, true
+	}
+	var found []keyArray
+	for key, entry := range s.nodeInfoNames {
+		if entry.name == name {
+			found = append(found, key)
+		}
+	}
+	if len(found) != 1 {
+		return netip.Addr{}, false
+	}
+	return addressForKey(found[0][:]), true
+}
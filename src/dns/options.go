@@ -0,0 +1,25 @@
+package dns
+
+func (s *Server) _applyOption(opt SetupOption) {
+	switch v := opt.(type) {
+	case ListenAddress:
+		s.config.listen = append(s.config.listen, v)
+	case AliasFile:
+		s.config.aliases = v
+	}
+}
+
+type SetupOption interface {
+	isSetupOption()
+}
+
+// ListenAddress is a "host:port" to answer queries on over UDP, i.e.
+// "[::1]:53". It can be given more than once.
+type ListenAddress string
+
+// AliasFile is the path to a hosts-style file of names for addresses or
+// public keys, one per line, i.e. "200:1234::1 server" or "<key> laptop".
+type AliasFile string
+
+func (a ListenAddress) isSetupOption() {}
+func (a AliasFile) isSetupOption()     {}
@@ -0,0 +1,348 @@
+package ipv6rwc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
+)
+
+type StartCaptureRequest struct {
+	Path    string `json:"path"`
+	Key     string `json:"key,omitempty"`
+	Address string `json:"address,omitempty"`
+	Subnet  string `json:"subnet,omitempty"`
+	SnapLen int    `json:"snaplen,omitempty"`
+}
+
+type StartCaptureResponse struct {
+	Path string `json:"path"`
+}
+
+type StopCaptureRequest struct{}
+
+type StopCaptureResponse struct {
+	Packets uint64 `json:"packets"`
+}
+
+func (rwc *ReadWriteCloser) startCaptureHandler(req *StartCaptureRequest, res *StartCaptureResponse) error {
+	rwc.mutex.Lock()
+	dir := rwc.captureDir
+	rwc.mutex.Unlock()
+	if dir == "" {
+		return errors.New("captures are disabled, set CaptureDirectory to enable them")
+	}
+	if req.Path == "" || req.Path != filepath.Base(req.Path) || req.Path == "." || req.Path == ".." {
+		return errors.New("a file name within the capture directory is required")
+	}
+	path := filepath.Join(dir, req.Path)
+	filter := CaptureFilter{
+		SnapLen: req.SnapLen,
+	}
+	if req.Key != "" {
+		key, err := hex.DecodeString(req.Key)
+		if err != nil {
+			return fmt.Errorf("invalid key: %w", err)
+		}
+		filter.Key = key
+	}
+	switch {
+	case req.Address != "" && req.Subnet != "":
+		return errors.New("only one of address or subnet can be given")
+	case req.Address != "":
+		addr, err := netip.ParseAddr(req.Address)
+		if err != nil {
+			return fmt.Errorf("invalid address %q", req.Address)
+		}
+		filter.Prefix = netip.PrefixFrom(addr, addr.BitLen())
+	case req.Subnet != "":
+		prefix, err := netip.ParsePrefix(req.Subnet)
+		if err != nil {
+			return fmt.Errorf("invalid subnet %q", req.Subnet)
+		}
+		filter.Prefix = prefix.Masked()
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err = rwc.StartCapture(f, filter); err != nil {
+		_ = f.Close() // Harmless if the capture already closed it
+		_ = os.Remove(path)
+		return err
+	}
+	res.Path = path
+	return nil
+}
+
+func (rwc *ReadWriteCloser) stopCaptureHandler(_ *StopCaptureRequest, res *StopCaptureResponse) error {
+	packets, err := rwc.StopCapture()
+	res.Packets = packets
+	return err
+}
+
+type GetFirewallRequest struct{}
+
+type GetFirewallResponse struct {
+	Enabled bool                `json:"enabled"`
+	Rules   []FirewallRuleEntry `json:"rules"`
+	Flows   int                 `json:"flows"`
+	Dropped uint64              `json:"dropped"`
+}
+
+type FirewallRuleEntry struct {
+	Index    int      `json:"index"`
+	Action   string   `json:"action"`
+	Keys     []string `json:"keys,omitempty"`
+	Protocol string   `json:"protocol,omitempty"`
+	Ports    string   `json:"ports,omitempty"`
+	Hits     uint64   `json:"hits"`
+}
+
+type SetFirewallRequest struct {
+	Enabled string `json:"enabled"`
+}
+
+type SetFirewallResponse struct{}
+
+type AddFirewallRuleRequest struct {
+	Action   string `json:"action"`
+	Keys     string `json:"keys,omitempty"` // Comma-separated
+	Protocol string `json:"protocol,omitempty"`
+	Ports    string `json:"ports,omitempty"`
+	Index    string `json:"index,omitempty"`
+}
+
+type AddFirewallRuleResponse struct {
+	Rule string `json:"rule"`
+}
+
+type RemoveFirewallRuleRequest struct {
+	Index string `json:"index"`
+}
+
+type RemoveFirewallRuleResponse struct{}
+
+func (rwc *ReadWriteCloser) getFirewallHandler(_ *GetFirewallRequest, res *GetFirewallResponse) error {
+	f := &rwc.firewall
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	res.Enabled = f.enabled
+	res.Flows = len(f.flows)
+	res.Dropped = f.dropped
+	res.Rules = make([]FirewallRuleEntry, 0, len(f.rules))
+	for i, rule := range f.rules {
+		entry := FirewallRuleEntry{
+			Index:    i,
+			Action:   "deny",
+			Protocol: rule.Protocol,
+			Hits:     rule.hits,
+		}
+		if rule.Allow {
+			entry.Action = "allow"
+		}
+		for _, key := range rule.Keys {
+			entry.Keys = append(entry.Keys, hex.EncodeToString(key))
+		}
+		entry.Ports = rule.ports()
+		res.Rules = append(res.Rules, entry)
+	}
+	return nil
+}
+
+func (rwc *ReadWriteCloser) addFirewallRuleHandler(req *AddFirewallRuleRequest, res *AddFirewallRuleResponse) error {
+	var keys []string
+	if req.Keys != "" {
+		keys = strings.Split(req.Keys, ",")
+	}
+	rule, err := ParseFirewallRule(req.Action, keys, req.Protocol, req.Ports)
+	if err != nil {
+		return err
+	}
+	index := -1
+	if req.Index != "" {
+		if index, err = strconv.Atoi(req.Index); err != nil || index < 0 {
+			return fmt.Errorf("invalid firewall rule index %q", req.Index)
+		}
+	}
+	if err = rwc.AddFirewallRule(rule, index); err != nil {
+		return err
+	}
+	res.Rule = rule.String()
+	return nil
+}
+
+func (rwc *ReadWriteCloser) setFirewallHandler(req *SetFirewallRequest, _ *SetFirewallResponse) error {
+	enabled, err := strconv.ParseBool(req.Enabled)
+	if err != nil {
+		return fmt.Errorf("invalid value for enabled %q", req.Enabled)
+	}
+	rwc.SetFirewall(enabled)
+	return nil
+}
+
+func (rwc *ReadWriteCloser) removeFirewallRuleHandler(req *RemoveFirewallRuleRequest, _ *RemoveFirewallRuleResponse) error {
+	index, err := strconv.Atoi(req.Index)
+	if err != nil {
+		return fmt.Errorf("invalid firewall rule index %q", req.Index)
+	}
+	return rwc.RemoveFirewallRule(index)
+}
+
+type GetLookupQueuesRequest struct{}
+
+type GetLookupQueuesResponse struct {
+	Queues  []LookupQueueEntry `json:"queues"`
+	Packets int                `json:"packets"`
+	Bytes   int                `json:"bytes"`
+	Queued  uint64             `json:"queued"`
+	Flushed uint64             `json:"flushed"`
+	Dropped uint64             `json:"dropped"`
+	Expired uint64             `json:"expired"`
+}
+
+type LookupQueueEntry struct {
+	Destination string `json:"destination"` // Address or subnet
+	Packets     int    `json:"packets"`
+	Bytes       int    `json:"bytes"`
+}
+
+func (rwc *ReadWriteCloser) getLookupQueuesHandler(_ *GetLookupQueuesRequest, res *GetLookupQueuesResponse) error {
+	rwc.mutex.Lock()
+	defer rwc.mutex.Unlock()
+	stats := rwc.queueStatistics()
+	res.Packets, res.Bytes = stats.Packets, stats.Bytes
+	res.Queued, res.Flushed = stats.Queued, stats.Flushed
+	res.Dropped, res.Expired = stats.Dropped, stats.Expired
+	res.Queues = make([]LookupQueueEntry, 0, stats.Destinations)
+	for addr, buf := range rwc.addrBuffer {
+		res.Queues = append(res.Queues, LookupQueueEntry{
+			Destination: net.IP(addr[:]).String(),
+			Packets:     len(buf.packets),
+			Bytes:       buf.size,
+		})
+	}
+	for subnet, buf := range rwc.subnetBuffer {
+		prefix := append(subnet[:], 0, 0, 0, 0, 0, 0, 0, 0)
+		res.Queues = append(res.Queues, LookupQueueEntry{
+			Destination: net.IP(prefix).String() + "/64",
+			Packets:     len(buf.packets),
+			Bytes:       buf.size,
+		})
+	}
+	sort.Slice(res.Queues, func(i, j int) bool {
+		return res.Queues[i].Destination < res.Queues[j].Destination
+	})
+	return nil
+}
+
+func (rwc *ReadWriteCloser) SetupAdminHandlers(a *admin.AdminSocket) {
+	a.SetSessionMTU(rwc.SessionMTU)
+	_ = a.AddHandler(
+		"startCapture", "Start writing traffic to a pcapng file in the capture directory, optionally only for a remote key, address or subnet", []string{"path", "[key]", "[address]", "[subnet]", "[snaplen]"},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &StartCaptureRequest{}
+			res := &StartCaptureResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := rwc.startCaptureHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"stopCapture", "Stop writing traffic to a pcapng file", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &StopCaptureRequest{}
+			res := &StopCaptureResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := rwc.stopCaptureHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"getLookupQueues", "Show packets queued for destinations whose key is being looked up", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetLookupQueuesRequest{}
+			res := &GetLookupQueuesResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := rwc.getLookupQueuesHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"getFirewall", "Show the firewall rules for inbound traffic and how many packets they matched", []string{},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &GetFirewallRequest{}
+			res := &GetFirewallResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := rwc.getFirewallHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"setFirewall", "Turn the firewall for inbound traffic on or off", []string{"enabled"},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &SetFirewallRequest{}
+			res := &SetFirewallResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := rwc.setFirewallHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"addFirewallRule", "Add a firewall rule to allow or deny new inbound traffic, at the end unless an index is given", []string{"action", "[keys]", "[protocol]", "[ports]", "[index]"},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &AddFirewallRuleRequest{}
+			res := &AddFirewallRuleResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := rwc.addFirewallRuleHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+	_ = a.AddHandler(
+		"removeFirewallRule", "Remove the firewall rule at the given index", []string{"index"},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &RemoveFirewallRuleRequest{}
+			res := &RemoveFirewallRuleResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := rwc.removeFirewallRuleHandler(req, res); err != nil {
+				return nil, err
+			}
+			return res, nil
+		},
+	)
+}
@@ -0,0 +1,211 @@
+package ipv6rwc
+
+// This writes the IP traffic going to and from the network to a pcapng
+// file, so that it can be looked at with Wireshark or tcpdump even when
+// there is no TUN interface to capture on. Each packet is annotated with the
+// public key of the remote node in a comment.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	pcapngSectionHeader    = 0x0A0D0D0A
+	pcapngInterfaceDesc    = 0x00000001
+	pcapngEnhancedPacket   = 0x00000006
+	pcapngByteOrderMagic   = 0x1A2B3C4D
+	pcapngLinkTypeRaw      = 101 // IPv4 or IPv6, depending on the version
+	pcapngOptEnd           = 0
+	pcapngOptComment       = 1
+	pcapngOptIfName        = 2
+	pcapngOptEPBFlags      = 2
+	pcapngFlagInbound      = 1
+	pcapngFlagOutbound     = 2
+	captureDefaultSnapLen  = 65535
+	captureMinimumSnapLen  = 40
+	captureInterfaceName   = "yggdrasil"
+	captureMaxCommentBytes = 128
+)
+
+// CaptureFilter limits which packets are captured. A packet is captured if
+// the remote node has the given key, if one is given, and the remote address
+// is within the given prefix, if one is given, i.e. a single address or a
+// subnet such as a /64 or a routed prefix.
+type CaptureFilter struct {
+	Key     ed25519.PublicKey
+	Prefix  netip.Prefix
+	SnapLen int // Maximum number of bytes to capture from each packet
+}
+
+type capture struct {
+	mutex   sync.Mutex
+	w       io.WriteCloser
+	filter  CaptureFilter
+	packets uint64
+	err     error // The first write error, after which nothing else is written
+}
+
+// SetCaptureDirectory sets the directory that the startCapture admin command
+// can create capture files in. The admin command is refused until this is
+// set, as otherwise it could be used to write files anywhere.
+func (k *keyStore) SetCaptureDirectory(dir string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.captureDir = dir
+}
+
+// StartCapture starts writing the packets that match the filter to w in the
+// pcapng format. Only one capture can run at a time. The writer is closed
+// when the capture is stopped.
+func (k *keyStore) StartCapture(w io.WriteCloser, filter CaptureFilter) error {
+	if filter.Key != nil && len(filter.Key) != ed25519.PublicKeySize {
+		return errors.New("capture key is the wrong length")
+	}
+	switch {
+	case filter.SnapLen == 0:
+		filter.SnapLen = captureDefaultSnapLen
+	case filter.SnapLen < captureMinimumSnapLen:
+		return errors.New("capture snap length is too short")
+	}
+	c := &capture{
+		w:      w,
+		filter: filter,
+	}
+	if !k.capturing.CompareAndSwap(nil, c) {
+		return errors.New("a capture is already running")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, c.err = w.Write(c.header()); c.err != nil {
+		k.capturing.Store(nil)
+		_ = w.Close()
+		return c.err
+	}
+	return nil
+}
+
+// StopCapture stops the running capture and closes the writer, returning
+// the number of packets that were captured.
+func (k *keyStore) StopCapture() (uint64, error) {
+	c := k.capturing.Swap(nil)
+	if c == nil {
+		return 0, errors.New("no capture is running")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	err := c.w.Close()
+	if c.err != nil {
+		err = c.err
+	}
+	return c.packets, err
+}
+
+// capturePacket captures the packet if a capture is running and the packet
+// matches its filter. The packet must be at least as long as its IP header.
+func (k *keyStore) capturePacket(bs []byte, key keyArray, inbound bool) {
+	c := k.capturing.Load()
+	if c == nil {
+		return
+	}
+	var remote netip.Addr
+	switch {
+	case bs[0]&0xf0 == 0x40 && inbound:
+		remote = netip.AddrFrom4([4]byte(bs[12:16]))
+	case bs[0]&0xf0 == 0x40:
+		remote = netip.AddrFrom4([4]byte(bs[16:20]))
+	case inbound:
+		remote = netip.AddrFrom16([16]byte(bs[8:24]))
+	default:
+		remote = netip.AddrFrom16([16]byte(bs[24:40]))
+	}
+	if c.filter.Key != nil && !bytes.Equal(c.filter.Key, key[:]) {
+		return
+	}
+	if c.filter.Prefix.IsValid() && !c.filter.Prefix.Contains(remote) {
+		return
+	}
+	block := c.packet(bs, key, inbound, time.Now())
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return
+	}
+	if _, c.err = c.w.Write(block); c.err == nil {
+		c.packets++
+	}
+}
+
+// header returns the section header and interface description blocks that
+// start the file.
+func (c *capture) header() []byte {
+	shb := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // Major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0) // Minor version
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0))
+	shb = appendPcapngOption(shb, pcapngOptEnd, nil)
+
+	idb := binary.LittleEndian.AppendUint16(nil, pcapngLinkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, uint32(c.filter.SnapLen))
+	idb = appendPcapngOption(idb, pcapngOptIfName, []byte(captureInterfaceName))
+	idb = appendPcapngOption(idb, pcapngOptEnd, nil)
+
+	b := appendPcapngBlock(nil, pcapngSectionHeader, shb)
+	return appendPcapngBlock(b, pcapngInterfaceDesc, idb)
+}
+
+// packet returns an enhanced packet block for the packet. Timestamps are in
+// microseconds, which is the default resolution.
+func (c *capture) packet(bs []byte, key keyArray, inbound bool, now time.Time) []byte {
+	data := bs
+	if len(data) > c.filter.SnapLen {
+		data = data[:c.filter.SnapLen]
+	}
+	ts := uint64(now.UnixMicro())
+	epb := make([]byte, 0, 20+len(data)+captureMaxCommentBytes)
+	epb = binary.LittleEndian.AppendUint32(epb, 0) // Interface ID
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(bs)))
+	epb = append(epb, data...)
+	epb = appendPcapngPadding(epb)
+	flags := uint32(pcapngFlagOutbound)
+	if inbound {
+		flags = pcapngFlagInbound
+	}
+	epb = appendPcapngOption(epb, pcapngOptEPBFlags, binary.LittleEndian.AppendUint32(nil, flags))
+	epb = appendPcapngOption(epb, pcapngOptComment, []byte("remote key "+hex.EncodeToString(key[:])))
+	epb = appendPcapngOption(epb, pcapngOptEnd, nil)
+	return appendPcapngBlock(nil, pcapngEnhancedPacket, epb)
+}
+
+func appendPcapngBlock(b []byte, blockType uint32, body []byte) []byte {
+	length := uint32(12 + len(body))
+	b = binary.LittleEndian.AppendUint32(b, blockType)
+	b = binary.LittleEndian.AppendUint32(b, length)
+	b = append(b, body...)
+	return binary.LittleEndian.AppendUint32(b, length)
+}
+
+func appendPcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return appendPcapngPadding(b)
+}
+
+func appendPcapngPadding(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,141 @@
+package ipv6rwc
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type captureBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *captureBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func testPacket(src, dst netip.Addr, length int) []byte {
+	bs := make([]byte, length)
+	bs[0] = 0x60
+	copy(bs[8:24], src.AsSlice())
+	copy(bs[24:40], dst.AsSlice())
+	return bs
+}
+
+// pcapngBlocks splits the capture into blocks, checking that the lengths
+// at either end of each block agree.
+func pcapngBlocks(t *testing.T, b []byte) (types []uint32, bodies [][]byte) {
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block")
+		}
+		length := binary.LittleEndian.Uint32(b[4:8])
+		if length%4 != 0 || int(length) > len(b) {
+			t.Fatalf("bad block length %d", length)
+		}
+		if binary.LittleEndian.Uint32(b[length-4:length]) != length {
+			t.Fatalf("block lengths don't match")
+		}
+		types = append(types, binary.LittleEndian.Uint32(b[0:4]))
+		bodies = append(bodies, b[8:length-4])
+		b = b[length:]
+	}
+	return
+}
+
+func TestCapture(t *testing.T) {
+	var k keyStore
+	pub, _, _ := ed25519.GenerateKey(nil)
+	var key, other keyArray
+	copy(key[:], pub)
+	other[0] = 1
+
+	local := netip.MustParseAddr("200::1")
+	inSubnet := netip.MustParseAddr("300:1:2:3::1")
+	outside := netip.MustParseAddr("300:1:2:4::1")
+
+	w := &captureBuffer{}
+	filter := CaptureFilter{
+		Key:     pub,
+		Prefix:  netip.MustParsePrefix("300:1:2:3::/64"),
+		SnapLen: 64,
+	}
+	if err := k.StartCapture(w, filter); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.StartCapture(&captureBuffer{}, filter); err == nil {
+		t.Fatalf("only one capture should run at a time")
+	}
+	k.capturePacket(testPacket(inSubnet, local, 100), key, true)  // Captured
+	k.capturePacket(testPacket(local, inSubnet, 40), key, false)  // Captured
+	k.capturePacket(testPacket(local, outside, 40), key, false)   // Wrong subnet
+	k.capturePacket(testPacket(inSubnet, local, 40), other, true) // Wrong key
+
+	packets, err := k.StopCapture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packets != 2 || !w.closed {
+		t.Fatalf("expected 2 packets and a closed writer, got %d, %v", packets, w.closed)
+	}
+	if _, err := k.StopCapture(); err == nil {
+		t.Fatalf("stopping twice should fail")
+	}
+
+	types, bodies := pcapngBlocks(t, w.Bytes())
+	expected := []uint32{pcapngSectionHeader, pcapngInterfaceDesc, pcapngEnhancedPacket, pcapngEnhancedPacket}
+	if len(types) != len(expected) {
+		t.Fatalf("expected %d blocks, got %d", len(expected), len(types))
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Fatalf("block %d has type %#x, expected %#x", i, types[i], expected[i])
+		}
+	}
+	epb := bodies[2]
+	if captured, original := binary.LittleEndian.Uint32(epb[12:16]), binary.LittleEndian.Uint32(epb[16:20]); captured != 64 || original != 100 {
+		t.Fatalf("expected 64 of 100 bytes captured, got %d of %d", captured, original)
+	}
+	if !strings.Contains(string(epb), "remote key ") {
+		t.Fatalf("packet is missing the remote key comment")
+	}
+}
+
+func TestCaptureDirectory(t *testing.T) {
+	rwc := &ReadWriteCloser{}
+	req := &StartCaptureRequest{Path: "test.pcapng"}
+	if err := rwc.startCaptureHandler(req, &StartCaptureResponse{}); err == nil {
+		t.Fatalf("captures should be refused without a capture directory")
+	}
+
+	dir := t.TempDir()
+	rwc.SetCaptureDirectory(dir)
+	for _, path := range []string{"", ".", "..", "../test.pcapng", "/tmp/test.pcapng", "sub/test.pcapng"} {
+		req.Path = path
+		if err := rwc.startCaptureHandler(req, &StartCaptureResponse{}); err == nil {
+			t.Fatalf("capture to %q should be refused", path)
+		}
+	}
+
+	req.Path = "test.pcapng"
+	res := &StartCaptureResponse{}
+	if err := rwc.startCaptureHandler(req, res); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rwc.StopCapture(); err != nil {
+		t.Fatal(err)
+	}
+	if res.Path != filepath.Join(dir, "test.pcapng") {
+		t.Fatalf("capture written to %q, expected it in %q", res.Path, dir)
+	}
+	if _, err := os.Stat(res.Path); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,457 @@
+package ipv6rwc
+
+// This is a stateful firewall for traffic coming in from the network, for
+// hosts which can't filter it themselves, i.e. because there is no TUN
+// adapter. New inbound connections are matched against the rules in order,
+// with the first match deciding, and are dropped if nothing matches. Replies
+// to outbound traffic are always allowed, as are ICMP errors, which path MTU
+// discovery relies on. Fragments other than the first have no ports to
+// match against, so they are let in if the first fragment of the same packet
+// was, which means that they are dropped if they arrive before it.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	protocolICMPv4 = 1
+	protocolTCP    = 6
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+)
+
+const (
+	firewallSweepInterval = time.Minute
+	firewallTCPTimeout    = time.Hour // There's no TCP state machine, so this is generous
+	firewallUDPTimeout    = 3 * time.Minute
+	firewallICMPTimeout   = 30 * time.Second
+	firewallFragTimeout   = time.Minute // As long as reassembly waits, from RFC 8200
+)
+
+// FirewallRule allows or denies new inbound traffic. Empty fields match
+// anything.
+type FirewallRule struct {
+	Allow    bool
+	Keys     []ed25519.PublicKey // Remote public keys
+	Protocol string              // "tcp", "udp" or "icmp"
+	MinPort  uint16              // Destination port range, for TCP and UDP
+	MaxPort  uint16
+}
+
+// ParseFirewallRule parses a rule from its text form, as used in the config
+// and on the admin socket. The action is "allow" or "deny", keys are in hex
+// and ports are either a single port or a range, i.e. "8000-8080".
+func ParseFirewallRule(action string, keys []string, protocol string, ports string) (FirewallRule, error) {
+	var rule FirewallRule
+	switch action {
+	case "allow":
+		rule.Allow = true
+	case "deny":
+	default:
+		return rule, fmt.Errorf("unknown firewall action %q", action)
+	}
+	for _, k := range keys {
+		key, err := hex.DecodeString(k)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return rule, fmt.Errorf("invalid firewall key %q", k)
+		}
+		rule.Keys = append(rule.Keys, key)
+	}
+	switch protocol {
+	case "", "tcp", "udp", "icmp":
+		rule.Protocol = protocol
+	default:
+		return rule, fmt.Errorf("unknown firewall protocol %q", protocol)
+	}
+	if ports != "" {
+		if rule.Protocol != "tcp" && rule.Protocol != "udp" {
+			return rule, errors.New("firewall ports need a protocol of tcp or udp")
+		}
+		lo, hi, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			hi = lo
+		}
+		min, err1 := strconv.ParseUint(lo, 10, 16)
+		max, err2 := strconv.ParseUint(hi, 10, 16)
+		if err1 != nil || err2 != nil || min == 0 || min > max {
+			return rule, fmt.Errorf("invalid firewall ports %q", ports)
+		}
+		rule.MinPort, rule.MaxPort = uint16(min), uint16(max)
+	}
+	return rule, nil
+}
+
+// String describes the rule for people to read, i.e. in the reply to the
+// addFirewallRule admin command.
+func (r *FirewallRule) String() string {
+	parts := []string{"deny"}
+	if r.Allow {
+		parts[0] = "allow"
+	}
+	if r.Protocol != "" {
+		parts = append(parts, r.Protocol)
+	}
+	if ports := r.ports(); ports != "" {
+		parts = append(parts, "port "+ports)
+	}
+	for _, key := range r.Keys {
+		parts = append(parts, "from "+hex.EncodeToString(key))
+	}
+	return strings.Join(parts, " ")
+}
+
+// ports returns the port range in the same form as ParseFirewallRule takes,
+// or an empty string if the rule isn't limited to any ports.
+func (r *FirewallRule) ports() string {
+	switch {
+	case r.MinPort == 0:
+		return ""
+	case r.MinPort == r.MaxPort:
+		return strconv.Itoa(int(r.MinPort))
+	default:
+		return strconv.Itoa(int(r.MinPort)) + "-" + strconv.Itoa(int(r.MaxPort))
+	}
+}
+
+func (r *FirewallRule) matches(key keyArray, p *packetInfo) bool {
+	if len(r.Keys) > 0 {
+		found := false
+		for _, k := range r.Keys {
+			if bytes.Equal(k, key[:]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	switch r.Protocol {
+	case "":
+		return true
+	case "icmp":
+		return p.protocol == protocolICMPv6 || p.protocol == protocolICMPv4
+	case "tcp":
+		if p.protocol != protocolTCP {
+			return false
+		}
+	case "udp":
+		if p.protocol != protocolUDP {
+			return false
+		}
+	}
+	return r.MinPort == 0 || (p.hasPorts && p.dstPort >= r.MinPort && p.dstPort <= r.MaxPort)
+}
+
+type firewallRule struct {
+	FirewallRule
+	hits uint64 // Packets which matched the rule
+}
+
+// flow identifies traffic that we sent, so that replies can be let in. For
+// ICMP echoes, both ports are the echo identifier.
+type flow struct {
+	key       keyArray
+	protocol  uint8
+	localPort uint16
+	port      uint16
+}
+
+// fragment identifies the fragments of an inbound packet whose first
+// fragment was let in.
+type fragment struct {
+	key      keyArray
+	protocol uint8
+	id       uint32
+}
+
+type firewall struct {
+	mutex     sync.Mutex
+	enabled   bool
+	rules     []*firewallRule
+	flows     map[flow]time.Time     // Expiry
+	fragments map[fragment]time.Time // Expiry
+	dropped   uint64                 // Inbound packets dropped, by rules or by default
+	swept     time.Time
+}
+
+// packetInfo is what the firewall needs to know about a packet.
+type packetInfo struct {
+	protocol uint8
+	hasPorts bool // The ports, or the ICMP echo identifier, are known
+	srcPort  uint16
+	dstPort  uint16
+	icmpType uint8
+	isICMP   bool
+	fragment int // Whether this is the first or a later fragment, if either
+	fragID   uint32
+}
+
+const (
+	notFragment = iota
+	firstFragment
+	laterFragment
+)
+
+// icmpIsError returns true if the packet is an ICMP error, rather than an
+// echo request or reply.
+func (p *packetInfo) icmpIsError() bool {
+	switch p.protocol {
+	case protocolICMPv6:
+		return p.icmpType < 128
+	case protocolICMPv4:
+		return p.icmpType == 3 || p.icmpType == 11 || p.icmpType == 12
+	}
+	return false
+}
+
+func (p *packetInfo) icmpIsEcho(reply bool) bool {
+	switch {
+	case p.protocol == protocolICMPv6 && reply:
+		return p.icmpType == 129
+	case p.protocol == protocolICMPv6:
+		return p.icmpType == 128
+	case p.protocol == protocolICMPv4 && reply:
+		return p.icmpType == 0
+	case p.protocol == protocolICMPv4:
+		return p.icmpType == 8
+	}
+	return false
+}
+
+// parsePacket finds the transport protocol of the IPv4 or IPv6 packet, which
+// has already been checked to be long enough for its IP header, skipping
+// over any IPv6 extension headers. The ports aren't known for fragments
+// other than the first.
+func parsePacket(bs []byte) (p packetInfo) {
+	var payload []byte
+	if bs[0]&0xf0 == 0x40 {
+		ihl := int(bs[0]&0x0f) * 4
+		p.protocol = bs[9]
+		flags := binary.BigEndian.Uint16(bs[6:8])
+		switch {
+		case flags&0x1fff != 0:
+			p.fragment, p.fragID = laterFragment, uint32(binary.BigEndian.Uint16(bs[4:6]))
+			return
+		case flags&0x2000 != 0: // More fragments
+			p.fragment, p.fragID = firstFragment, uint32(binary.BigEndian.Uint16(bs[4:6]))
+		}
+		if ihl < 20 || len(bs) < ihl {
+			return
+		}
+		payload = bs[ihl:]
+	} else {
+		next, offset := bs[6], 40
+	headers:
+		for {
+			switch next {
+			case 0, 43, 60: // Hop-by-hop, routing and destination options
+				if len(bs) < offset+2 {
+					return
+				}
+				next, offset = bs[offset], offset+(int(bs[offset+1])+1)*8
+			case 44: // Fragment
+				if len(bs) < offset+8 {
+					return
+				}
+				p.fragID = binary.BigEndian.Uint32(bs[offset+4 : offset+8])
+				switch flags := binary.BigEndian.Uint16(bs[offset+2 : offset+4]); {
+				case flags>>3 != 0:
+					p.fragment = laterFragment
+					p.protocol = bs[offset]
+					return
+				case flags&1 != 0: // More fragments
+					p.fragment = firstFragment
+				}
+				next, offset = bs[offset], offset+8
+			case 51: // Authentication
+				if len(bs) < offset+2 {
+					return
+				}
+				next, offset = bs[offset], offset+(int(bs[offset+1])+2)*4
+			default:
+				break headers
+			}
+		}
+		p.protocol = next
+		if len(bs) < offset {
+			return
+		}
+		payload = bs[offset:]
+	}
+	switch p.protocol {
+	case protocolTCP, protocolUDP:
+		if len(payload) >= 4 {
+			p.hasPorts = true
+			p.srcPort = binary.BigEndian.Uint16(payload[0:2])
+			p.dstPort = binary.BigEndian.Uint16(payload[2:4])
+		}
+	case protocolICMPv4, protocolICMPv6:
+		if len(payload) >= 1 {
+			p.isICMP = true
+			p.icmpType = payload[0]
+		}
+		if len(payload) >= 6 && (p.icmpIsEcho(false) || p.icmpIsEcho(true)) {
+			p.hasPorts = true
+			p.srcPort = binary.BigEndian.Uint16(payload[4:6])
+			p.dstPort = p.srcPort
+		}
+	}
+	return
+}
+
+func flowTimeout(protocol uint8) time.Duration {
+	switch protocol {
+	case protocolTCP:
+		return firewallTCPTimeout
+	case protocolUDP:
+		return firewallUDPTimeout
+	default:
+		return firewallICMPTimeout
+	}
+}
+
+// trackOutbound remembers the packet that we are sending, so that replies to
+// it are allowed back in.
+func (f *firewall) trackOutbound(bs []byte, key keyArray) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.enabled {
+		return
+	}
+	p := parsePacket(bs)
+	if !p.hasPorts || (p.isICMP && !p.icmpIsEcho(false)) {
+		return
+	}
+	now := time.Now()
+	fl := flow{key: key, protocol: p.protocol, localPort: p.srcPort, port: p.dstPort}
+	f.flows[fl] = now.Add(flowTimeout(p.protocol))
+	f._sweep(now)
+}
+
+// _sweep removes expired flows and fragments every so often. The mutex must
+// be held.
+func (f *firewall) _sweep(now time.Time) {
+	if now.Sub(f.swept) <= firewallSweepInterval {
+		return
+	}
+	for fl, expiry := range f.flows {
+		if now.After(expiry) {
+			delete(f.flows, fl)
+		}
+	}
+	for fr, expiry := range f.fragments {
+		if now.After(expiry) {
+			delete(f.fragments, fr)
+		}
+	}
+	f.swept = now
+}
+
+// allowInbound returns true if the packet that we received should be let in.
+func (f *firewall) allowInbound(bs []byte, key keyArray) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.enabled {
+		return true
+	}
+	p := parsePacket(bs)
+	now := time.Now()
+	fr := fragment{key: key, protocol: p.protocol, id: p.fragID}
+	switch p.fragment {
+	case laterFragment:
+		if expiry, ok := f.fragments[fr]; ok && now.Before(expiry) {
+			return true
+		}
+		f.dropped++
+		return false
+	case firstFragment:
+		allowed := f._allowInbound(key, &p, now)
+		if allowed {
+			f.fragments[fr] = now.Add(firewallFragTimeout)
+			f._sweep(now)
+		}
+		return allowed
+	default:
+		return f._allowInbound(key, &p, now)
+	}
+}
+
+// _allowInbound decides whether a packet, or the first fragment of one, is
+// let in. The mutex must be held.
+func (f *firewall) _allowInbound(key keyArray, p *packetInfo, now time.Time) bool {
+	if p.icmpIsError() {
+		return true
+	}
+	if p.hasPorts && (!p.isICMP || p.icmpIsEcho(true)) {
+		fl := flow{key: key, protocol: p.protocol, localPort: p.dstPort, port: p.srcPort}
+		if expiry, ok := f.flows[fl]; ok && now.Before(expiry) {
+			f.flows[fl] = now.Add(flowTimeout(p.protocol))
+			return true
+		}
+	}
+	for _, rule := range f.rules {
+		if rule.matches(key, p) {
+			rule.hits++
+			if !rule.Allow {
+				f.dropped++
+			}
+			return rule.Allow
+		}
+	}
+	f.dropped++
+	return false
+}
+
+// SetFirewall turns filtering of inbound traffic on or off. When it is first
+// turned on, replies to traffic that was sent before aren't allowed in unless
+// the rules allow them.
+func (k *keyStore) SetFirewall(enabled bool) {
+	f := &k.firewall
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if enabled && f.flows == nil {
+		f.flows = make(map[flow]time.Time)
+		f.fragments = make(map[fragment]time.Time)
+	}
+	f.enabled = enabled
+}
+
+// AddFirewallRule adds the rule at the given position in the rules, or at
+// the end if the index is negative.
+func (k *keyStore) AddFirewallRule(rule FirewallRule, index int) error {
+	f := &k.firewall
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if index > len(f.rules) {
+		return fmt.Errorf("firewall rule index %d is out of range", index)
+	}
+	if index < 0 {
+		index = len(f.rules)
+	}
+	f.rules = append(f.rules, nil)
+	copy(f.rules[index+1:], f.rules[index:])
+	f.rules[index] = &firewallRule{FirewallRule: rule}
+	return nil
+}
+
+// RemoveFirewallRule removes the rule at the given position in the rules.
+func (k *keyStore) RemoveFirewallRule(index int) error {
+	f := &k.firewall
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if index < 0 || index >= len(f.rules) {
+		return fmt.Errorf("firewall rule index %d is out of range", index)
+	}
+	f.rules = append(f.rules[:index], f.rules[index+1:]...)
+	return nil
+}
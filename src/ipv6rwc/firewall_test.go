@@ -0,0 +1,170 @@
+package ipv6rwc
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// firewallPacket makes an IPv6 packet with a TCP, UDP or ICMPv6 header. For
+// ICMPv6, the ports are the type and the echo identifier.
+func firewallPacket(protocol uint8, src, dst uint16) []byte {
+	bs := make([]byte, 48)
+	bs[0] = 0x60
+	bs[6] = protocol
+	if protocol == protocolICMPv6 {
+		bs[40] = uint8(src)
+		binary.BigEndian.PutUint16(bs[44:46], dst)
+	} else {
+		binary.BigEndian.PutUint16(bs[40:42], src)
+		binary.BigEndian.PutUint16(bs[42:44], dst)
+	}
+	return bs
+}
+
+func TestFirewall(t *testing.T) {
+	var k keyStore
+	var friend, stranger keyArray
+	friend[0], stranger[0] = 1, 2
+
+	// Everything is allowed until the firewall is turned on.
+	if !k.firewall.allowInbound(firewallPacket(protocolTCP, 1234, 22), stranger) {
+		t.Fatalf("traffic should be allowed with the firewall off")
+	}
+	k.SetFirewall(true)
+	for _, r := range []struct {
+		action, protocol, ports string
+		keys                    []string
+	}{
+		{"deny", "tcp", "22", []string{hex.EncodeToString(stranger[:])}},
+		{"allow", "tcp", "20-22", nil},
+		{"allow", "icmp", "", []string{hex.EncodeToString(friend[:])}},
+	} {
+		rule, err := ParseFirewallRule(r.action, r.keys, r.protocol, r.ports)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = k.AddFirewallRule(rule, -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, bad := range [][]string{
+		{"reject", "tcp", "22"},
+		{"allow", "sctp", ""},
+		{"allow", "", "22"},
+		{"allow", "udp", "22-21"},
+		{"allow", "udp", "0"},
+	} {
+		if _, err := ParseFirewallRule(bad[0], nil, bad[1], bad[2]); err == nil {
+			t.Fatalf("expected an error for rule %v", bad)
+		}
+	}
+	if _, err := ParseFirewallRule("allow", []string{"abcd"}, "", ""); err == nil {
+		t.Fatalf("expected an error for a short key")
+	}
+
+	for _, test := range []struct {
+		name    string
+		packet  []byte
+		key     keyArray
+		allowed bool
+	}{
+		{"allowed port", firewallPacket(protocolTCP, 1234, 22), friend, true},
+		{"denied key", firewallPacket(protocolTCP, 1234, 22), stranger, false},
+		{"port in range", firewallPacket(protocolTCP, 1234, 20), stranger, true},
+		{"unmatched port", firewallPacket(protocolTCP, 1234, 80), friend, false},
+		{"unmatched protocol", firewallPacket(protocolUDP, 1234, 22), friend, false},
+		{"echo request from key", firewallPacket(protocolICMPv6, 128, 7), friend, true},
+		{"echo request", firewallPacket(protocolICMPv6, 128, 7), stranger, false},
+		{"packet too big", firewallPacket(protocolICMPv6, 2, 0), stranger, true},
+		{"reply before request", firewallPacket(protocolUDP, 53, 5353), stranger, false},
+	} {
+		if k.firewall.allowInbound(test.packet, test.key) != test.allowed {
+			t.Fatalf("%s: expected allowed to be %v", test.name, test.allowed)
+		}
+	}
+
+	// Replies to our own traffic are allowed back in, but only from the node
+	// and port that it was sent to.
+	k.firewall.trackOutbound(firewallPacket(protocolUDP, 5353, 53), stranger)
+	k.firewall.trackOutbound(firewallPacket(protocolICMPv6, 128, 9), stranger)
+	if !k.firewall.allowInbound(firewallPacket(protocolUDP, 53, 5353), stranger) {
+		t.Fatalf("reply should be allowed")
+	}
+	if k.firewall.allowInbound(firewallPacket(protocolUDP, 53, 5353), friend) {
+		t.Fatalf("reply from another node should be dropped")
+	}
+	if k.firewall.allowInbound(firewallPacket(protocolUDP, 54, 5353), stranger) {
+		t.Fatalf("reply from another port should be dropped")
+	}
+	if !k.firewall.allowInbound(firewallPacket(protocolICMPv6, 129, 9), stranger) {
+		t.Fatalf("echo reply should be allowed")
+	}
+
+	if k.firewall.rules[0].hits != 1 || k.firewall.rules[1].hits != 2 || k.firewall.dropped != 7 {
+		t.Fatalf("unexpected counters: %d, %d, %d", k.firewall.rules[0].hits, k.firewall.rules[1].hits, k.firewall.dropped)
+	}
+	if err := k.RemoveFirewallRule(0); err != nil {
+		t.Fatal(err)
+	}
+	if !k.firewall.allowInbound(firewallPacket(protocolTCP, 1234, 22), stranger) {
+		t.Fatalf("traffic should be allowed after removing the deny rule")
+	}
+	if err := k.RemoveFirewallRule(5); err == nil {
+		t.Fatalf("expected an error removing a rule which doesn't exist")
+	}
+	if err := k.AddFirewallRule(FirewallRule{Keys: []ed25519.PublicKey{friend[:]}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if k.firewall.allowInbound(firewallPacket(protocolTCP, 1234, 22), friend) {
+		t.Fatalf("traffic should be denied by the new first rule")
+	}
+}
+
+// fragmentPacket makes an IPv6 fragment of a TCP packet. The first fragment
+// has the TCP header, later ones don't.
+func fragmentPacket(id uint32, first bool, dst uint16) []byte {
+	bs := make([]byte, 56)
+	bs[0] = 0x60
+	bs[6] = 44
+	bs[40] = protocolTCP
+	binary.BigEndian.PutUint32(bs[44:48], id)
+	if first {
+		bs[43] = 1 // More fragments
+		binary.BigEndian.PutUint16(bs[48:50], 1234)
+		binary.BigEndian.PutUint16(bs[50:52], dst)
+	} else {
+		binary.BigEndian.PutUint16(bs[42:44], 185<<3)
+	}
+	return bs
+}
+
+func TestFirewallFragments(t *testing.T) {
+	var k keyStore
+	var key keyArray
+	k.SetFirewall(true)
+	rule, err := ParseFirewallRule("allow", nil, "tcp", "22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = k.AddFirewallRule(rule, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		packet  []byte
+		allowed bool
+	}{
+		{"later fragment before the first", fragmentPacket(1, false, 0), false},
+		{"allowed first fragment", fragmentPacket(1, true, 22), true},
+		{"later fragment of allowed packet", fragmentPacket(1, false, 0), true},
+		{"denied first fragment", fragmentPacket(2, true, 80), false},
+		{"later fragment of denied packet", fragmentPacket(2, false, 0), false},
+	} {
+		if k.firewall.allowInbound(test.packet, key) != test.allowed {
+			t.Fatalf("%s: expected allowed to be %v", test.name, test.allowed)
+		}
+	}
+}
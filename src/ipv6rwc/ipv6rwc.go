@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/icmp"
@@ -19,6 +21,14 @@ import (
 
 const keyStoreTimeout = 2 * time.Minute
 
+// Limits on the packets queued for destinations whose key is being looked up.
+// Packets beyond these are dropped.
+const (
+	bufferMaxPackets = 64              // Per destination
+	bufferMaxBytes   = 256 * 1024      // Per destination
+	bufferMaxTotal   = 4 * 1024 * 1024 // For all destinations
+)
+
 /*
 // Out-of-band packet types
 const (
@@ -31,27 +41,58 @@ const (
 type keyArray [ed25519.PublicKeySize]byte
 
 type keyStore struct {
-	core         *core.Core
-	address      address.Address
-	subnet       address.Subnet
-	mutex        sync.Mutex
-	keyToInfo    map[keyArray]*keyInfo
-	addrToInfo   map[address.Address]*keyInfo
-	addrBuffer   map[address.Address]*buffer
-	subnetToInfo map[address.Subnet]*keyInfo
-	subnetBuffer map[address.Subnet]*buffer
-	mtu          uint64
+	core          *core.Core
+	address       address.Address
+	subnet        address.Subnet
+	mutex         sync.Mutex
+	keyToInfo     map[keyArray]*keyInfo
+	addrToInfo    map[address.Address]*keyInfo
+	addrBuffer    map[address.Address]*buffer
+	subnetToInfo  map[address.Subnet]*keyInfo
+	subnetBuffer  map[address.Subnet]*buffer
+	mtu           uint64
+	routes        []tunnelRoute           // Most specific first
+	capturing     atomic.Pointer[capture] // Running packet capture, if any
+	captureDir    string                  // Where the admin socket can start captures
+	firewall      firewall
+	buffered      int         // Bytes queued in addrBuffer and subnetBuffer
+	bufferStats   bufferStats // Packets that went through the queues
+	lookupTimeout time.Duration
+	icmpLimiter   icmpLimiter
+	local         chan []byte         // Packets to return from readPC, i.e. ICMPv6 errors
+	received      chan receivedPacket // From readLoop, closed when it stops
+	readErr       error               // Why readLoop stopped
+	readOnce      sync.Once
+	readPool      sync.Pool // Of *[]byte
+}
+
+type receivedPacket struct {
+	buf *[]byte // From readPool
+	n   int
+	key keyArray
+}
+
+type bufferStats struct {
+	queued  uint64
+	flushed uint64 // Sent once the key was found
+	dropped uint64 // Because a queue was full
+	expired uint64 // Because the key wasn't found in time
 }
 
 type keyInfo struct {
-	key     keyArray
-	address address.Address
-	subnet  address.Subnet
-	timeout *time.Timer // From calling a time.AfterFunc to do cleanup
+	key        keyArray
+	address    address.Address
+	subnet     address.Subnet
+	timeout    *time.Timer // From calling a time.AfterFunc to do cleanup
+	remoteMTU  uint64      // Advertised by the remote node, if it has
+	pmtu       uint64      // From Packet Too Big, if any
+	pmtuExpiry time.Time
+	advertised bool // Whether we have advertised our MTU to the remote node
 }
 
 type buffer struct {
-	packet  []byte
+	packets [][]byte
+	size    int // Bytes in packets
 	timeout *time.Timer
 }
 
@@ -66,38 +107,51 @@ func (k *keyStore) init(c *core.Core) {
 	k.core.SetPathNotify(func(key ed25519.PublicKey) {
 		k.update(key)
 	})
+	k.core.SetMTUNotify(func(key ed25519.PublicKey, mtu uint64) {
+		k.setRemoteMTU(key, mtu)
+	})
 	k.keyToInfo = make(map[keyArray]*keyInfo)
 	k.addrToInfo = make(map[address.Address]*keyInfo)
 	k.addrBuffer = make(map[address.Address]*buffer)
 	k.subnetToInfo = make(map[address.Subnet]*keyInfo)
 	k.subnetBuffer = make(map[address.Subnet]*buffer)
 	k.mtu = 1280 // Default to something safe, expect user to set this
+	k.lookupTimeout = defaultLookupTimeout
+	k.local = make(chan []byte, 32)
+	k.received = make(chan receivedPacket)
+	k.readPool.New = func() interface{} {
+		buf := make([]byte, k.core.MTU())
+		return &buf
+	}
 }
 
 func (k *keyStore) sendToAddress(addr address.Address, bs []byte) {
 	k.mutex.Lock()
 	if info := k.addrToInfo[addr]; info != nil {
 		k.resetTimeout(info)
+		if !k.fits(bs, info) {
+			k.mutex.Unlock()
+			return
+		}
 		k.mutex.Unlock()
-		_, _ = k.core.WriteTo(bs, iwt.Addr(info.key[:]))
+		k.writeTo(bs, info.key)
 	} else {
 		var buf *buffer
 		if buf = k.addrBuffer[addr]; buf == nil {
 			buf = new(buffer)
 			k.addrBuffer[addr] = buf
 		}
-		msg := append([]byte(nil), bs...)
-		buf.packet = msg
-		if buf.timeout != nil {
-			buf.timeout.Stop()
+		k.bufferPacket(buf, bs)
+		if buf.timeout == nil {
+			buf.timeout = time.AfterFunc(k.lookupTimeout, func() {
+				k.mutex.Lock()
+				defer k.mutex.Unlock()
+				if nbuf := k.addrBuffer[addr]; nbuf == buf {
+					delete(k.addrBuffer, addr)
+					k.expireBuffer(buf)
+				}
+			})
 		}
-		buf.timeout = time.AfterFunc(keyStoreTimeout, func() {
-			k.mutex.Lock()
-			defer k.mutex.Unlock()
-			if nbuf := k.addrBuffer[addr]; nbuf == buf {
-				delete(k.addrBuffer, addr)
-			}
-		})
 		k.mutex.Unlock()
 		k.sendKeyLookup(addr.GetKey())
 	}
@@ -107,26 +161,29 @@ func (k *keyStore) sendToSubnet(subnet address.Subnet, bs []byte) {
 	k.mutex.Lock()
 	if info := k.subnetToInfo[subnet]; info != nil {
 		k.resetTimeout(info)
+		if !k.fits(bs, info) {
+			k.mutex.Unlock()
+			return
+		}
 		k.mutex.Unlock()
-		_, _ = k.core.WriteTo(bs, iwt.Addr(info.key[:]))
+		k.writeTo(bs, info.key)
 	} else {
 		var buf *buffer
 		if buf = k.subnetBuffer[subnet]; buf == nil {
 			buf = new(buffer)
 			k.subnetBuffer[subnet] = buf
 		}
-		msg := append([]byte(nil), bs...)
-		buf.packet = msg
-		if buf.timeout != nil {
-			buf.timeout.Stop()
+		k.bufferPacket(buf, bs)
+		if buf.timeout == nil {
+			buf.timeout = time.AfterFunc(k.lookupTimeout, func() {
+				k.mutex.Lock()
+				defer k.mutex.Unlock()
+				if nbuf := k.subnetBuffer[subnet]; nbuf == buf {
+					delete(k.subnetBuffer, subnet)
+					k.expireBuffer(buf)
+				}
+			})
 		}
-		buf.timeout = time.AfterFunc(keyStoreTimeout, func() {
-			k.mutex.Lock()
-			defer k.mutex.Unlock()
-			if nbuf := k.subnetBuffer[subnet]; nbuf == buf {
-				delete(k.subnetBuffer, subnet)
-			}
-		})
 		k.mutex.Unlock()
 		k.sendKeyLookup(subnet.GetKey())
 	}
@@ -147,22 +204,120 @@ func (k *keyStore) update(key ed25519.PublicKey) *keyInfo {
 		k.addrToInfo[info.address] = info
 		k.subnetToInfo[info.subnet] = info
 		if buf := k.addrBuffer[info.address]; buf != nil {
-			packets = append(packets, buf.packet)
+			packets = append(packets, k.flushBuffer(buf)...)
 			delete(k.addrBuffer, info.address)
 		}
 		if buf := k.subnetBuffer[info.subnet]; buf != nil {
-			packets = append(packets, buf.packet)
+			packets = append(packets, k.flushBuffer(buf)...)
 			delete(k.subnetBuffer, info.subnet)
 		}
 	}
 	k.resetTimeout(info)
 	k.mutex.Unlock()
 	for _, packet := range packets {
-		_, _ = k.core.WriteTo(packet, iwt.Addr(info.key[:]))
+		k.writeTo(packet, info.key)
 	}
 	return info
 }
 
+// fits returns true if the packet fits in the MTU to the remote node, or
+// else returns Packet Too Big to the sender. The mutex must be held.
+func (k *keyStore) fits(bs []byte, info *keyInfo) bool {
+	mtu := k.mtuFor(info)
+	if uint64(len(bs)) <= mtu {
+		return true
+	}
+	if icmp := k.packetTooBig(bs, mtu); icmp != nil {
+		k.deliverLocally(icmp)
+	}
+	return false
+}
+
+// writeTo sends a packet to the remote node, capturing it first if needed.
+func (k *keyStore) writeTo(bs []byte, key keyArray) {
+	k.firewall.trackOutbound(bs, key)
+	k.capturePacket(bs, key, false)
+	_, _ = k.core.WriteTo(bs, iwt.Addr(key[:]))
+}
+
+// bufferPacket queues a copy of the packet until the key for its destination
+// is found, unless the queues are full. The mutex must be held.
+func (k *keyStore) bufferPacket(buf *buffer, bs []byte) {
+	if len(buf.packets) >= bufferMaxPackets || buf.size+len(bs) > bufferMaxBytes || k.buffered+len(bs) > bufferMaxTotal {
+		k.bufferStats.dropped++
+		return
+	}
+	buf.packets = append(buf.packets, append([]byte(nil), bs...))
+	buf.size += len(bs)
+	k.buffered += len(bs)
+	k.bufferStats.queued++
+}
+
+// flushBuffer returns the queued packets, in the order they were queued, so
+// that they can be sent. The mutex must be held and the buffer must be
+// removed from its map by the caller.
+func (k *keyStore) flushBuffer(buf *buffer) [][]byte {
+	if buf.timeout != nil {
+		buf.timeout.Stop()
+	}
+	k.buffered -= buf.size
+	k.bufferStats.flushed += uint64(len(buf.packets))
+	return buf.packets
+}
+
+// QueueStatistics describes the packets queued for destinations whose key is
+// being looked up.
+type QueueStatistics struct {
+	Destinations int // Waiting for a lookup now
+	Packets      int // Queued now
+	Bytes        int // Queued now
+	Queued       uint64
+	Flushed      uint64 // Sent once the key was found
+	Dropped      uint64 // Because a queue was full
+	Expired      uint64 // Because the key wasn't found in time
+}
+
+// QueueStatistics returns the current state of the queues for destinations
+// whose key is being looked up, and how many packets have gone through them.
+func (k *keyStore) QueueStatistics() QueueStatistics {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.queueStatistics()
+}
+
+// queueStatistics is QueueStatistics with the mutex held.
+func (k *keyStore) queueStatistics() QueueStatistics {
+	stats := QueueStatistics{
+		Destinations: len(k.addrBuffer) + len(k.subnetBuffer),
+		Bytes:        k.buffered,
+		Queued:       k.bufferStats.queued,
+		Flushed:      k.bufferStats.flushed,
+		Dropped:      k.bufferStats.dropped,
+		Expired:      k.bufferStats.expired,
+	}
+	for _, buf := range k.addrBuffer {
+		stats.Packets += len(buf.packets)
+	}
+	for _, buf := range k.subnetBuffer {
+		stats.Packets += len(buf.packets)
+	}
+	return stats
+}
+
+// expireBuffer drops the queued packets because the key for their
+// destination wasn't found in time, returning Destination Unreachable for
+// them. The mutex must be held and the buffer must be removed from its map by
+// the caller.
+func (k *keyStore) expireBuffer(buf *buffer) {
+	k.buffered -= buf.size
+	k.bufferStats.expired += uint64(len(buf.packets))
+	for _, packet := range buf.packets {
+		if icmp := k.unreachable(packet, unreachableAddress); icmp != nil {
+			k.deliverLocally(icmp)
+		}
+	}
+}
+
 func (k *keyStore) resetTimeout(info *keyInfo) {
 	if info.timeout != nil {
 		info.timeout.Stop()
@@ -226,64 +381,145 @@ func (k *keyStore) sendKeyResponse(dest ed25519.PublicKey) { // nolint:unused
 */
 
 func (k *keyStore) readPC(p []byte) (int, error) {
-	buf := make([]byte, k.core.MTU(), 65535)
+	k.readOnce.Do(func() {
+		go k.readLoop()
+	})
 	for {
-		bs := buf
-		n, from, err := k.core.ReadFrom(bs)
+		select {
+		case packet := <-k.local:
+			return copy(p, packet), nil
+		case r, ok := <-k.received:
+			if !ok {
+				return 0, k.readErr
+			}
+			bs := (*r.buf)[:r.n]
+			if ok = k.accept(bs, r.key); ok {
+				k.capturePacket(bs, r.key, true)
+				r.n = copy(p, bs)
+			}
+			k.readPool.Put(r.buf)
+			if ok {
+				return r.n, nil
+			}
+		}
+	}
+}
+
+// readLoop reads packets from the network for readPC, which waits for
+// either these or packets that we generate locally.
+func (k *keyStore) readLoop() {
+	defer close(k.received)
+	for {
+		buf := k.readPool.Get().(*[]byte)
+		n, from, err := k.core.ReadFrom(*buf)
 		if err != nil {
-			return n, err
+			k.readErr = err
+			return
 		}
 		if n == 0 {
+			k.readPool.Put(buf)
 			continue
 		}
-		bs = bs[:n]
-		if len(bs) == 0 {
-			continue
+		r := receivedPacket{buf: buf, n: n}
+		copy(r.key[:], from.(iwt.Addr))
+		k.received <- r
+	}
+}
+
+// accept returns true if the packet from the node with the given key should
+// be delivered, after checking the addresses and the firewall.
+func (k *keyStore) accept(bs []byte, key keyArray) bool {
+	switch bs[0] & 0xf0 {
+	case 0x60:
+		if !k.acceptIPv6(bs, key) {
+			return false
 		}
-		if bs[0]&0xf0 != 0x60 {
-			continue // not IPv6
-		}
-		if len(bs) < 40 {
-			continue
+		k.learnPacketTooBig(bs, key)
+	case 0x40:
+		if !k.acceptIPv4(bs, key) {
+			return false
 		}
+	default:
+		return false // not IPv4 or IPv6
+	}
+	if !k.firewall.allowInbound(bs, key) {
 		k.mutex.Lock()
-		mtu := int(k.mtu)
+		icmp := k.unreachable(bs, unreachableProhibited)
 		k.mutex.Unlock()
-		if len(bs) > mtu {
-			// Using bs would make it leak off the stack, so copy to buf
-			buf := make([]byte, 512)
-			cn := copy(buf, bs)
-			ptb := &icmp.PacketTooBig{
-				MTU:  mtu,
-				Data: buf[:cn],
-			}
-			if packet, err := CreateICMPv6(buf[8:24], buf[24:40], ipv6.ICMPTypePacketTooBig, 0, ptb); err == nil {
-				_, _ = k.writePC(packet)
-			}
-			continue
+		if icmp != nil {
+			_, _ = k.writePC(icmp)
 		}
-		var srcAddr, dstAddr address.Address
-		var srcSubnet, dstSubnet address.Subnet
-		copy(srcAddr[:], bs[8:])
-		copy(dstAddr[:], bs[24:])
-		copy(srcSubnet[:], bs[8:])
-		copy(dstSubnet[:], bs[24:])
-		if dstAddr != k.address && dstSubnet != k.subnet {
-			continue // bad local address/subnet
+		return false
+	}
+	return true
+}
+
+// acceptIPv6 returns true if the IPv6 packet from the node with the given key
+// should be delivered, sending back an ICMPv6 error if it is too big.
+func (k *keyStore) acceptIPv6(bs []byte, key keyArray) bool {
+	if len(bs) < 40 {
+		return false
+	}
+	k.mutex.Lock()
+	mtu := int(k.mtu)
+	k.mutex.Unlock()
+	if len(bs) > mtu {
+		// Using bs would make it leak off the stack, so copy to buf
+		buf := make([]byte, 512)
+		cn := copy(buf, bs)
+		ptb := &icmp.PacketTooBig{
+			MTU:  mtu,
+			Data: buf[:cn],
 		}
-		info := k.update(ed25519.PublicKey(from.(iwt.Addr)))
-		if srcAddr != info.address && srcSubnet != info.subnet {
-			continue // bad remote address/subnet
+		if packet, err := CreateICMPv6(buf[8:24], buf[24:40], ipv6.ICMPTypePacketTooBig, 0, ptb); err == nil {
+			_, _ = k.writePC(packet)
 		}
-		n = copy(p, bs)
-		return n, nil
+		return false
 	}
+	var srcAddr, dstAddr address.Address
+	var srcSubnet, dstSubnet address.Subnet
+	copy(srcAddr[:], bs[8:])
+	copy(dstAddr[:], bs[24:])
+	copy(srcSubnet[:], bs[8:])
+	copy(dstSubnet[:], bs[24:])
+	if dstAddr != k.address && dstSubnet != k.subnet {
+		// Not for our address/subnet, so it must be from a routed prefix
+		return !dstAddr.IsValid() && !dstSubnet.IsValid() &&
+			k.routedFrom(netip.AddrFrom16(srcAddr), key)
+	}
+	info := k.update(ed25519.PublicKey(key[:]))
+	k.advertiseMTU(info)
+	if srcAddr != info.address && srcSubnet != info.subnet {
+		return k.routedFrom(netip.AddrFrom16(srcAddr), key)
+	}
+	return true
+}
+
+// acceptIPv4 returns true if the IPv4 packet from the node with the given key
+// should be delivered, which is only the case if it is from a routed prefix.
+func (k *keyStore) acceptIPv4(bs []byte, key keyArray) bool {
+	if len(bs) < 20 {
+		return false
+	}
+	k.mutex.Lock()
+	mtu := int(k.mtu)
+	k.mutex.Unlock()
+	if len(bs) > mtu {
+		return false
+	}
+	return k.routedFrom(netip.AddrFrom4([4]byte(bs[12:16])), key)
 }
 
 func (k *keyStore) writePC(bs []byte) (int, error) {
 	if len(bs) == 0 {
 		return 0, errors.New("empty packet")
 	}
+	if bs[0]&0xf0 == 0x40 && len(bs) >= 20 {
+		if key, ok := k.routeFor(netip.AddrFrom4([4]byte(bs[16:20]))); ok {
+			k.writeTo(bs, key)
+			return len(bs), nil
+		}
+	}
 	if bs[0]&0xf0 != 0x60 {
 		return 0, errors.New("not an IPv6 packet") // not IPv6
 	}
@@ -297,6 +533,14 @@ func (k *keyStore) writePC(bs []byte) (int, error) {
 	copy(dstAddr[:], bs[24:])
 	copy(srcSubnet[:], bs[8:])
 	copy(dstSubnet[:], bs[24:])
+	if !dstAddr.IsValid() && !dstSubnet.IsValid() {
+		// The source of routed traffic isn't checked, as it is most likely
+		// from the LAN that we are routing for
+		if key, ok := k.routeFor(netip.AddrFrom16(dstAddr)); ok {
+			k.writeTo(bs, key)
+			return len(bs), nil
+		}
+	}
 	if srcAddr != k.address && srcSubnet != k.subnet {
 		// This happens all the time due to link-local traffic
 		// Don't send back an error, just drop it
@@ -328,6 +572,9 @@ func (k *keyStore) SetMTU(mtu uint64) {
 	}
 	k.mutex.Lock()
 	k.mtu = mtu
+	for _, info := range k.keyToInfo {
+		info.advertised = false // Advertise the new MTU
+	}
 	k.mutex.Unlock()
 }
 
@@ -68,3 +68,37 @@ func TestWritePCReportsIPv4AsNonIPv6(t *testing.T) {
 		})
 	}
 }
+
+// Packets for a destination whose key is being looked up are queued in order,
+// up to the per-destination and total limits, rather than only keeping the
+// most recent one.
+func TestBufferPacket(t *testing.T) {
+	var k keyStore
+	buf := new(buffer)
+	for i := 0; i < bufferMaxPackets+2; i++ {
+		k.bufferPacket(buf, []byte{byte(i)})
+	}
+	if len(buf.packets) != bufferMaxPackets || k.bufferStats.dropped != 2 {
+		t.Fatalf("expected %d packets queued and 2 dropped, got %d and %d", bufferMaxPackets, len(buf.packets), k.bufferStats.dropped)
+	}
+	big := new(buffer)
+	k.bufferPacket(big, make([]byte, bufferMaxBytes+1))
+	if len(big.packets) != 0 {
+		t.Fatalf("packet larger than the per-destination limit should be dropped")
+	}
+	k.buffered = bufferMaxTotal
+	k.bufferPacket(big, []byte{1})
+	if len(big.packets) != 0 || k.bufferStats.dropped != 4 {
+		t.Fatalf("packet beyond the total limit should be dropped")
+	}
+	k.buffered = bufferMaxPackets
+	packets := k.flushBuffer(buf)
+	for i, packet := range packets {
+		if packet[0] != byte(i) {
+			t.Fatalf("packets flushed out of order")
+		}
+	}
+	if k.buffered != 0 || k.bufferStats.flushed != bufferMaxPackets {
+		t.Fatalf("unexpected statistics after flushing: %d bytes, %d flushed", k.buffered, k.bufferStats.flushed)
+	}
+}
@@ -0,0 +1,96 @@
+package ipv6rwc
+
+// The MTU to each remote node is the smallest of our own MTU, the MTU that
+// the remote node advertised, and any MTU learned from a Packet Too Big that
+// it sent us. Packets which are larger are dropped and Packet Too Big is
+// returned to the sender, so that it doesn't keep sending packets that the
+// remote node would drop.
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/net/ipv6"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+// How long an MTU learned from Packet Too Big is used for, from RFC 8201.
+const pmtuTimeout = 10 * time.Minute
+
+// mtuFor returns the MTU to the remote node. The mutex must be held.
+func (k *keyStore) mtuFor(info *keyInfo) uint64 {
+	mtu := k.mtu
+	if info.remoteMTU != 0 && info.remoteMTU < mtu {
+		mtu = info.remoteMTU
+	}
+	if info.pmtu != 0 {
+		switch {
+		case time.Now().After(info.pmtuExpiry):
+			info.pmtu = 0
+		case info.pmtu < mtu:
+			mtu = info.pmtu
+		}
+	}
+	return mtu
+}
+
+// advertiseMTU tells the remote node our MTU, if we haven't yet. This is done
+// once traffic has arrived from it, as then there is a session to send it
+// over, rather than it taking the place of a packet waiting for one.
+func (k *keyStore) advertiseMTU(info *keyInfo) {
+	k.mutex.Lock()
+	advertised, mtu := info.advertised, k.mtu
+	info.advertised = true
+	k.mutex.Unlock()
+	if !advertised {
+		k.core.AdvertiseMTU(info.key[:], mtu)
+	}
+}
+
+// setRemoteMTU is called when the remote node advertises its MTU.
+func (k *keyStore) setRemoteMTU(key ed25519.PublicKey, mtu uint64) {
+	info := k.update(key)
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	info.remoteMTU = max(mtu, 1280)
+}
+
+// learnPacketTooBig remembers the MTU from a Packet Too Big that the remote
+// node sent about a packet to its own address or subnet. Ones about packets
+// to routed prefixes are left to the host, as they could be about any hop
+// beyond the remote node.
+func (k *keyStore) learnPacketTooBig(bs []byte, key keyArray) {
+	if len(bs) < 48+40 || bs[6] != protocolICMPv6 || bs[40] != byte(ipv6.ICMPTypePacketTooBig) {
+		return
+	}
+	var dstAddr address.Address
+	var dstSubnet address.Subnet
+	copy(dstAddr[:], bs[48+24:])
+	copy(dstSubnet[:], bs[48+24:])
+	mtu := max(uint64(binary.BigEndian.Uint32(bs[44:48])), 1280)
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	info := k.keyToInfo[key]
+	if info == nil || (dstAddr != info.address && dstSubnet != info.subnet) {
+		return
+	}
+	if mtu < k.mtuFor(info) {
+		info.pmtu = mtu
+		info.pmtuExpiry = time.Now().Add(pmtuTimeout)
+	}
+}
+
+// SessionMTU returns the MTU to the remote node with the given key, or 0 if
+// we aren't exchanging traffic with it.
+func (k *keyStore) SessionMTU(key ed25519.PublicKey) uint64 {
+	var kArray keyArray
+	copy(kArray[:], key)
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if info := k.keyToInfo[kArray]; info != nil {
+		return k.mtuFor(info)
+	}
+	return 0
+}
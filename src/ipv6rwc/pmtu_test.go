@@ -0,0 +1,78 @@
+package ipv6rwc
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/net/ipv6"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+func TestPathMTU(t *testing.T) {
+	k := keyStore{
+		mtu:        9000,
+		keyToInfo:  make(map[keyArray]*keyInfo),
+		addrToInfo: make(map[address.Address]*keyInfo),
+		local:      make(chan []byte, 32),
+	}
+	remote := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	remote[0] = 0x80 // Makes for a short address prefix
+	info := &keyInfo{
+		address: *address.AddrForKey(remote),
+		subnet:  *address.SubnetForKey(remote),
+	}
+	copy(info.key[:], remote)
+	k.keyToInfo[info.key] = info
+	k.addrToInfo[info.address] = info
+
+	if mtu := k.SessionMTU(remote); mtu != 9000 {
+		t.Fatalf("expected our own MTU before learning anything, got %d", mtu)
+	}
+	info.remoteMTU = 4000
+	if mtu := k.SessionMTU(remote); mtu != 4000 {
+		t.Fatalf("expected the advertised MTU, got %d", mtu)
+	}
+
+	// A Packet Too Big from the remote node, about a packet to its address.
+	ptb := make([]byte, 48+40)
+	ptb[0], ptb[6], ptb[40] = 0x60, protocolICMPv6, byte(ipv6.ICMPTypePacketTooBig)
+	binary.BigEndian.PutUint32(ptb[44:48], 1400)
+	ptb[48] = 0x60
+	copy(ptb[48+24:], info.address[:])
+	k.learnPacketTooBig(ptb, info.key)
+	if mtu := k.SessionMTU(remote); mtu != 1400 {
+		t.Fatalf("expected the MTU from Packet Too Big, got %d", mtu)
+	}
+
+	// Ones about other destinations are ignored, and it never goes below
+	// the IPv6 minimum.
+	binary.BigEndian.PutUint32(ptb[44:48], 576)
+	ptb[48+24] = 0xfd
+	k.learnPacketTooBig(ptb, info.key)
+	if mtu := k.SessionMTU(remote); mtu != 1400 {
+		t.Fatalf("Packet Too Big about a routed prefix should be ignored, got %d", mtu)
+	}
+	copy(ptb[48+24:], info.address[:])
+	k.learnPacketTooBig(ptb, info.key)
+	if mtu := k.SessionMTU(remote); mtu != 1280 {
+		t.Fatalf("expected the MTU to be clamped to 1280, got %d", mtu)
+	}
+
+	// Oversized packets are dropped and Packet Too Big is returned for them.
+	packet := make([]byte, 1300)
+	packet[0] = 0x60
+	copy(packet[8:24], []byte{0x02, 1})
+	copy(packet[24:40], info.address[:])
+	if k.fits(packet, info) || len(k.local) != 1 {
+		t.Fatalf("expected the packet to be too big")
+	}
+	icmp := <-k.local
+	if icmp[40] != byte(ipv6.ICMPTypePacketTooBig) || binary.BigEndian.Uint32(icmp[44:48]) != 1280 {
+		t.Fatalf("expected Packet Too Big with an MTU of 1280")
+	}
+	if !k.fits(packet[:1280], info) {
+		t.Fatalf("expected the packet to fit")
+	}
+}
@@ -0,0 +1,84 @@
+package ipv6rwc
+
+// This implements cryptokey routing, which sends traffic for additional IPv4
+// and IPv6 prefixes, i.e. a LAN behind a remote node, over the session with
+// the node that the prefix is routed to. In the other direction, traffic is
+// only accepted from a node if its source address is routed to that node.
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+type tunnelRoute struct {
+	prefix netip.Prefix
+	key    keyArray
+}
+
+// AddTunnelRoute routes the prefix to the node with the given key. The prefix
+// must not overlap with the Yggdrasil address range.
+func (k *keyStore) AddTunnelRoute(prefix netip.Prefix, key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize {
+		return errors.New("tunnel route key is the wrong length")
+	}
+	if !prefix.IsValid() {
+		return errors.New("tunnel route prefix is not valid")
+	}
+	prefix = prefix.Masked()
+	ygg := netip.PrefixFrom(netip.AddrFrom16([16]byte{address.GetPrefix()[0]}), 7)
+	if prefix.Overlaps(ygg) {
+		return fmt.Errorf("tunnel route prefix %s overlaps with %s", prefix, ygg)
+	}
+	route := tunnelRoute{prefix: prefix}
+	copy(route.key[:], key)
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	for _, r := range k.routes {
+		if r.prefix == prefix {
+			return fmt.Errorf("tunnel route prefix %s is already routed", prefix)
+		}
+	}
+	// Keep the most specific prefixes first, so that the first match during
+	// a lookup is the longest one.
+	k.routes = append(k.routes, route)
+	slices.SortStableFunc(k.routes, func(a, b tunnelRoute) int {
+		return b.prefix.Bits() - a.prefix.Bits()
+	})
+	return nil
+}
+
+// TunnelRoutes returns the configured tunnel routes, from prefix to the key
+// of the remote node.
+func (k *keyStore) TunnelRoutes() map[netip.Prefix]ed25519.PublicKey {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	routes := make(map[netip.Prefix]ed25519.PublicKey, len(k.routes))
+	for _, r := range k.routes {
+		routes[r.prefix] = append(ed25519.PublicKey(nil), r.key[:]...)
+	}
+	return routes
+}
+
+// routeFor returns the key of the node that the address is routed to.
+func (k *keyStore) routeFor(addr netip.Addr) (keyArray, bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	for _, r := range k.routes {
+		if r.prefix.Contains(addr) {
+			return r.key, true
+		}
+	}
+	return keyArray{}, false
+}
+
+// routedFrom returns true if the address is routed to the node with the
+// given key, and so that node is allowed to send traffic from it.
+func (k *keyStore) routedFrom(addr netip.Addr, key keyArray) bool {
+	routed, ok := k.routeFor(addr)
+	return ok && routed == key
+}
@@ -0,0 +1,59 @@
+package ipv6rwc
+
+import (
+	"crypto/ed25519"
+	"net/netip"
+	"testing"
+)
+
+func TestTunnelRoutes(t *testing.T) {
+	var k keyStore
+	site, lan := make(ed25519.PublicKey, ed25519.PublicKeySize), make(ed25519.PublicKey, ed25519.PublicKeySize)
+	site[0], lan[0] = 1, 2
+
+	for _, prefix := range []string{"10.0.0.0/8", "10.1.0.0/16", "fd00::/64"} {
+		key := site
+		if prefix == "10.1.0.0/16" {
+			key = lan
+		}
+		if err := k.AddTunnelRoute(netip.MustParsePrefix(prefix), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, prefix := range []string{"10.0.0.0/8", "200::/8", "::/0"} {
+		if err := k.AddTunnelRoute(netip.MustParsePrefix(prefix), site); err == nil {
+			t.Fatalf("expected an error adding %s", prefix)
+		}
+	}
+	if err := k.AddTunnelRoute(netip.MustParsePrefix("10.2.0.0/16"), site[:16]); err == nil {
+		t.Fatalf("expected an error for a short key")
+	}
+
+	var siteKey, lanKey keyArray
+	copy(siteKey[:], site)
+	copy(lanKey[:], lan)
+	for addr, expected := range map[string]keyArray{
+		"10.2.3.4":  siteKey,
+		"10.1.2.3":  lanKey, // Longest match wins
+		"fd00::1":   siteKey,
+		"fd00:1::1": {},
+		"192.0.2.1": {},
+	} {
+		key, ok := k.routeFor(netip.MustParseAddr(addr))
+		if key != expected || ok != (expected != keyArray{}) {
+			t.Fatalf("unexpected route for %s", addr)
+		}
+	}
+
+	// IPv4 packets are only accepted from the node the source is routed to.
+	packet := make([]byte, 20)
+	packet[0] = 0x45
+	copy(packet[12:16], netip.MustParseAddr("10.1.0.1").AsSlice())
+	k.mtu = 1280
+	if !k.acceptIPv4(packet, lanKey) {
+		t.Fatalf("packet from a routed source should be accepted")
+	}
+	if k.acceptIPv4(packet, siteKey) {
+		t.Fatalf("packet from another node's prefix should be dropped")
+	}
+}
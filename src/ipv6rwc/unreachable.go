@@ -0,0 +1,102 @@
+package ipv6rwc
+
+// Destination Unreachable messages are sent back to the source of packets
+// that we can't deliver, so that i.e. connect() fails quickly instead of
+// waiting for its own timeout. Packets to nodes which use a different group
+// password are covered by the lookup timeout, as those nodes are never
+// reachable.
+
+import (
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+const defaultLookupTimeout = 10 * time.Second
+
+// ICMPv6 Destination Unreachable codes, from RFC 4443.
+const (
+	unreachableProhibited = 1
+	unreachableAddress    = 3
+)
+
+// Rate limit for the ICMPv6 errors that we generate, as RFC 4443 requires.
+const (
+	icmpRate  = 100 // Per second
+	icmpBurst = 100
+)
+
+type icmpLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow returns true if another ICMPv6 error can be sent now. The keyStore
+// mutex must be held.
+func (l *icmpLimiter) allow() bool {
+	now := time.Now()
+	l.tokens = min(icmpBurst, l.tokens+now.Sub(l.last).Seconds()*icmpRate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// unreachable returns an ICMPv6 Destination Unreachable message for the IPv6
+// packet, addressed to its source, or nil if one shouldn't be sent. The mutex
+// must be held.
+func (k *keyStore) unreachable(bs []byte, code int) []byte {
+	return k.icmpError(bs, ipv6.ICMPTypeDestinationUnreachable, code, func(data []byte) icmp.MessageBody {
+		return &icmp.DstUnreach{Data: data}
+	})
+}
+
+// packetTooBig returns an ICMPv6 Packet Too Big message for the IPv6 packet,
+// addressed to its source, or nil if one shouldn't be sent. The mutex must be
+// held.
+func (k *keyStore) packetTooBig(bs []byte, mtu uint64) []byte {
+	return k.icmpError(bs, ipv6.ICMPTypePacketTooBig, 0, func(data []byte) icmp.MessageBody {
+		return &icmp.PacketTooBig{MTU: int(mtu), Data: data}
+	})
+}
+
+// icmpError returns an ICMPv6 error about the IPv6 packet, addressed to its
+// source, or nil if one shouldn't be sent, i.e. because the packet is itself
+// an ICMPv6 error or because of the rate limit. The mutex must be held.
+func (k *keyStore) icmpError(bs []byte, mtype ipv6.ICMPType, code int, body func([]byte) icmp.MessageBody) []byte {
+	if len(bs) < 40 || bs[0]&0xf0 != 0x60 {
+		return nil
+	}
+	if p := parsePacket(bs); p.icmpIsError() || !k.icmpLimiter.allow() {
+		return nil
+	}
+	// Include as much of the packet as fits in the minimum MTU
+	buf := make([]byte, 1280-40-8)
+	cn := copy(buf, bs)
+	packet, err := CreateICMPv6(buf[8:24], buf[24:40], mtype, code, body(buf[:cn]))
+	if err != nil {
+		return nil
+	}
+	return packet
+}
+
+// deliverLocally queues a packet to be returned by Read, as if it had come
+// from the network. It is dropped if too many are already queued.
+func (k *keyStore) deliverLocally(packet []byte) {
+	select {
+	case k.local <- packet:
+	default:
+	}
+}
+
+// SetLookupTimeout sets how long packets are queued for a destination whose
+// key is being looked up, after which they are dropped and Destination
+// Unreachable is returned for them.
+func (k *keyStore) SetLookupTimeout(timeout time.Duration) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.lookupTimeout = timeout
+}
@@ -0,0 +1,47 @@
+package ipv6rwc
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/ipv6"
+)
+
+func TestUnreachable(t *testing.T) {
+	k := keyStore{local: make(chan []byte, 32)}
+	packet := firewallPacket(protocolTCP, 1234, 22)
+	copy(packet[8:24], []byte{0x02, 1})  // Source
+	copy(packet[24:40], []byte{0x02, 2}) // Destination
+	buf := new(buffer)
+	k.bufferPacket(buf, packet)
+	k.bufferPacket(buf, packet)
+	k.expireBuffer(buf)
+	if k.buffered != 0 || k.bufferStats.expired != 2 || len(k.local) != 2 {
+		t.Fatalf("expected 2 packets expired and returned, got %d and %d", k.bufferStats.expired, len(k.local))
+	}
+	icmp := <-k.local
+	switch {
+	case len(icmp) != 40+8+len(packet):
+		t.Fatalf("unexpected length %d", len(icmp))
+	case !bytes.Equal(icmp[8:24], packet[24:40]) || !bytes.Equal(icmp[24:40], packet[8:24]):
+		t.Fatalf("addresses should be reversed")
+	case icmp[40] != byte(ipv6.ICMPTypeDestinationUnreachable) || icmp[41] != unreachableAddress:
+		t.Fatalf("unexpected type %d and code %d", icmp[40], icmp[41])
+	case !bytes.Equal(icmp[48:], packet):
+		t.Fatalf("the original packet should be included")
+	}
+
+	// Errors aren't sent in response to errors, and are rate limited.
+	if k.unreachable(icmp, unreachableAddress) != nil {
+		t.Fatalf("unreachable should not be sent for an ICMPv6 error")
+	}
+	sent := 0
+	for i := 0; i < 2*icmpBurst; i++ {
+		if k.unreachable(packet, unreachableProhibited) != nil {
+			sent++
+		}
+	}
+	if sent < icmpBurst-2 || sent > icmpBurst {
+		t.Fatalf("expected errors to be rate limited, sent %d", sent)
+	}
+}
@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/admin"
+)
+
+type SetLogLevelRequest struct {
+	Subsystem string `json:"subsystem"`
+	Level     string `json:"level"`
+}
+
+type SetLogLevelResponse struct {
+	Default    string            `json:"default"`
+	Subsystems map[string]string `json:"subsystems"`
+}
+
+// setLogLevelHandler sets the level of a subsystem, or the default level if
+// no subsystem is given. The level "default" makes the subsystem use the
+// default level again. If no level is given then nothing is changed, so that
+// the current levels can be queried.
+func (l *Logger) setLogLevelHandler(req *SetLogLevelRequest, res *SetLogLevelResponse) error {
+	switch {
+	case req.Level == "":
+	case req.Level == "default" && req.Subsystem != "":
+		l.ResetLevel(req.Subsystem)
+	default:
+		level, err := ParseLevel(req.Level)
+		if err != nil {
+			return err
+		}
+		l.SetLevel(req.Subsystem, level)
+	}
+	level, levels := l.Levels()
+	res.Default = level.String()
+	res.Subsystems = make(map[string]string, len(levels))
+	for subsystem, level := range levels {
+		res.Subsystems[subsystem] = level.String()
+	}
+	return nil
+}
+
+func (l *Logger) SetupAdminHandlers(a *admin.AdminSocket) {
+	_ = a.AddHandler(
+		"setLogLevel", "Set the log level (error, warn, info, debug, trace) of a subsystem, or the default", []string{"subsystem", "level"},
+		func(in json.RawMessage) (interface{}, error) {
+			req := &SetLogLevelRequest{}
+			res := &SetLogLevelResponse{}
+			if err := json.Unmarshal(in, &req); err != nil {
+				return nil, err
+			}
+			if err := l.setLogLevelHandler(req, res); err != nil {
+				return nil, fmt.Errorf("failed to set log level: %w", err)
+			}
+			return res, nil
+		},
+	)
+}
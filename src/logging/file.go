@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// File is a log file which can be reopened, i.e. after logrotate has moved
+// it out of the way, and which can optionally rotate itself once it reaches
+// a certain size or age. Rotated files get a numbered suffix, with ".1" the
+// most recent, and only the given number of them are kept.
+type File struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	opened  time.Time
+	maxSize int64         // Rotate when the file would grow beyond this size, if non-zero
+	maxAge  time.Duration // Rotate when the file is older than this, if non-zero
+	keep    int           // Number of rotated files to keep
+}
+
+// OpenFile opens the log file for appending, creating it if needed. If
+// maxSize or maxAge are zero then the file isn't rotated for that reason.
+func OpenFile(path string, maxSize int64, maxAge time.Duration, keep int) (*File, error) {
+	if maxSize < 0 || maxAge < 0 || keep < 0 {
+		return nil, fmt.Errorf("log rotation limits must not be negative")
+	}
+	f := &File{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		keep:    keep,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	if f.file != nil {
+		_ = f.file.Close()
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// Reopen closes the log file and opens it again by name, so that writes go
+// to a new file if the old one was moved.
+func (f *File) Reopen() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.open()
+}
+
+// Close closes the log file.
+func (f *File) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	tooBig := f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	tooOld := f.maxAge > 0 && time.Since(f.opened) > f.maxAge
+	if tooBig || tooOld {
+		if err := f.rotate(); err != nil {
+			// Keep writing to the old file rather than losing the log.
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file %s: %s\n", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the rotated files along by one, dropping the oldest, moves
+// the current file to ".1" and then opens a new one.
+func (f *File) rotate() error {
+	name := func(i int) string {
+		return fmt.Sprintf("%s.%d", f.path, i)
+	}
+	if f.keep == 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return f.open()
+	}
+	if err := os.Remove(name(f.keep)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := f.keep - 1; i > 0; i-- {
+		if err := os.Rename(name(i), name(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.path, name(1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return f.open()
+}
@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileRotateBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "yggdrasil.log")
+	f, err := OpenFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, expected := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != expected {
+			t.Fatalf("expected %s to contain %q, got %q", name, expected, b)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("only two rotated files should be kept")
+	}
+}
+
+func TestFileReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "yggdrasil.log")
+	f, err := OpenFile(path, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// This is what logrotate does without copytruncate.
+	if _, err := f.Write([]byte("before\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("still old\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("after\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]string{
+		path + ".old": "before\nstill old\n",
+		path:          "after\n",
+	} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != expected {
+			t.Fatalf("expected %s to contain %q, got %q", name, expected, b)
+		}
+	}
+}
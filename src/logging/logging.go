@@ -0,0 +1,276 @@
+package logging
+
+// This implements core.Logger with per-subsystem levels and an optional JSON
+// output format, so that the log can be shipped somewhere that understands
+// structured logs. Fields are attached with With, i.e. the subsystem that
+// the message came from or the peer that it is about.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gologme/log"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+type Level int
+
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+	LevelTrace
+)
+
+var levelNames = [...]string{"error", "warn", "info", "debug", "trace"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses one of "error", "warn", "info", "debug" or "trace".
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+type Format int
+
+const (
+	FormatText Format = iota // The same plain text lines as before, without fields
+	FormatJSON               // One JSON object per line, including all fields
+)
+
+// ParseFormat parses either "text" or "json".
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "text", "":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	default:
+		return FormatText, fmt.Errorf("unknown log format %q", s)
+	}
+}
+
+// Logger is safe for concurrent use. Loggers returned by With share their
+// output and levels with the logger that they were created from.
+type Logger struct {
+	*output
+	subsystem string
+	fields    []interface{} // Key and value pairs, in the order they were added
+}
+
+type output struct {
+	mutex  sync.RWMutex
+	format Format
+	flags  int
+	out    *log.Logger
+	level  Level            // Default level
+	levels map[string]Level // Levels for individual subsystems
+}
+
+// New creates a logger which writes to w. The flags are those of the
+// github.com/gologme/log package, i.e. log.Ldate|log.Ltime, and control
+// whether times are included in the output. The default level is info.
+func New(w io.Writer, format Format, flags int) *Logger {
+	o := &output{
+		format: format,
+		flags:  flags,
+		level:  LevelInfo,
+		levels: map[string]Level{},
+	}
+	if format == FormatJSON {
+		// The time is written as a field instead.
+		o.out = log.New(w, "", 0)
+	} else {
+		o.out = log.New(w, "", flags)
+	}
+	return &Logger{output: o}
+}
+
+// SetOutput changes where the log is written to.
+func (l *Logger) SetOutput(w io.Writer) {
+	l.out.SetOutput(w)
+}
+
+// SetLevel sets the level for a subsystem, or the default level for all
+// subsystems which don't have their own if the subsystem is empty.
+func (l *Logger) SetLevel(subsystem string, level Level) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if subsystem == "" {
+		l.level = level
+	} else {
+		l.levels[subsystem] = level
+	}
+}
+
+// ResetLevel removes the level for a subsystem, so that it uses the default
+// level again.
+func (l *Logger) ResetLevel(subsystem string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.levels, subsystem)
+}
+
+// Levels returns the default level and the levels of any subsystems which
+// have their own.
+func (l *Logger) Levels() (Level, map[string]Level) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	levels := make(map[string]Level, len(l.levels))
+	for subsystem, level := range l.levels {
+		levels[subsystem] = level
+	}
+	return l.level, levels
+}
+
+// Enabled returns true if messages at the given level would be logged.
+func (l *Logger) Enabled(level Level) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if sl, ok := l.levels[l.subsystem]; ok {
+		return level <= sl
+	}
+	return level <= l.level
+}
+
+// With returns a logger which adds the given key and value pairs to every
+// message. A value given for a key which is already set replaces it. The
+// "subsystem" key also decides which level applies.
+func (l *Logger) With(keyvals ...interface{}) core.Logger {
+	nl := &Logger{
+		output:    l.output,
+		subsystem: l.subsystem,
+		fields:    append([]interface{}{}, l.fields...),
+	}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		if key == "subsystem" {
+			nl.subsystem = fmt.Sprint(keyvals[i+1])
+			continue
+		}
+		replaced := false
+		for j := 0; j+1 < len(nl.fields); j += 2 {
+			if nl.fields[j] == key {
+				nl.fields[j+1] = keyvals[i+1]
+				replaced = true
+			}
+		}
+		if !replaced {
+			nl.fields = append(nl.fields, key, keyvals[i+1])
+		}
+	}
+	return nl
+}
+
+// Subsystem is shorthand for With("subsystem", name).
+func (l *Logger) Subsystem(name string) *Logger {
+	return l.With("subsystem", name).(*Logger)
+}
+
+func (l *Logger) log(level Level, always bool, msg string) {
+	if !always && !l.Enabled(level) {
+		return
+	}
+	msg = strings.TrimSuffix(msg, "\n")
+	if l.format != FormatJSON {
+		_ = l.out.Output("", msg)
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	writeField := func(key string, value interface{}) {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case fmt.Stringer:
+			value = v.String()
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			b, _ = json.Marshal(fmt.Sprint(value))
+		}
+		buf.Write(b)
+	}
+	if l.flags&(log.Ldate|log.Ltime|log.Lmicroseconds) != 0 {
+		writeField("time", time.Now().Format(time.RFC3339Nano))
+	}
+	writeField("level", level.String())
+	if l.subsystem != "" {
+		writeField("subsystem", l.subsystem)
+	}
+	writeField("msg", msg)
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		writeField(l.fields[i].(string), l.fields[i+1])
+	}
+	buf.WriteByte('}')
+	_ = l.out.Output("", buf.String())
+}
+
+// The Print functions always log, whatever the level, as they do in the
+// github.com/gologme/log package.
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.log(LevelInfo, true, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Println(v ...interface{}) {
+	l.log(LevelInfo, true, fmt.Sprintln(v...))
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.log(LevelInfo, false, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Infoln(v ...interface{}) {
+	l.log(LevelInfo, false, fmt.Sprintln(v...))
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.log(LevelWarn, false, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Warnln(v ...interface{}) {
+	l.log(LevelWarn, false, fmt.Sprintln(v...))
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.log(LevelError, false, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Errorln(v ...interface{}) {
+	l.log(LevelError, false, fmt.Sprintln(v...))
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.log(LevelDebug, false, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Debugln(v ...interface{}) {
+	l.log(LevelDebug, false, fmt.Sprintln(v...))
+}
+
+func (l *Logger) Traceln(v ...interface{}) {
+	l.log(LevelTrace, false, fmt.Sprintln(v...))
+}
@@ -0,0 +1,102 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+// Make sure that the logger can be given to the core, and that the core
+// will attach fields to it.
+var _ core.StructuredLogger = &Logger{}
+
+func TestJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, FormatJSON, 0)
+	log := logger.Subsystem("links").With(
+		"key", "abcd",
+		"remote", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234},
+		"error", errors.New("failed"),
+	)
+	log.Infof("Connected %s", "outbound")
+	log.(*Logger).With("key", "ef01").Debugln("Not logged")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid JSON %q: %s", buf.String(), err)
+	}
+	for key, expected := range map[string]string{
+		"level":     "info",
+		"subsystem": "links",
+		"msg":       "Connected outbound",
+		"key":       "abcd",
+		"remote":    "192.0.2.1:1234",
+		"error":     "failed",
+	} {
+		if entry[key] != expected {
+			t.Fatalf("expected %s to be %q, got %v", key, expected, entry[key])
+		}
+	}
+	if _, ok := entry["time"]; ok {
+		t.Fatalf("time should not be included without flags")
+	}
+}
+
+func TestTextFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, FormatText, 0)
+	logger.With("key", "abcd").Infoln("Hello", "world")
+	logger.Printf("Printed %d", 1)
+	if buf.String() != "Hello world\nPrinted 1\n" {
+		t.Fatalf("unexpected output %q", buf.String())
+	}
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, FormatText, 0)
+	multicast, tun := logger.Subsystem("multicast"), logger.Subsystem("tun")
+
+	logger.SetLevel("multicast", LevelDebug)
+	multicast.Debugln("multicast debug")
+	tun.Debugln("tun debug")
+	tun.Infoln("tun info")
+
+	logger.SetLevel("", LevelError)
+	multicast.Infoln("multicast info")
+	tun.Infoln("tun info hidden")
+
+	logger.ResetLevel("multicast")
+	multicast.Infoln("multicast info hidden")
+	multicast.Errorln("multicast error")
+
+	expected := "multicast debug\ntun info\nmulticast info\nmulticast error\n"
+	if buf.String() != expected {
+		t.Fatalf("unexpected output %q", buf.String())
+	}
+}
+
+func TestSetLogLevelHandler(t *testing.T) {
+	logger := New(&bytes.Buffer{}, FormatText, 0)
+	res := &SetLogLevelResponse{}
+	if err := logger.setLogLevelHandler(&SetLogLevelRequest{Subsystem: "multicast", Level: "debug"}, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Default != "info" || res.Subsystems["multicast"] != "debug" {
+		t.Fatalf("unexpected response %+v", res)
+	}
+	if err := logger.setLogLevelHandler(&SetLogLevelRequest{Level: "loud"}, res); err == nil {
+		t.Fatalf("expected an error for an unknown level")
+	}
+	if err := logger.setLogLevelHandler(&SetLogLevelRequest{Subsystem: "multicast", Level: "default"}, res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Subsystems) != 0 || !strings.EqualFold(res.Default, "info") {
+		t.Fatalf("unexpected response %+v", res)
+	}
+}
@@ -0,0 +1,292 @@
+package metrics
+
+// This exports the state of the node in the Prometheus text format, so that
+// it can be scraped without going through the admin socket. Everything comes
+// from the same functions that the admin socket uses.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+	"github.com/yggdrasil-network/yggdrasil-go/src/version"
+)
+
+type Metrics struct {
+	core     *core.Core
+	log      core.Logger
+	listener net.Listener
+	server   *http.Server
+	config   struct {
+		listenaddr ListenAddress
+		multicast  MulticastInterfaces
+		tun        TUNStatistics
+	}
+}
+
+// New starts the metrics endpoint, which serves the metrics at /metrics on
+// the listen address. The listen address can be given as "host:port",
+// "tcp://host:port" or "unix:///path". If it is empty or "none" then New
+// returns nil.
+func New(c *core.Core, log core.Logger, opts ...SetupOption) (*Metrics, error) {
+	m := &Metrics{
+		core: c,
+		log:  log,
+	}
+	for _, opt := range opts {
+		m._applyOption(opt)
+	}
+	if m.config.listenaddr == "none" || m.config.listenaddr == "" {
+		return nil, nil
+	}
+
+	listenaddr := string(m.config.listenaddr)
+	var err error
+	u, perr := url.Parse(listenaddr)
+	switch {
+	case perr == nil && strings.EqualFold(u.Scheme, "unix"):
+		m.listener, err = net.Listen("unix", u.Path)
+	case perr == nil && strings.EqualFold(u.Scheme, "tcp"):
+		m.listener, err = net.Listen("tcp", u.Host)
+	default:
+		m.listener, err = net.Listen("tcp", listenaddr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("metrics failed to listen: %w", err)
+	}
+	m.log.Infof("Metrics endpoint listening on http://%s/metrics", m.listener.Addr().String())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	m.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	go func() {
+		if err := m.server.Serve(m.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			m.log.Errorf("Metrics endpoint stopped: %v", err)
+		}
+	}()
+	return m, nil
+}
+
+// Addr returns the address that the metrics endpoint is listening on.
+func (m *Metrics) Addr() net.Addr {
+	return m.listener.Addr()
+}
+
+// Stop stops the metrics endpoint.
+func (m *Metrics) Stop() error {
+	if m == nil {
+		return nil
+	}
+	return m.server.Close()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var buf bytes.Buffer
+	m.write(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(buf.Bytes())
+	}
+}
+
+// write collects all of the metrics and writes them out.
+func (m *Metrics) write(buf *bytes.Buffer) {
+	writeFamily(buf, "yggdrasil_build_info", "gauge", "Build name and version of the node.",
+		sample{labels: []string{"name", version.BuildName(), "version", version.BuildVersion()}, value: 1},
+	)
+
+	self := m.core.GetSelf()
+	writeFamily(buf, "yggdrasil_routing_entries", "gauge", "Number of entries in the routing table.",
+		sample{value: float64(self.RoutingEntries)},
+	)
+	writeFamily(buf, "yggdrasil_dropped_traffic_total", "counter", "Traffic packets dropped as nothing was reading them.",
+		sample{value: float64(self.DroppedTraffic)},
+	)
+	writeFamily(buf, "yggdrasil_tree_entries", "gauge", "Number of known spanning tree entries.",
+		sample{value: float64(len(m.core.GetTree()))},
+	)
+	writeFamily(buf, "yggdrasil_path_entries", "gauge", "Number of known paths.",
+		sample{value: float64(len(m.core.GetPaths()))},
+	)
+
+	m.writePeers(buf)
+
+	var rx, tx uint64
+	sessions := m.core.GetSessions()
+	for _, s := range sessions {
+		rx += s.RXBytes
+		tx += s.TXBytes
+	}
+	writeFamily(buf, "yggdrasil_sessions", "gauge", "Number of open sessions.",
+		sample{value: float64(len(sessions))},
+	)
+	writeFamily(buf, "yggdrasil_sessions_received_bytes", "gauge", "Bytes received over the open sessions.",
+		sample{value: float64(rx)},
+	)
+	writeFamily(buf, "yggdrasil_sessions_sent_bytes", "gauge", "Bytes sent over the open sessions.",
+		sample{value: float64(tx)},
+	)
+
+	failures := m.core.GetHandshakeFailures()
+	reasons := make([]string, 0, len(failures))
+	for reason := range failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	var samples []sample
+	for _, reason := range reasons {
+		samples = append(samples, sample{labels: []string{"reason", reason}, value: float64(failures[reason])})
+	}
+	writeFamily(buf, "yggdrasil_handshake_failures_total", "counter", "Failed peering handshakes by reason.", samples...)
+
+	if m.config.multicast != nil {
+		m.writeMulticast(buf)
+	}
+	if m.config.tun != nil {
+		m.writeTUN(buf)
+	}
+}
+
+// peerMetrics are exported for each connected peer, labelled by the peering
+// URI. The key and address of the peer are in yggdrasil_peer_info instead,
+// so that they don't become part of every series.
+var peerMetrics = []struct {
+	name, typ, help string
+	value           func(p *core.PeerInfo) float64
+}{
+	{"yggdrasil_peer_received_bytes_total", "counter", "Bytes received from the peer.", func(p *core.PeerInfo) float64 { return float64(p.RXBytes) }},
+	{"yggdrasil_peer_sent_bytes_total", "counter", "Bytes sent to the peer.", func(p *core.PeerInfo) float64 { return float64(p.TXBytes) }},
+	{"yggdrasil_peer_receive_rate_bytes", "gauge", "Bytes per second received from the peer.", func(p *core.PeerInfo) float64 { return float64(p.RXRate) }},
+	{"yggdrasil_peer_send_rate_bytes", "gauge", "Bytes per second sent to the peer.", func(p *core.PeerInfo) float64 { return float64(p.TXRate) }},
+	{"yggdrasil_peer_latency_seconds", "gauge", "Round-trip time to the peer.", func(p *core.PeerInfo) float64 { return p.Latency.Seconds() }},
+	{"yggdrasil_peer_cost", "gauge", "Link cost of the peer.", func(p *core.PeerInfo) float64 { return float64(p.Cost) }},
+	{"yggdrasil_peer_priority", "gauge", "Effective priority of the peer.", func(p *core.PeerInfo) float64 { return float64(p.Priority) }},
+	{"yggdrasil_peer_uptime_seconds", "gauge", "Time since the peering came up.", func(p *core.PeerInfo) float64 { return p.Uptime.Seconds() }},
+}
+
+func (m *Metrics) writePeers(buf *bytes.Buffer) {
+	peers := m.core.GetPeers()
+	sort.SliceStable(peers, func(i, j int) bool {
+		return peers[i].URI < peers[j].URI
+	})
+	direction := func(p *core.PeerInfo) string {
+		if p.Inbound {
+			return "in"
+		}
+		return "out"
+	}
+
+	var up, info []sample
+	for i := range peers {
+		p := &peers[i]
+		var value float64
+		if p.Up {
+			value = 1
+		}
+		up = append(up, sample{labels: []string{"uri", p.URI}, value: value})
+		if p.Up && len(p.Key) > 0 {
+			addr := address.AddrForKey(p.Key)
+			info = append(info, sample{labels: []string{
+				"uri", p.URI,
+				"key", hex.EncodeToString(p.Key),
+				"address", net.IP(addr[:]).String(),
+				"direction", direction(p),
+			}, value: 1})
+		}
+	}
+	writeFamily(buf, "yggdrasil_peer_up", "gauge", "Whether the peering is connected.", up...)
+	writeFamily(buf, "yggdrasil_peer_info", "gauge", "Key, address and direction of connected peers.", info...)
+
+	for _, metric := range peerMetrics {
+		var samples []sample
+		for i := range peers {
+			if p := &peers[i]; p.Up {
+				samples = append(samples, sample{labels: []string{"uri", p.URI}, value: metric.value(p)})
+			}
+		}
+		writeFamily(buf, metric.name, metric.typ, metric.help, samples...)
+	}
+}
+
+func (m *Metrics) writeMulticast(buf *bytes.Buffer) {
+	var beacon, listen, listening []sample
+	boolValue := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	for _, intf := range m.config.multicast() {
+		labels := []string{"interface", intf.Name}
+		beacon = append(beacon, sample{labels: labels, value: boolValue(intf.Beacon)})
+		listen = append(listen, sample{labels: labels, value: boolValue(intf.Listen)})
+		listening = append(listening, sample{labels: labels, value: boolValue(intf.Address != "-")})
+	}
+	writeFamily(buf, "yggdrasil_multicast_interface_beacon", "gauge", "Whether the node advertises itself on the interface.", beacon...)
+	writeFamily(buf, "yggdrasil_multicast_interface_listen", "gauge", "Whether the node looks for peers on the interface.", listen...)
+	writeFamily(buf, "yggdrasil_multicast_interface_listening", "gauge", "Whether there is a listener for peerings on the interface.", listening...)
+}
+
+func (m *Metrics) writeTUN(buf *bytes.Buffer) {
+	stats := m.config.tun()
+	writeFamily(buf, "yggdrasil_tun_received_packets_total", "counter", "Packets read from the TUN interface.", sample{value: float64(stats.RXPackets)})
+	writeFamily(buf, "yggdrasil_tun_received_bytes_total", "counter", "Bytes read from the TUN interface.", sample{value: float64(stats.RXBytes)})
+	writeFamily(buf, "yggdrasil_tun_received_dropped_total", "counter", "Packets read from the TUN interface which could not be sent.", sample{value: float64(stats.RXDropped)})
+	writeFamily(buf, "yggdrasil_tun_sent_packets_total", "counter", "Packets written to the TUN interface.", sample{value: float64(stats.TXPackets)})
+	writeFamily(buf, "yggdrasil_tun_sent_bytes_total", "counter", "Bytes written to the TUN interface.", sample{value: float64(stats.TXBytes)})
+	writeFamily(buf, "yggdrasil_tun_sent_errors_total", "counter", "Packets which could not be written to the TUN interface.", sample{value: float64(stats.TXErrors)})
+}
+
+// sample is a single value of a metric. The labels are given as name and
+// value pairs.
+type sample struct {
+	labels []string
+	value  float64
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// writeFamily writes out a metric family in the text exposition format.
+// Families with no samples are still described, so that it is clear that
+// the metric exists.
+func writeFamily(buf *bytes.Buffer, name, typ, help string, samples ...sample) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, helpEscaper.Replace(help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, typ)
+	for _, s := range samples {
+		buf.WriteString(name)
+		if len(s.labels) > 0 {
+			buf.WriteByte('{')
+			for i := 0; i+1 < len(s.labels); i += 2 {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				fmt.Fprintf(buf, `%s="%s"`, s.labels[i], labelEscaper.Replace(s.labels[i+1]))
+			}
+			buf.WriteByte('}')
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatFloat(s.value, 'g', -1, 64))
+		buf.WriteByte('\n')
+	}
+}
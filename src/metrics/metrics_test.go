@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+	"github.com/yggdrasil-network/yggdrasil-go/src/multicast"
+	"github.com/yggdrasil-network/yggdrasil-go/src/tun"
+)
+
+func TestWriteFamily(t *testing.T) {
+	var buf bytes.Buffer
+	writeFamily(&buf, "test_metric", "gauge", "Help with a \\ and\na newline.",
+		sample{value: 1.5},
+		sample{labels: []string{"a", `quote " and \`, "b", "new\nline"}, value: 2},
+	)
+	expected := "# HELP test_metric Help with a \\\\ and\\na newline.\n" +
+		"# TYPE test_metric gauge\n" +
+		"test_metric 1.5\n" +
+		"test_metric{a=\"quote \\\" and \\\\\",b=\"new\\nline\"} 2\n"
+	if buf.String() != expected {
+		t.Fatalf("unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	cfgA, cfgB := config.GenerateConfig(), config.GenerateConfig()
+	nodeA, err := core.New(cfgA.Certificate, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nodeA.Stop()
+	nodeB, err := core.New(cfgB.Certificate, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nodeB.Stop()
+
+	l, err := nodeA.Listen(&url.URL{Scheme: "tcp", Host: "127.0.0.1:0"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &url.URL{Scheme: "tcp", Host: l.Addr().String()}
+	if err = nodeB.AddPeer(peer, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := New(nodeB, logger,
+		ListenAddress("127.0.0.1:0"),
+		MulticastInterfaces(func() []multicast.MulticastInterfaceState {
+			return []multicast.MulticastInterfaceState{{Name: "eth0", Address: "-", Beacon: true}}
+		}),
+		TUNStatistics(func() tun.Statistics {
+			return tun.Statistics{RXPackets: 3, TXBytes: 1280}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop() // nolint:errcheck
+
+	scrape := func() string {
+		resp, err := http.Get("http://" + m.Addr().String() + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+			t.Fatalf("unexpected content type %q", ct)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	var body string
+	for i := 0; i < 50 && !strings.Contains(body, `yggdrasil_peer_up{uri="`+peer.String()+`"} 1`); i++ {
+		time.Sleep(100 * time.Millisecond)
+		body = scrape()
+	}
+	for _, expected := range []string{
+		`yggdrasil_peer_up{uri="` + peer.String() + `"} 1`,
+		`yggdrasil_peer_info{uri="` + peer.String() + `",key="`,
+		`yggdrasil_peer_received_bytes_total{uri="` + peer.String() + `"} `,
+		"# TYPE yggdrasil_peer_received_bytes_total counter\n",
+		"# TYPE yggdrasil_handshake_failures_total counter\n",
+		"yggdrasil_sessions ",
+		"yggdrasil_routing_entries ",
+		"yggdrasil_dropped_traffic_total 0\n",
+		`yggdrasil_multicast_interface_beacon{interface="eth0"} 1`,
+		`yggdrasil_multicast_interface_listening{interface="eth0"} 0`,
+		"yggdrasil_tun_received_packets_total 3\n",
+		"yggdrasil_tun_sent_bytes_total 1280\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("metrics do not contain %q:\n%s", expected, body)
+		}
+	}
+}
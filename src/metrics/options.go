@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"github.com/yggdrasil-network/yggdrasil-go/src/multicast"
+	"github.com/yggdrasil-network/yggdrasil-go/src/tun"
+)
+
+func (m *Metrics) _applyOption(opt SetupOption) {
+	switch v := opt.(type) {
+	case ListenAddress:
+		m.config.listenaddr = v
+	case MulticastInterfaces:
+		m.config.multicast = v
+	case TUNStatistics:
+		m.config.tun = v
+	}
+}
+
+type SetupOption interface {
+	isSetupOption()
+}
+
+type ListenAddress string
+
+// MulticastInterfaces and TUNStatistics supply the state of the multicast
+// and TUN modules, i.e. (*multicast.Multicast).GetInterfaces. If they aren't
+// given then the metrics for those modules are left out.
+type MulticastInterfaces func() []multicast.MulticastInterfaceState
+type TUNStatistics func() tun.Statistics
+
+func (a ListenAddress) isSetupOption()       {}
+func (a MulticastInterfaces) isSetupOption() {}
+func (a TUNStatistics) isSetupOption()       {}
@@ -22,8 +22,10 @@ type MulticastInterfaceState struct {
 	Password bool   `json:"password"`
 }
 
-func (m *Multicast) getMulticastInterfacesHandler(_ *GetMulticastInterfacesRequest, res *GetMulticastInterfacesResponse) error {
-	res.Interfaces = []MulticastInterfaceState{}
+// GetInterfaces returns the state of each interface that multicast is
+// enabled on, sorted by name. The address is "-" if there is no listener.
+func (m *Multicast) GetInterfaces() []MulticastInterfaceState {
+	interfaces := []MulticastInterfaceState{}
 	phony.Block(m, func() {
 		for name, intf := range m._interfaces {
 			is := MulticastInterfaceState{
@@ -37,12 +39,17 @@ func (m *Multicast) getMulticastInterfacesHandler(_ *GetMulticastInterfacesReque
 			} else {
 				is.Address = "-"
 			}
-			res.Interfaces = append(res.Interfaces, is)
+			interfaces = append(interfaces, is)
 		}
 	})
-	slices.SortStableFunc(res.Interfaces, func(a, b MulticastInterfaceState) int {
+	slices.SortStableFunc(interfaces, func(a, b MulticastInterfaceState) int {
 		return strings.Compare(a.Name, b.Name)
 	})
+	return interfaces
+}
+
+func (m *Multicast) getMulticastInterfacesHandler(_ *GetMulticastInterfacesRequest, res *GetMulticastInterfacesResponse) error {
+	res.Interfaces = m.GetInterfaces()
 	return nil
 }
 
@@ -0,0 +1,173 @@
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	forwardDialTimeout = 30 * time.Second
+	forwardUDPTimeout  = 2 * time.Minute // Idle time before a UDP flow is forgotten
+)
+
+type dialFunc func(ctx context.Context) (net.Conn, error)
+
+func (s *Netstack) startLocalForward(f LocalForward) error {
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return s.net.dial(ctx, f.Protocol, f.Target)
+	}
+	switch f.Protocol {
+	case "tcp":
+		l, err := net.Listen("tcp", f.Listen)
+		if err != nil {
+			return err
+		}
+		s.addCloser(l)
+		go s.forwardTCP(l, dial)
+	case "udp":
+		pc, err := net.ListenPacket("udp", f.Listen)
+		if err != nil {
+			return err
+		}
+		s.addCloser(pc)
+		go s.forwardUDP(pc, dial)
+	default:
+		return fmt.Errorf("unknown protocol %q", f.Protocol)
+	}
+	s.log.Infof("Forwarding local %s %s to %s", f.Protocol, f.Listen, f.Target)
+	return nil
+}
+
+func (s *Netstack) startRemoteForward(f RemoteForward) error {
+	dial := func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, f.Protocol, f.Target)
+	}
+	addr := netip.AddrPortFrom(s.address, f.Port)
+	switch f.Protocol {
+	case "tcp":
+		l, err := s.net.listenTCP(addr)
+		if err != nil {
+			return err
+		}
+		s.addCloser(l)
+		go s.forwardTCP(l, dial)
+	case "udp":
+		pc, err := s.net.listenUDP(addr)
+		if err != nil {
+			return err
+		}
+		s.addCloser(pc)
+		go s.forwardUDP(pc, dial)
+	default:
+		return fmt.Errorf("unknown protocol %q", f.Protocol)
+	}
+	s.log.Infof("Forwarding remote %s %s to %s", f.Protocol, addr, f.Target)
+	return nil
+}
+
+// forwardTCP accepts connections until the listener is closed, copying each
+// one to and from a new connection to the target.
+func (s *Netstack) forwardTCP(l net.Listener, dial dialFunc) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), forwardDialTimeout)
+			t, err := dial(ctx)
+			cancel()
+			if err != nil {
+				s.log.Debugf("Failed to forward connection from %s: %s", c.RemoteAddr(), err)
+				return
+			}
+			defer t.Close()
+			splice(c, t)
+		}()
+	}
+}
+
+// forwardUDP relays datagrams until the packet conn is closed. Each source
+// address gets its own connection to the target, so that replies can be sent
+// back to it, until it has been idle for a while.
+func (s *Netstack) forwardUDP(pc net.PacketConn, dial dialFunc) {
+	var mutex sync.Mutex
+	flows := make(map[string]net.Conn)
+	defer func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, t := range flows {
+			_ = t.Close()
+		}
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		mutex.Lock()
+		t := flows[from.String()]
+		mutex.Unlock()
+		if t == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), forwardDialTimeout)
+			t, err = dial(ctx)
+			cancel()
+			if err != nil {
+				s.log.Debugf("Failed to forward datagram from %s: %s", from, err)
+				continue
+			}
+			mutex.Lock()
+			flows[from.String()] = t
+			mutex.Unlock()
+			go func() {
+				defer func() {
+					mutex.Lock()
+					defer mutex.Unlock()
+					if flows[from.String()] == t {
+						delete(flows, from.String())
+					}
+					_ = t.Close()
+				}()
+				reply := make([]byte, 65535)
+				for {
+					n, err := t.Read(reply)
+					if err != nil {
+						return
+					}
+					if _, err := pc.WriteTo(reply[:n], from); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		_ = t.SetReadDeadline(time.Now().Add(forwardUDPTimeout))
+		_, _ = t.Write(buf[:n])
+	}
+}
+
+// splice copies between the connections in both directions, passing on
+// half-closes, until both directions are finished.
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	copyAndClose := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+	wg.Add(2)
+	go copyAndClose(a, b)
+	go copyAndClose(b, a)
+	wg.Wait()
+}
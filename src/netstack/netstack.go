@@ -0,0 +1,108 @@
+// Package netstack attaches a userspace TCP/IP stack to the network, in place
+// of a TUN adapter, so that a node can be used without root. Other nodes can
+// be reached through a SOCKS5 proxy or through port forwards.
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+type ReadWriteCloser interface {
+	io.ReadWriteCloser
+	Address() address.Address
+	MaxMTU() uint64
+	SetMTU(uint64)
+}
+
+// network is the part of the userspace stack that the SOCKS proxy and the
+// port forwards use, so that they can be tested without one.
+type network interface {
+	dial(ctx context.Context, network, address string) (net.Conn, error)
+	listenTCP(addr netip.AddrPort) (net.Listener, error)
+	listenUDP(addr netip.AddrPort) (net.PacketConn, error)
+}
+
+type Netstack struct {
+	rwc     ReadWriteCloser
+	log     core.Logger
+	net     network
+	address netip.Addr
+	mutex   sync.Mutex
+	closers []io.Closer // Listeners and the stack itself, closed on Stop
+	config  struct {
+		socks  SOCKSAddress
+		local  []LocalForward
+		remote []RemoteForward
+	}
+}
+
+// start runs the SOCKS proxy and port forwards on top of the stack.
+func (s *Netstack) start() error {
+	if s.config.socks != "" {
+		if !isLoopback(string(s.config.socks)) {
+			return fmt.Errorf("SOCKS proxy address %s is not a loopback address", s.config.socks)
+		}
+		l, err := net.Listen("tcp", string(s.config.socks))
+		if err != nil {
+			return fmt.Errorf("failed to start SOCKS proxy: %w", err)
+		}
+		s.addCloser(l)
+		s.log.Infof("SOCKS proxy listening on %s", l.Addr())
+		go s.serveSOCKS(l)
+	}
+	for _, f := range s.config.local {
+		if err := s.startLocalForward(f); err != nil {
+			return fmt.Errorf("failed to forward %s %s: %w", f.Protocol, f.Listen, err)
+		}
+	}
+	for _, f := range s.config.remote {
+		if err := s.startRemoteForward(f); err != nil {
+			return fmt.Errorf("failed to forward %s port %d: %w", f.Protocol, f.Port, err)
+		}
+	}
+	return nil
+}
+
+// isLoopback returns true if the "host:port" can only be reached from this
+// machine. The SOCKS proxy has no authentication, so it mustn't listen
+// anywhere else.
+func isLoopback(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsLoopback()
+}
+
+func (s *Netstack) addCloser(c io.Closer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closers = append(s.closers, c)
+}
+
+// Stop closes the SOCKS proxy, the port forwards and the stack. Connections
+// which are already open are not closed.
+func (s *Netstack) Stop() error {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		_ = s.closers[i].Close()
+	}
+	s.closers = nil
+	return nil
+}
@@ -0,0 +1,174 @@
+package netstack
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+)
+
+// hostNetwork stands in for the userspace stack, using the host's loopback
+// interface instead.
+type hostNetwork struct{}
+
+func (hostNetwork) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func (hostNetwork) listenTCP(addr netip.AddrPort) (net.Listener, error) {
+	return net.Listen("tcp", addr.String())
+}
+
+func (hostNetwork) listenUDP(addr netip.AddrPort) (net.PacketConn, error) {
+	return net.ListenPacket("udp", addr.String())
+}
+
+func newTestNetstack(t *testing.T, opts ...SetupOption) *Netstack {
+	s := &Netstack{
+		log:     log.New(io.Discard, "", 0),
+		net:     hostNetwork{},
+		address: netip.MustParseAddr("127.0.0.1"),
+	}
+	for _, opt := range opts {
+		s._applyOption(opt)
+	}
+	if err := s.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Stop() })
+	return s
+}
+
+// echoTCP runs a line echo server, returning its address.
+func echoTCP(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func expectEcho(t *testing.T, c net.Conn, r io.Reader) {
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\n" {
+		t.Fatalf("expected an echo, got %q", line)
+	}
+}
+
+func TestSOCKS(t *testing.T) {
+	target := netip.MustParseAddrPort(echoTCP(t))
+	s := newTestNetstack(t, SOCKSAddress("127.0.0.1:0"))
+	c, err := net.Dial("tcp", s.closers[0].(net.Listener).Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := []byte{5, 1, 0, 5, 1, 0, 1}
+	request = append(request, target.Addr().AsSlice()...)
+	request = append(request, byte(target.Port()>>8), byte(target.Port()))
+	if _, err := c.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply[:4], []byte{5, 0, 5, 0}) {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+	expectEcho(t, c, c)
+}
+
+func TestSOCKSLoopbackOnly(t *testing.T) {
+	for _, addr := range []string{":0", "0.0.0.0:0", "[::]:0", "192.0.2.1:1080", "example.com:1080", "1080"} {
+		s := &Netstack{log: log.New(io.Discard, "", 0), net: hostNetwork{}}
+		s._applyOption(SOCKSAddress(addr))
+		if err := s.start(); err == nil {
+			_ = s.Stop()
+			t.Fatalf("SOCKS proxy should not listen on %q", addr)
+		}
+	}
+}
+
+func TestSOCKSUnsupportedCommand(t *testing.T) {
+	var buf bytes.Buffer
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader([]byte{5, 1, 0, 5, 2, 0, 1, 127, 0, 0, 1, 0, 80}), &buf}
+	if _, _, err := readSOCKSRequest(rw); err == nil {
+		t.Fatalf("BIND should not be supported")
+	} else if serr, ok := err.(*socksError); !ok || serr.reply != socksCommandNotSupported {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestForwardTCP(t *testing.T) {
+	target := echoTCP(t)
+	s := newTestNetstack(t,
+		LocalForward{Protocol: "tcp", Listen: "127.0.0.1:0", Target: target},
+		RemoteForward{Protocol: "tcp", Port: 0, Target: target},
+	)
+	for _, l := range s.closers {
+		c, err := net.Dial("tcp", l.(net.Listener).Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectEcho(t, c, c)
+		_ = c.Close()
+	}
+}
+
+func TestForwardUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], from)
+		}
+	}()
+	s := newTestNetstack(t, LocalForward{Protocol: "udp", Listen: "127.0.0.1:0", Target: echo.LocalAddr().String()})
+	c, err := net.Dial("udp", s.closers[0].(net.PacketConn).LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	expectEcho(t, c, c)
+}
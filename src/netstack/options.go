@@ -0,0 +1,41 @@
+package netstack
+
+func (s *Netstack) _applyOption(opt SetupOption) {
+	switch v := opt.(type) {
+	case SOCKSAddress:
+		s.config.socks = v
+	case LocalForward:
+		s.config.local = append(s.config.local, v)
+	case RemoteForward:
+		s.config.remote = append(s.config.remote, v)
+	}
+}
+
+type SetupOption interface {
+	isSetupOption()
+}
+
+// SOCKSAddress is the loopback "host:port" to run a SOCKS5 proxy on, through
+// which connections can be made to other nodes.
+type SOCKSAddress string
+
+// LocalForward forwards a local "host:port", i.e. "127.0.0.1:8080", to a
+// "host:port" on the network, i.e. "[200:1234::1]:80". The protocol is
+// either "tcp" or "udp".
+type LocalForward struct {
+	Protocol string
+	Listen   string
+	Target   string
+}
+
+// RemoteForward forwards a port on our Yggdrasil address to a local
+// "host:port". The protocol is either "tcp" or "udp".
+type RemoteForward struct {
+	Protocol string
+	Port     uint16
+	Target   string
+}
+
+func (a SOCKSAddress) isSetupOption()  {}
+func (a LocalForward) isSetupOption()  {}
+func (a RemoteForward) isSetupOption() {}
@@ -0,0 +1,183 @@
+package netstack
+
+// This is a minimal SOCKS5 server (RFC 1928), supporting only the CONNECT
+// command without authentication, which is enough for browsers and most
+// other clients. The proxy is only allowed to listen on a loopback address,
+// so there is nobody to authenticate.
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+const socksHandshakeTimeout = 10 * time.Second
+
+const (
+	socksVersion        = 5
+	socksMethodNone     = 0x00
+	socksMethodRejected = 0xff
+	socksCommandConnect = 1
+	socksAddressIPv4    = 1
+	socksAddressDomain  = 3
+	socksAddressIPv6    = 4
+)
+
+// SOCKS reply codes
+const (
+	socksSucceeded               = 0
+	socksHostUnreachable         = 4
+	socksCommandNotSupported     = 7
+	socksAddressTypeNotSupported = 8
+)
+
+type socksError struct {
+	reply byte
+	err   error
+}
+
+func (e *socksError) Error() string {
+	return e.err.Error()
+}
+
+func (s *Netstack) serveSOCKS(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleSOCKS(c)
+	}
+}
+
+func (s *Netstack) handleSOCKS(c net.Conn) {
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	host, port, err := readSOCKSRequest(c)
+	if err != nil {
+		s.log.Debugf("Bad SOCKS request from %s: %s", c.RemoteAddr(), err)
+		var serr *socksError
+		if errors.As(err, &serr) {
+			_ = writeSOCKSReply(c, serr.reply)
+		}
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), forwardDialTimeout)
+	t, err := s.dialSOCKS(ctx, host, port)
+	cancel()
+	if err != nil {
+		s.log.Debugf("Failed to connect to %s for %s: %s", net.JoinHostPort(host, strconv.Itoa(int(port))), c.RemoteAddr(), err)
+		_ = writeSOCKSReply(c, socksHostUnreachable)
+		return
+	}
+	defer t.Close()
+	if err := writeSOCKSReply(c, socksSucceeded); err != nil {
+		return
+	}
+	_ = c.SetDeadline(time.Time{})
+	splice(c, t)
+}
+
+// dialSOCKS connects to the host through the stack, looking it up with the
+// system resolver if it is a name rather than an address.
+func (s *Netstack) dialSOCKS(ctx context.Context, host string, port uint16) (net.Conn, error) {
+	addrs := []netip.Addr{}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = append(addrs, addr)
+	} else if addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host); err != nil {
+		return nil, err
+	}
+	var err error
+	for _, addr := range addrs {
+		var t net.Conn
+		if t, err = s.net.dial(ctx, "tcp", netip.AddrPortFrom(addr.Unmap(), port).String()); err == nil {
+			return t, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no addresses found for %s", host)
+	}
+	return nil, err
+}
+
+// readSOCKSRequest does the method negotiation and then reads the CONNECT
+// request, returning where to connect to.
+func readSOCKSRequest(c io.ReadWriter) (string, uint16, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return "", 0, err
+	}
+	if header[0] != socksVersion {
+		return "", 0, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", 0, err
+	}
+	method := byte(socksMethodRejected)
+	for _, m := range methods {
+		if m == socksMethodNone {
+			method = socksMethodNone
+		}
+	}
+	if _, err := c.Write([]byte{socksVersion, method}); err != nil {
+		return "", 0, err
+	}
+	if method != socksMethodNone {
+		return "", 0, errors.New("client doesn't support connecting without authentication")
+	}
+
+	var request [4]byte // VER, CMD, RSV, ATYP
+	if _, err := io.ReadFull(c, request[:]); err != nil {
+		return "", 0, err
+	}
+	if request[0] != socksVersion {
+		return "", 0, fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+	var host string
+	switch request[3] {
+	case socksAddressIPv4, socksAddressIPv6:
+		addr := make([]byte, 4)
+		if request[3] == socksAddressIPv6 {
+			addr = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(c, addr); err != nil {
+			return "", 0, err
+		}
+		ip, _ := netip.AddrFromSlice(addr)
+		host = ip.String()
+	case socksAddressDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(c, length[:]); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(c, name); err != nil {
+			return "", 0, err
+		}
+		host = string(name)
+	default:
+		return "", 0, &socksError{socksAddressTypeNotSupported, fmt.Errorf("unsupported address type %d", request[3])}
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(c, port[:]); err != nil {
+		return "", 0, err
+	}
+	if request[1] != socksCommandConnect {
+		return "", 0, &socksError{socksCommandNotSupported, fmt.Errorf("unsupported command %d", request[1])}
+	}
+	return host, binary.BigEndian.Uint16(port[:]), nil
+}
+
+// writeSOCKSReply sends the reply to the request. The bound address isn't
+// meaningful for us, so it is always left empty.
+func writeSOCKSReply(w io.Writer, reply byte) error {
+	_, err := w.Write([]byte{socksVersion, reply, 0, socksAddressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
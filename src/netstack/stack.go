@@ -0,0 +1,104 @@
+//go:build netstack
+
+package netstack
+
+// The stack itself is gVisor's, as wrapped by wireguard-go. It is behind a
+// build tag as it adds considerably to the size of the binary, which isn't
+// worth it for nodes that have a TUN adapter.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	wgtun "golang.zx2c4.com/wireguard/tun"
+	wgnetstack "golang.zx2c4.com/wireguard/tun/netstack"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+// New attaches a userspace stack with our Yggdrasil address to the
+// ReadWriteCloser and starts the SOCKS proxy and port forwards. Nothing else
+// may read from the ReadWriteCloser, i.e. there must not be a TUN adapter.
+func New(rwc ReadWriteCloser, log core.Logger, opts ...SetupOption) (*Netstack, error) {
+	s := &Netstack{
+		rwc: rwc,
+		log: log,
+	}
+	for _, opt := range opts {
+		s._applyOption(opt)
+	}
+	s.address = netip.AddrFrom16(rwc.Address())
+	rwc.SetMTU(rwc.MaxMTU())
+	dev, tnet, err := wgnetstack.CreateNetTUN([]netip.Addr{s.address}, nil, int(rwc.MaxMTU()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create userspace stack: %w", err)
+	}
+	s.net = &stackNetwork{tnet}
+	s.addCloser(dev)
+	go s.read(dev)
+	go s.write(dev)
+	if err := s.start(); err != nil {
+		_ = s.Stop()
+		return nil, err
+	}
+	s.log.Infof("Userspace network stack address: %s", s.address)
+	return s, nil
+}
+
+// read sends the packets from the stack to the network.
+func (s *Netstack) read(dev wgtun.Device) {
+	bufs := [][]byte{make([]byte, 65535)}
+	sizes := make([]int, len(bufs))
+	for {
+		n, err := dev.Read(bufs, sizes, 0)
+		if err != nil {
+			return
+		}
+		for i := range bufs[:n] {
+			if _, err := s.rwc.Write(bufs[i][:sizes[i]]); err != nil {
+				s.log.Debugln("Unable to send packet:", err)
+			}
+		}
+	}
+}
+
+// write delivers the packets from the network to the stack.
+func (s *Netstack) write(dev wgtun.Device) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := s.rwc.Read(buf)
+		if err != nil {
+			s.log.Errorln("Exiting userspace stack due to core read error:", err)
+			return
+		}
+		if _, err := dev.Write([][]byte{buf[:n]}, 0); err != nil {
+			s.log.Debugln("Unable to deliver packet:", err)
+		}
+	}
+}
+
+type stackNetwork struct {
+	tnet *wgnetstack.Net
+}
+
+func (n *stackNetwork) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	return n.tnet.DialContext(ctx, network, address)
+}
+
+func (n *stackNetwork) listenTCP(addr netip.AddrPort) (net.Listener, error) {
+	l, err := n.tnet.ListenTCPAddrPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (n *stackNetwork) listenUDP(addr netip.AddrPort) (net.PacketConn, error) {
+	pc, err := n.tnet.ListenUDPAddrPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
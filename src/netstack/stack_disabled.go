@@ -0,0 +1,15 @@
+//go:build !netstack
+
+package netstack
+
+import (
+	"errors"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+// New always fails, as the userspace stack is only included in builds with
+// the netstack build tag.
+func New(rwc ReadWriteCloser, log core.Logger, opts ...SetupOption) (*Netstack, error) {
+	return nil, errors.New("this build doesn't include the userspace network stack, rebuild with -tags netstack")
+}
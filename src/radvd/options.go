@@ -0,0 +1,33 @@
+package radvd
+
+func (d *Daemon) _applyOption(opt SetupOption) {
+	switch v := opt.(type) {
+	case LANInterface:
+		d.config.lan = v
+	case TUNInterface:
+		d.config.tun = v
+	case DNSListenAddress:
+		d.config.dns = append(d.config.dns, v)
+	}
+}
+
+type SetupOption interface {
+	isSetupOption()
+}
+
+// LANInterface is the name of the interface to advertise the node's subnet
+// on, i.e. "eth0".
+type LANInterface string
+
+// TUNInterface is the name of the TUN adapter that traffic for the rest of
+// the network is routed to.
+type TUNInterface string
+
+// DNSListenAddress is a listen address of the node's DNS server. If it
+// listens on port 53 of the node's address on the LAN, or of every address,
+// then it is advertised to hosts on the LAN.
+type DNSListenAddress string
+
+func (a LANInterface) isSetupOption()     {}
+func (a TUNInterface) isSetupOption()     {}
+func (a DNSListenAddress) isSetupOption() {}
@@ -0,0 +1,299 @@
+// Package radvd sends IPv6 router advertisements for the node's routed /64
+// subnet on a LAN interface, so that hosts on the LAN configure addresses in
+// it and reach the rest of the network through the node. The node takes the
+// first address in the subnet on the LAN interface and packets are forwarded
+// between it and the TUN adapter.
+//
+// A route to 200::/7 is advertised instead of a default route, so that hosts
+// keep using any other router that they have for everything else. Hosts only
+// use it if they accept RFC 4191 route information though, which Linux only
+// does when accept_ra_rt_info_max_plen is at least 7 (it is 0 by default)
+// and Android doesn't do at all. Other hosts only get an address in the
+// subnet and can't reach the rest of the network.
+//
+// The node's DNS server is only advertised if it is given with the
+// DNSListenAddress option, as it only answers for .ygg names and hosts which
+// have no other resolver would lose every other name.
+package radvd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+// The intervals between unsolicited advertisements, from RFC 4861.
+const (
+	maxInterval           = 600 * time.Second
+	minInterval           = maxInterval / 3
+	initialInterval       = 16 * time.Second
+	initialAdvertisements = 3
+	minDelayBetweenRAs    = 3 * time.Second
+)
+
+// Lifetimes in seconds of the advertised prefix, route and DNS server.
+const (
+	validLifetime     = 86400
+	preferredLifetime = 14400
+	routeLifetime     = 1800
+)
+
+// Option types, from RFC 4861, RFC 4191 and RFC 8106.
+const (
+	optionSourceLinkLayer  = 1
+	optionPrefixInfo       = 3
+	optionRouteInfo        = 24
+	optionRecursiveDNS     = 25
+	prefixFlagOnLink       = 0x80
+	prefixFlagAutonomous   = 0x40
+	advertisementHopLimit  = 64
+	advertisementHeaderLen = 12
+)
+
+var (
+	allNodes   = net.ParseIP("ff02::1")
+	allRouters = net.ParseIP("ff02::2")
+)
+
+// Daemon sends router advertisements on a LAN interface.
+type Daemon struct {
+	core      *core.Core
+	log       core.Logger
+	lan       *net.Interface
+	tun       *net.Interface
+	prefix    netip.Prefix // The node's subnet
+	addr      netip.Addr   // The node's address in the subnet on the LAN
+	dns       bool         // Whether to advertise addr as a DNS server
+	sock      *ipv6.PacketConn
+	solicited chan struct{}
+	cancel    context.CancelFunc
+	done      chan struct{}
+	config    struct {
+		lan LANInterface
+		tun TUNInterface
+		dns []DNSListenAddress
+	}
+}
+
+// New starts sending router advertisements on the LAN interface. If no LAN
+// interface is given then nothing is started and nil is returned.
+func New(c *core.Core, log core.Logger, opts ...SetupOption) (*Daemon, error) {
+	d := &Daemon{
+		core:      c,
+		log:       log,
+		solicited: make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		d._applyOption(opt)
+	}
+	if d.config.lan == "" {
+		return nil, nil
+	}
+	if d.config.tun == "" {
+		return nil, errors.New("a TUN adapter is needed to route the subnet to")
+	}
+	var err error
+	if d.lan, err = net.InterfaceByName(string(d.config.lan)); err != nil {
+		return nil, fmt.Errorf("failed to find LAN interface %q: %w", d.config.lan, err)
+	}
+	if d.tun, err = net.InterfaceByName(string(d.config.tun)); err != nil {
+		return nil, fmt.Errorf("failed to find TUN interface %q: %w", d.config.tun, err)
+	}
+	subnet := c.Subnet()
+	prefix, _ := netip.AddrFromSlice(subnet.IP)
+	d.prefix = netip.PrefixFrom(prefix, 64)
+	d.addr = prefix.Next()
+	d.dns = d.servesDNS()
+	if err = d.setup(); err != nil {
+		return nil, err
+	}
+	if err = d.listen(); err != nil {
+		_ = d.teardown()
+		return nil, err
+	}
+	var ctx context.Context
+	ctx, d.cancel = context.WithCancel(context.Background())
+	go d.read()
+	go d.advertise(ctx)
+	d.log.Infof("Advertising %s on %s", d.prefix, d.lan.Name)
+	return d, nil
+}
+
+// Stop sends a last advertisement to tell hosts to stop using the subnet and
+// removes the node's address from the LAN interface.
+func (d *Daemon) Stop() error {
+	if d == nil {
+		return nil
+	}
+	d.cancel()
+	<-d.done
+	_ = d.sock.Close()
+	return d.teardown()
+}
+
+// servesDNS returns true if the DNS server is listening on port 53 of the
+// node's address on the LAN, so that it can be advertised to hosts.
+func (d *Daemon) servesDNS() bool {
+	for _, listen := range d.config.dns {
+		addrport, err := netip.ParseAddrPort(string(listen))
+		if err != nil || addrport.Port() != 53 {
+			continue
+		}
+		addr := addrport.Addr()
+		if addr == d.addr || (addr.Is6() && addr.IsUnspecified()) {
+			return true
+		}
+	}
+	if len(d.config.dns) > 0 {
+		d.log.Infof("Not advertising the DNS server as it isn't listening on [%s]:53", d.addr)
+	}
+	return false
+}
+
+// listen opens a raw socket for router solicitations from the LAN and for
+// sending advertisements, which must have a hop limit of 255.
+func (d *Daemon) listen() error {
+	conn, err := net.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return fmt.Errorf("failed to open ICMPv6 socket: %w", err)
+	}
+	d.sock = ipv6.NewPacketConn(conn)
+	var filter ipv6.ICMPFilter
+	filter.SetAll(true)
+	filter.Accept(ipv6.ICMPTypeRouterSolicitation)
+	for _, err = range []error{
+		d.sock.SetICMPFilter(&filter),
+		d.sock.SetControlMessage(ipv6.FlagInterface|ipv6.FlagHopLimit, true),
+		d.sock.SetHopLimit(255),
+		d.sock.SetMulticastHopLimit(255),
+		d.sock.SetMulticastLoopback(false),
+		d.sock.SetMulticastInterface(d.lan),
+		d.sock.JoinGroup(d.lan, &net.IPAddr{IP: allRouters}),
+	} {
+		if err != nil {
+			_ = d.sock.Close()
+			return fmt.Errorf("failed to set up ICMPv6 socket: %w", err)
+		}
+	}
+	return nil
+}
+
+// read waits for router solicitations from the LAN interface.
+func (d *Daemon) read() {
+	buf := make([]byte, 1500)
+	for {
+		n, cm, _, err := d.sock.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if cm == nil || cm.IfIndex != d.lan.Index || cm.HopLimit != 255 {
+			continue
+		}
+		if n < 8 || buf[0] != byte(ipv6.ICMPTypeRouterSolicitation) || buf[1] != 0 {
+			continue
+		}
+		select {
+		case d.solicited <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// advertise sends unsolicited advertisements, more often at first so that
+// hosts find the node quickly, and answers solicitations. Answers are sent
+// to all nodes, but no more often than every few seconds.
+func (d *Daemon) advertise(ctx context.Context) {
+	defer close(d.done)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	var last time.Time
+	for sent := 0; ; sent++ {
+		select {
+		case <-ctx.Done():
+			d.send(true)
+			return
+		case <-d.solicited:
+			if wait := minDelayBetweenRAs - time.Since(last); wait > 0 {
+				timer.Reset(wait)
+				sent--
+				continue
+			}
+		case <-timer.C:
+		}
+		d.send(false)
+		last = time.Now()
+		interval := minInterval + time.Duration(rand.Int63n(int64(maxInterval-minInterval)))
+		if sent < initialAdvertisements && interval > initialInterval {
+			interval = initialInterval
+		}
+		timer.Reset(interval)
+	}
+}
+
+func (d *Daemon) send(final bool) {
+	var dns netip.Addr
+	if d.dns {
+		dns = d.addr
+	}
+	msg := advertisement(d.prefix, d.lan.HardwareAddr, dns, final)
+	dst := &net.IPAddr{IP: allNodes, Zone: d.lan.Name}
+	if _, err := d.sock.WriteTo(msg, nil, dst); err != nil {
+		d.log.Debugf("Failed to send router advertisement on %s: %s", d.lan.Name, err)
+	}
+}
+
+// advertisement returns a router advertisement for the prefix and a route to
+// the rest of the network, and for the DNS server if it's valid. The final
+// advertisement tells hosts to stop using them. The checksum is left for the
+// kernel to fill in.
+func advertisement(prefix netip.Prefix, mac net.HardwareAddr, dns netip.Addr, final bool) []byte {
+	var preferred, valid, lifetime uint32 = preferredLifetime, validLifetime, routeLifetime
+	if final {
+		preferred, valid, lifetime = 0, 0, 0
+	}
+	body := make([]byte, advertisementHeaderLen)
+	body[0] = advertisementHopLimit
+	// The router lifetime is 0, as the node isn't a default router.
+
+	if len(mac) == 6 {
+		body = append(body, optionSourceLinkLayer, 1)
+		body = append(body, mac...)
+	}
+
+	body = append(body, optionPrefixInfo, 4, byte(prefix.Bits()), prefixFlagOnLink|prefixFlagAutonomous)
+	body = binary.BigEndian.AppendUint32(body, valid)
+	body = binary.BigEndian.AppendUint32(body, preferred)
+	body = append(body, 0, 0, 0, 0)
+	body = append(body, prefix.Addr().AsSlice()...)
+
+	network := address.GetPrefix()
+	body = append(body, optionRouteInfo, 2, byte(8*len(network)-1), 0)
+	body = binary.BigEndian.AppendUint32(body, lifetime)
+	body = append(body, make([]byte, 8)...)
+	copy(body[len(body)-8:], network[:])
+
+	if dns.IsValid() {
+		body = append(body, optionRecursiveDNS, 3, 0, 0)
+		body = binary.BigEndian.AppendUint32(body, lifetime)
+		body = append(body, dns.AsSlice()...)
+	}
+
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeRouterAdvertisement,
+		Body: &icmp.RawBody{Data: body},
+	}
+	bs, _ := msg.Marshal(nil)
+	return bs
+}
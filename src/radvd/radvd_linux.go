@@ -0,0 +1,97 @@
+//go:build linux
+
+package radvd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+// setup turns on IPv6 forwarding, adds the node's address in the subnet to
+// the LAN interface, which routes the subnet there, and routes the rest of
+// the network to the TUN adapter.
+func (d *Daemon) setup() error {
+	if err := d.keepAcceptingRAs(); err != nil {
+		return fmt.Errorf("failed to keep accepting router advertisements: %w", err)
+	}
+	if err := os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0644); err != nil {
+		return fmt.Errorf("failed to enable IPv6 forwarding: %w", err)
+	}
+	lan, err := netlink.LinkByIndex(d.lan.Index)
+	if err != nil {
+		return fmt.Errorf("failed to find LAN interface: %w", err)
+	}
+	if err = netlink.AddrReplace(lan, d.netlinkAddr()); err != nil {
+		return fmt.Errorf("failed to add address to LAN interface: %w", err)
+	}
+	prefix := address.GetPrefix()
+	route := &netlink.Route{
+		LinkIndex: d.tun.Index,
+		Dst: &net.IPNet{
+			IP:   append(prefix[:], make([]byte, net.IPv6len-len(prefix))...),
+			Mask: net.CIDRMask(8*len(prefix)-1, 128),
+		},
+	}
+	if err = netlink.RouteReplace(route); err != nil {
+		_ = d.teardown()
+		return fmt.Errorf("failed to add route to TUN interface: %w", err)
+	}
+	d.log.Infof("LAN interface %s IPv6: %s/%d", d.lan.Name, d.addr, d.prefix.Bits())
+	return nil
+}
+
+// keepAcceptingRAs stops forwarding from turning off router advertisements
+// on the other interfaces, i.e. the uplink, which Linux does when accept_ra
+// is 1. Those are set to 2, which accepts them while forwarding too. This
+// includes "default", for interfaces that come up later. The LAN interface
+// is left alone, as the node is the router there.
+func (d *Daemon) keepAcceptingRAs() error {
+	entries, err := os.ReadDir("/proc/sys/net/ipv6/conf")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		switch name := entry.Name(); name {
+		case "all", "lo", d.lan.Name, d.tun.Name:
+		default:
+			path := filepath.Join("/proc/sys/net/ipv6/conf", name, "accept_ra")
+			if value, err := os.ReadFile(path); err != nil || strings.TrimSpace(string(value)) != "1" {
+				continue
+			}
+			if err = os.WriteFile(path, []byte("2"), 0644); err != nil {
+				return err
+			}
+			d.log.Debugf("Set accept_ra to 2 on %s so that it accepts router advertisements while forwarding", name)
+		}
+	}
+	return nil
+}
+
+// teardown removes the node's address from the LAN interface. Forwarding
+// and accept_ra are left as they are, as something else may rely on them.
+func (d *Daemon) teardown() error {
+	lan, err := netlink.LinkByIndex(d.lan.Index)
+	if err != nil {
+		return fmt.Errorf("failed to find LAN interface: %w", err)
+	}
+	if err = netlink.AddrDel(lan, d.netlinkAddr()); err != nil {
+		return fmt.Errorf("failed to remove address from LAN interface: %w", err)
+	}
+	return nil
+}
+
+func (d *Daemon) netlinkAddr() *netlink.Addr {
+	return &netlink.Addr{
+		IPNet: &net.IPNet{
+			IP:   d.addr.AsSlice(),
+			Mask: net.CIDRMask(d.prefix.Bits(), 128),
+		},
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package radvd
+
+import "errors"
+
+func (d *Daemon) setup() error {
+	return errors.New("router advertisements are only supported on Linux")
+}
+
+func (d *Daemon) teardown() error {
+	return nil
+}
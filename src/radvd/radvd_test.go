@@ -0,0 +1,73 @@
+package radvd
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/ipv6"
+)
+
+func TestAdvertisement(t *testing.T) {
+	prefix := netip.MustParsePrefix("300:1111:2222:3333::/64")
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	dns := netip.MustParseAddr("300:1111:2222:3333::1")
+
+	// options returns the options in the advertisement by type.
+	options := func(bs []byte) map[byte][]byte {
+		if bs[0] != byte(ipv6.ICMPTypeRouterAdvertisement) || bs[4] != advertisementHopLimit {
+			t.Fatalf("not a router advertisement")
+		}
+		if binary.BigEndian.Uint16(bs[6:8]) != 0 {
+			t.Fatalf("router lifetime should be 0")
+		}
+		opts := make(map[byte][]byte)
+		for bs = bs[4+advertisementHeaderLen:]; len(bs) > 0; {
+			length := 8 * int(bs[1])
+			if length == 0 || length > len(bs) {
+				t.Fatalf("invalid option length %d", bs[1])
+			}
+			opts[bs[0]], bs = bs[:length], bs[length:]
+		}
+		return opts
+	}
+
+	opts := options(advertisement(prefix, mac, dns, false))
+	if lladdr := opts[optionSourceLinkLayer]; lladdr == nil || net.HardwareAddr(lladdr[2:]).String() != mac.String() {
+		t.Fatalf("unexpected link-layer address option %v", lladdr)
+	}
+	pi := opts[optionPrefixInfo]
+	switch {
+	case pi == nil:
+		t.Fatalf("missing prefix information")
+	case pi[2] != 64 || pi[3] != prefixFlagOnLink|prefixFlagAutonomous:
+		t.Fatalf("unexpected prefix length or flags")
+	case binary.BigEndian.Uint32(pi[4:]) != validLifetime || binary.BigEndian.Uint32(pi[8:]) != preferredLifetime:
+		t.Fatalf("unexpected prefix lifetimes")
+	case netip.AddrFrom16([16]byte(pi[16:32])) != prefix.Addr():
+		t.Fatalf("unexpected prefix %v", pi[16:32])
+	}
+	ri := opts[optionRouteInfo]
+	if ri == nil || ri[2] != 7 || ri[8] != 0x02 || binary.BigEndian.Uint32(ri[4:]) != routeLifetime {
+		t.Fatalf("unexpected route information %v", ri)
+	}
+	rdnss := opts[optionRecursiveDNS]
+	if rdnss == nil || netip.AddrFrom16([16]byte(rdnss[8:24])) != dns {
+		t.Fatalf("unexpected DNS server option %v", rdnss)
+	}
+
+	// Without a DNS server or a MAC address, i.e. on a point-to-point link.
+	opts = options(advertisement(prefix, nil, netip.Addr{}, false))
+	if opts[optionRecursiveDNS] != nil || opts[optionSourceLinkLayer] != nil {
+		t.Fatalf("unexpected options")
+	}
+
+	// The final advertisement withdraws everything.
+	opts = options(advertisement(prefix, mac, dns, true))
+	if binary.BigEndian.Uint32(opts[optionPrefixInfo][8:]) != 0 ||
+		binary.BigEndian.Uint32(opts[optionRouteInfo][4:]) != 0 ||
+		binary.BigEndian.Uint32(opts[optionRecursiveDNS][4:]) != 0 {
+		t.Fatalf("final advertisement should have zero lifetimes")
+	}
+}
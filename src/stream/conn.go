@@ -0,0 +1,676 @@
+package stream
+
+import (
+	"crypto/ed25519"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Retransmission times, along the lines of RFC 6298.
+const (
+	initialRTO = time.Second
+	minRTO     = 200 * time.Millisecond
+	maxRTO     = time.Minute
+	maxRetries = 8
+)
+
+const (
+	initialWindow   = 10  // Segments
+	maxOutOfOrder   = 256 // Segments kept until the ones before them arrive
+	dupAckThreshold = 3
+	lingerTimeout   = time.Minute // For the remote end to close after Close
+)
+
+type connState uint8
+
+const (
+	stateSynSent connState = iota
+	stateSynReceived
+	stateEstablished
+	stateClosed
+)
+
+type pendingSegment struct {
+	data []byte
+	fin  bool
+}
+
+// Conn is a connection to a port on a remote node. Its methods are safe to
+// call from more than one goroutine.
+type Conn struct {
+	mux      *Mux
+	id       connID
+	remote   ed25519.PublicKey
+	listener *Listener // For accepted connections, until they're established
+	window   uint32    // Size of the send and receive buffers
+	mutex    sync.Mutex
+	state    connState
+	err      error // Why the connection ended, if not by closing both ways
+	closed   bool  // Close was called
+	linger   *time.Timer
+	// Sending, where sequence numbers are as in TCP
+	iss      uint32
+	sndUna   uint32 // Oldest not acknowledged
+	sndNxt   uint32 // Next to send, which goes back when retransmitting
+	sndMax   uint32 // Next to send for the first time
+	sndWnd   uint32 // How much the remote end will accept after sndUna
+	sendBuf  []byte // Data that hasn't been acknowledged, from bufSeq
+	bufSeq   uint32
+	finSent  bool
+	finAcked bool
+	cwnd     uint32
+	ssthresh uint32
+	dupAcks  int
+	rto      time.Duration
+	srtt     time.Duration
+	rttvar   time.Duration
+	rttSeq   uint32 // The round trip time is measured until this is acked
+	rttStart time.Time
+	timing   bool
+	retries  int
+	timer    *time.Timer
+	timerSet bool
+	// Receiving
+	rcvNxt      uint32
+	recvBuf     []byte                    // Received in order but not read yet
+	outOfOrder  map[uint32]pendingSegment // Never overlapping
+	outOfOrderN int                       // Bytes in outOfOrder
+	finReceived bool
+	lastWnd     uint32 // The window that was last advertised
+	// Waiting
+	readable      chan struct{}
+	writable      chan struct{}
+	established   chan struct{} // Closed once established or failed
+	done          chan struct{} // Closed once the connection has ended
+	readDeadline  deadline
+	writeDeadline deadline
+}
+
+func (c *Conn) init() {
+	c.iss = rand.Uint32()
+	c.sndUna, c.sndNxt, c.sndMax = c.iss, c.iss, c.iss
+	c.bufSeq = c.iss + 1
+	c.cwnd = initialWindow * uint32(c.mux.mss)
+	c.ssthresh = math.MaxUint32
+	c.rto = initialRTO
+	c.outOfOrder = make(map[uint32]pendingSegment)
+	c.timer = time.AfterFunc(time.Hour, c.timeout)
+	c.timer.Stop()
+}
+
+// connect sends a SYN to the remote end, which establishes the connection
+// when it is answered.
+func (c *Conn) connect() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.state = stateSynSent
+	c._send(flagSYN, c.iss, nil)
+	c.sndNxt, c.sndMax = c.iss+1, c.iss+1
+	c._arm()
+}
+
+// accept answers the SYN that created the connection for a listener.
+func (c *Conn) accept(seg *segment) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.state = stateSynReceived
+	c.rcvNxt = seg.seq + 1
+	c.sndWnd = seg.window
+	c._send(flagSYN, c.iss, nil)
+	c.sndNxt, c.sndMax = c.iss+1, c.iss+1
+	c._arm()
+}
+
+// failed returns why the connection ended, if it has.
+func (c *Conn) failed() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.state != stateClosed {
+		return nil
+	}
+	if c.err == nil {
+		return net.ErrClosed
+	}
+	return c.err
+}
+
+// abort ends the connection and sends a reset to the remote end.
+func (c *Conn) abort(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.state != stateClosed {
+		c._send(flagRST, c.sndNxt, nil)
+		c._finish(err)
+	}
+}
+
+func (c *Conn) _finish(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	c.err = err
+	c._disarm()
+	if c.linger != nil {
+		c.linger.Stop()
+	}
+	select {
+	case <-c.established:
+	default:
+		close(c.established)
+	}
+	close(c.done)
+	c.mux.remove(c)
+}
+
+func (c *Conn) _send(flags uint8, seq uint32, data []byte) {
+	seg := segment{
+		flags:   flags,
+		dstPort: c.id.remote,
+		srcPort: c.id.local,
+		seq:     seq,
+		window:  c._receiveWindow(),
+		data:    data,
+	}
+	if c.state != stateSynSent {
+		seg.flags |= flagACK
+		seg.ack = c.rcvNxt
+	}
+	c.lastWnd = seg.window
+	_ = c.mux.write(c.remote, seg.marshal())
+}
+
+func (c *Conn) _receiveWindow() uint32 {
+	if c.closed {
+		return c.window // Anything received is thrown away
+	}
+	return c.window - uint32(len(c.recvBuf))
+}
+
+func (c *Conn) _arm() {
+	if !c.timerSet {
+		c.timer.Reset(c.rto)
+		c.timerSet = true
+	}
+}
+
+func (c *Conn) _disarm() {
+	c.timer.Stop()
+	c.timerSet = false
+}
+
+// handle is called with each segment that is received for the connection.
+func (c *Conn) handle(seg *segment) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if seg.flags&flagRST != 0 {
+		c._handleReset(seg)
+		return
+	}
+	switch c.state {
+	case stateClosed:
+		return
+	case stateSynSent:
+		if seg.flags&(flagSYN|flagACK) != flagSYN|flagACK || seg.ack != c.iss+1 {
+			return
+		}
+		c.state = stateEstablished
+		c.rcvNxt = seg.seq + 1
+		c._handleAck(seg)
+		c._send(0, c.sndNxt, nil)
+		close(c.established)
+		return
+	case stateSynReceived:
+		if seg.flags&flagSYN != 0 {
+			// Our SYN-ACK was lost, so send it again
+			if seg.seq+1 == c.rcvNxt {
+				c._send(flagSYN, c.iss, nil)
+			}
+			return
+		}
+		if seg.flags&flagACK == 0 || seg.ack != c.iss+1 {
+			return
+		}
+		c.state = stateEstablished
+		l := c.listener
+		c.mux.established(c)
+		if !l.offer(c) {
+			c._send(flagRST, c.sndNxt, nil)
+			c._finish(ErrRefused)
+			return
+		}
+		close(c.established)
+	}
+	if seg.flags&flagSYN != 0 {
+		// Our ACK of the SYN-ACK was lost
+		c._send(0, c.sndNxt, nil)
+		return
+	}
+	if seg.flags&flagACK != 0 {
+		c._handleAck(seg)
+	}
+	if seg.length() > 0 {
+		c._handleData(seg)
+	}
+	c._output()
+	if c.finAcked && c.finReceived {
+		c._finish(nil)
+	}
+}
+
+func (c *Conn) _handleReset(seg *segment) {
+	switch c.state {
+	case stateClosed:
+	case stateSynSent:
+		if seg.flags&flagACK != 0 && seg.ack == c.iss+1 {
+			c._finish(ErrRefused)
+		}
+	default:
+		// Only in the window, so that an old reset can't end a new connection
+		if seqLEQ(c.rcvNxt, seg.seq) && seqLEQ(seg.seq, c.rcvNxt+c.window) {
+			c._finish(ErrReset)
+		}
+	}
+}
+
+func (c *Conn) _handleAck(seg *segment) {
+	ack := seg.ack
+	if seqLT(ack, c.sndUna) || seqLT(c.sndMax, ack) {
+		return
+	}
+	c.retries = 0
+	if ack == c.sndUna {
+		// Nothing new is acknowledged, which means a segment was lost if it
+		// happens a few times without the window changing
+		if len(seg.data) == 0 && c.sndUna != c.sndMax && seg.window == c.sndWnd {
+			if c.dupAcks++; c.dupAcks == dupAckThreshold {
+				c.ssthresh = c._halfFlight()
+				c.cwnd = c.ssthresh
+				c.timing = false
+				c._retransmitFirst()
+			}
+		}
+		c.sndWnd = seg.window
+		return
+	}
+	acked := ack - c.sndUna
+	if seqLT(c.bufSeq, ack) {
+		n := ack - c.bufSeq
+		if n > uint32(len(c.sendBuf)) {
+			n = uint32(len(c.sendBuf))
+		}
+		c.sendBuf = c.sendBuf[n:]
+		c.bufSeq += n
+		if len(c.sendBuf) == 0 {
+			c.sendBuf = nil
+		}
+	}
+	if c.finSent && len(c.sendBuf) == 0 && ack == c.bufSeq+1 {
+		c.finAcked = true
+	}
+	c.sndUna = ack
+	if seqLT(c.sndNxt, ack) {
+		c.sndNxt = ack
+	}
+	c.sndWnd = seg.window
+	c.dupAcks = 0
+	if c.timing && seqLT(c.rttSeq, ack) {
+		c._updateRTT(time.Since(c.rttStart))
+		c.timing = false
+	}
+	mss := uint32(c.mux.mss)
+	switch {
+	case c.cwnd >= math.MaxUint32/2:
+	case c.cwnd < c.ssthresh:
+		c.cwnd += acked
+	default:
+		c.cwnd += max(mss*mss/c.cwnd, 1)
+	}
+	if c.sndUna == c.sndMax {
+		c._disarm()
+	} else {
+		c._disarm()
+		c._arm()
+	}
+	select {
+	case c.writable <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Conn) _halfFlight() uint32 {
+	return max((c.sndMax-c.sndUna)/2, 2*uint32(c.mux.mss))
+}
+
+func (c *Conn) _updateRTT(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt, c.rttvar = rtt, rtt/2
+	} else {
+		delta := c.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = min(max(c.srtt+4*c.rttvar, minRTO), maxRTO)
+}
+
+// _handleData takes the data and FIN from the segment, in order, keeping any
+// that arrive early until the gap before them is filled. Everything is
+// acknowledged, including what is old or outside of the window, as the
+// remote end may have missed an acknowledgement or be probing the window.
+func (c *Conn) _handleData(seg *segment) {
+	defer c._send(0, c.sndNxt, nil)
+	if c.finReceived {
+		return
+	}
+	seq, data, fin := seg.seq, seg.data, seg.flags&flagFIN != 0
+	if seqLT(seq, c.rcvNxt) {
+		skip := c.rcvNxt - seq
+		if skip > uint32(len(data)) {
+			return
+		}
+		seq, data = c.rcvNxt, data[skip:]
+	}
+	if limit := c.rcvNxt + c._receiveWindow(); seqLT(limit, seq+uint32(len(data))) {
+		if seqLEQ(limit, seq) {
+			return
+		}
+		data, fin = data[:limit-seq], false
+	}
+	if seq != c.rcvNxt {
+		c._keepOutOfOrder(seq, data, fin)
+		return
+	}
+	c._deliver(data, fin)
+	for found := true; found && !c.finReceived; {
+		found = false
+		for seq, pending := range c.outOfOrder {
+			if seqLT(c.rcvNxt, seq) {
+				continue
+			}
+			delete(c.outOfOrder, seq)
+			c.outOfOrderN -= len(pending.data)
+			if end := seq + uint32(len(pending.data)); seqLT(c.rcvNxt, end) || (pending.fin && end == c.rcvNxt) {
+				c._deliver(pending.data[c.rcvNxt-seq:], pending.fin)
+				found = true
+				break
+			}
+		}
+	}
+}
+
+// _keepOutOfOrder keeps a segment that arrived ahead of rcvNxt, without the
+// parts that are kept already, so that what is kept is never more than the
+// receive window however the remote end splits it up.
+func (c *Conn) _keepOutOfOrder(seq uint32, data []byte, fin bool) {
+	end := seq + uint32(len(data))
+	for kept, pending := range c.outOfOrder {
+		keptEnd := kept + uint32(len(pending.data))
+		switch {
+		case seqLEQ(end, kept) || seqLEQ(keptEnd, seq):
+			// No overlap
+		case seqLEQ(kept, seq) && seqLEQ(end, keptEnd):
+			if fin && end == keptEnd {
+				c.outOfOrder[kept] = pendingSegment{pending.data, true}
+			}
+			return // Nothing else new
+		case seqLEQ(seq, kept) && seqLEQ(keptEnd, end):
+			delete(c.outOfOrder, kept)
+			c.outOfOrderN -= len(pending.data)
+		case seqLT(kept, seq):
+			data, seq = data[keptEnd-seq:], keptEnd
+		default:
+			data, end, fin = data[:kept-seq], kept, false
+		}
+	}
+	if len(c.outOfOrder) >= maxOutOfOrder || c.outOfOrderN+len(data) > int(c._receiveWindow()) {
+		return
+	}
+	c.outOfOrder[seq] = pendingSegment{append([]byte(nil), data...), fin}
+	c.outOfOrderN += len(data)
+}
+
+func (c *Conn) _deliver(data []byte, fin bool) {
+	if !c.closed {
+		c.recvBuf = append(c.recvBuf, data...)
+	}
+	c.rcvNxt += uint32(len(data))
+	if fin {
+		c.rcvNxt++
+		c.finReceived = true
+		clear(c.outOfOrder)
+		c.outOfOrderN = 0
+	}
+	select {
+	case c.readable <- struct{}{}:
+	default:
+	}
+}
+
+// _output sends as much data as the windows allow, and the FIN once all of
+// the data is sent after Close.
+func (c *Conn) _output() {
+	if c.state != stateEstablished {
+		return
+	}
+	end := c.bufSeq + uint32(len(c.sendBuf))
+	for seqLT(c.sndNxt, end) {
+		flight, limit := c.sndNxt-c.sndUna, min(c.sndWnd, c.cwnd)
+		if flight >= limit {
+			break
+		}
+		n := min(end-c.sndNxt, limit-flight, uint32(c.mux.mss))
+		offset := c.sndNxt - c.bufSeq
+		c._send(0, c.sndNxt, c.sendBuf[offset:offset+n])
+		if !c.timing && c.sndNxt == c.sndMax {
+			// Only time new data, as an ack for a retransmission is ambiguous
+			c.timing, c.rttSeq, c.rttStart = true, c.sndNxt, time.Now()
+		}
+		c.sndNxt += n
+		if seqLT(c.sndMax, c.sndNxt) {
+			c.sndMax = c.sndNxt
+		}
+	}
+	if c.closed && c.sndNxt == end {
+		c._send(flagFIN, c.sndNxt, nil)
+		c.sndNxt++
+		c.finSent = true
+		if seqLT(c.sndMax, c.sndNxt) {
+			c.sndMax = c.sndNxt
+		}
+	}
+	if c.sndUna != c.sndMax || seqLT(c.sndNxt, end) {
+		c._arm()
+	}
+}
+
+func (c *Conn) _retransmitFirst() {
+	if len(c.sendBuf) > 0 {
+		n := min(len(c.sendBuf), c.mux.mss)
+		c._send(0, c.sndUna, c.sendBuf[:n])
+	} else if c.finSent {
+		c._send(flagFIN, c.sndUna, nil)
+	}
+}
+
+// timeout is called when nothing has been acknowledged for a while, to send
+// the oldest segment again, or to probe the window if the remote end has
+// run out of buffer space and its update may have been lost.
+func (c *Conn) timeout() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.timerSet = false
+	if c.state == stateClosed {
+		return
+	}
+	if c.retries++; c.retries > maxRetries {
+		c._finish(ErrTimedOut)
+		return
+	}
+	c.rto = min(2*c.rto, maxRTO)
+	c.timing = false
+	switch {
+	case c.state != stateEstablished:
+		c._send(flagSYN, c.iss, nil)
+		c._arm()
+	case c.sndUna == c.sndNxt && c.sndWnd == 0:
+		if end := c.bufSeq + uint32(len(c.sendBuf)); seqLT(c.sndNxt, end) {
+			offset := c.sndNxt - c.bufSeq
+			c._send(0, c.sndNxt, c.sendBuf[offset:offset+1])
+			if seqLT(c.sndMax, c.sndNxt+1) {
+				c.sndMax = c.sndNxt + 1
+			}
+			c._arm()
+		}
+	case c.sndUna != c.sndMax:
+		c.ssthresh = c._halfFlight()
+		c.cwnd = uint32(c.mux.mss)
+		c.dupAcks = 0
+		c.sndNxt = c.sndUna
+		if c.finSent && len(c.sendBuf) == 0 {
+			c.finSent = false
+		}
+		c._output()
+	}
+}
+
+// Read reads data from the connection, returning io.EOF once the remote end
+// has closed it and everything it sent has been read.
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		select {
+		case <-c.readDeadline.done():
+			return 0, os.ErrDeadlineExceeded
+		default:
+		}
+		c.mutex.Lock()
+		switch {
+		case c.closed:
+			c.mutex.Unlock()
+			return 0, net.ErrClosed
+		case len(c.recvBuf) > 0:
+			n := copy(b, c.recvBuf)
+			if c.recvBuf = c.recvBuf[n:]; len(c.recvBuf) == 0 {
+				c.recvBuf = nil
+			}
+			// Tell the remote end once there is room for more
+			if c.state == stateEstablished && c.lastWnd < c.window/2 && c._receiveWindow() >= c.window/2 {
+				c._send(0, c.sndNxt, nil)
+			}
+			c.mutex.Unlock()
+			return n, nil
+		case c.finReceived:
+			c.mutex.Unlock()
+			return 0, io.EOF
+		case c.state == stateClosed:
+			err := c.err
+			c.mutex.Unlock()
+			return 0, err
+		}
+		c.mutex.Unlock()
+		select {
+		case <-c.readable:
+		case <-c.done:
+		case <-c.readDeadline.done():
+		}
+	}
+}
+
+// Write writes data to the connection, blocking while the send buffer is
+// full.
+func (c *Conn) Write(b []byte) (int, error) {
+	var written int
+	for written < len(b) {
+		select {
+		case <-c.writeDeadline.done():
+			return written, os.ErrDeadlineExceeded
+		default:
+		}
+		c.mutex.Lock()
+		switch {
+		case c.closed:
+			c.mutex.Unlock()
+			return written, net.ErrClosed
+		case c.state == stateClosed:
+			err := c.err
+			c.mutex.Unlock()
+			if err == nil {
+				err = net.ErrClosed
+			}
+			return written, err
+		}
+		if space := int(c.window) - len(c.sendBuf); space > 0 {
+			n := min(space, len(b)-written)
+			c.sendBuf = append(c.sendBuf, b[written:written+n]...)
+			written += n
+			c._output()
+			c.mutex.Unlock()
+			continue
+		}
+		c.mutex.Unlock()
+		select {
+		case <-c.writable:
+		case <-c.done:
+		case <-c.writeDeadline.done():
+		}
+	}
+	return written, nil
+}
+
+// Close closes the connection once everything written so far has been sent.
+// Anything received afterwards is thrown away. If the remote end doesn't
+// close it too within a minute then it is reset.
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.recvBuf = nil
+	for _, ch := range []chan struct{}{c.readable, c.writable} {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	if c.state == stateClosed {
+		return nil
+	}
+	c._output()
+	c.linger = time.AfterFunc(lingerTimeout, func() {
+		c.abort(ErrTimedOut)
+	})
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return &Addr{Key: c.mux.core.PublicKey(), Port: c.id.local}
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return &Addr{Key: c.remote, Port: c.id.remote}
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
@@ -0,0 +1,61 @@
+package stream
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline is a channel which is closed when a deadline passes, so that
+// blocked reads or writes can wait for it alongside other things.
+type deadline struct {
+	mutex   sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+	gen     uint64 // Changes when the deadline does, to ignore old timers
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.gen++
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	select {
+	case <-d.wait():
+		d.expired = make(chan struct{})
+	default:
+	}
+	if t.IsZero() {
+		return
+	}
+	wait := time.Until(t)
+	if wait <= 0 {
+		close(d.expired)
+		return
+	}
+	gen := d.gen
+	d.timer = time.AfterFunc(wait, func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if d.gen == gen {
+			close(d.expired)
+		}
+	})
+}
+
+// wait returns the channel, making it if needed. The mutex must be held.
+func (d *deadline) wait() chan struct{} {
+	if d.expired == nil {
+		d.expired = make(chan struct{})
+	}
+	return d.expired
+}
+
+// done returns a channel which is closed once the deadline passes.
+func (d *deadline) done() <-chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.wait()
+}
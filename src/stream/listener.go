@@ -0,0 +1,69 @@
+package stream
+
+import (
+	"net"
+	"sync"
+)
+
+// Listener accepts connections to a port.
+type Listener struct {
+	mux    *Mux
+	port   uint16
+	mutex  sync.Mutex
+	accept chan *Conn
+	closed chan struct{}
+	syns   int // Connections that aren't established yet, under the Mux mutex
+}
+
+// Accept waits for the next connection to the port.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections and resets any that haven't been
+// accepted yet. Connections that were already accepted stay open.
+func (l *Listener) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	select {
+	case <-l.closed:
+		return net.ErrClosed
+	default:
+	}
+	close(l.closed)
+	l.mux.mutex.Lock()
+	delete(l.mux.listeners, l.port)
+	l.mux.mutex.Unlock()
+	for {
+		select {
+		case c := <-l.accept:
+			go c.abort(net.ErrClosed)
+		default:
+			return nil
+		}
+	}
+}
+
+func (l *Listener) Addr() net.Addr {
+	return &Addr{Key: l.mux.core.PublicKey(), Port: l.port}
+}
+
+// offer passes a newly established connection to Accept, returning false if
+// the listener is closed or too many are waiting already.
+func (l *Listener) offer(c *Conn) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	select {
+	case <-l.closed:
+		return false
+	case l.accept <- c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,19 @@
+package stream
+
+func (m *Mux) _applyOption(opt SetupOption) {
+	switch v := opt.(type) {
+	case WindowSize:
+		m.config.window = v
+	}
+}
+
+type SetupOption interface {
+	isSetupOption()
+}
+
+// WindowSize is the most data in bytes that is buffered for each connection
+// in each direction, which limits how much can be in flight at once. The
+// default is 1MiB.
+type WindowSize uint32
+
+func (a WindowSize) isSetupOption() {}
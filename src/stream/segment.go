@@ -0,0 +1,70 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Segment flags, which mean the same as they do in TCP. SYN and FIN each take
+// up one sequence number, so that they are acknowledged like data.
+const (
+	flagSYN = 1 << iota
+	flagACK
+	flagFIN
+	flagRST
+)
+
+const headerSize = 17
+
+// segment is one stream packet, which is sent from the source port on one
+// node to the destination port on another.
+type segment struct {
+	flags   uint8
+	dstPort uint16
+	srcPort uint16
+	seq     uint32 // Of the first byte of data, or of the SYN or FIN
+	ack     uint32 // The next sequence number expected, if flagACK is set
+	window  uint32 // How much more data can be sent after ack
+	data    []byte
+}
+
+func (s *segment) marshal() []byte {
+	bs := make([]byte, headerSize, headerSize+len(s.data))
+	bs[0] = s.flags
+	binary.BigEndian.PutUint16(bs[1:], s.dstPort)
+	binary.BigEndian.PutUint16(bs[3:], s.srcPort)
+	binary.BigEndian.PutUint32(bs[5:], s.seq)
+	binary.BigEndian.PutUint32(bs[9:], s.ack)
+	binary.BigEndian.PutUint32(bs[13:], s.window)
+	return append(bs, s.data...)
+}
+
+func (s *segment) unmarshal(bs []byte) error {
+	if len(bs) < headerSize {
+		return errors.New("segment is too short")
+	}
+	s.flags = bs[0]
+	s.dstPort = binary.BigEndian.Uint16(bs[1:])
+	s.srcPort = binary.BigEndian.Uint16(bs[3:])
+	s.seq = binary.BigEndian.Uint32(bs[5:])
+	s.ack = binary.BigEndian.Uint32(bs[9:])
+	s.window = binary.BigEndian.Uint32(bs[13:])
+	s.data = bs[headerSize:]
+	return nil
+}
+
+// length returns how many sequence numbers the segment takes up.
+func (s *segment) length() uint32 {
+	n := uint32(len(s.data))
+	if s.flags&flagSYN != 0 {
+		n++
+	}
+	if s.flags&flagFIN != 0 {
+		n++
+	}
+	return n
+}
+
+// Sequence numbers wrap around, so are compared by their difference.
+func seqLT(a, b uint32) bool  { return int32(a-b) < 0 }
+func seqLEQ(a, b uint32) bool { return int32(a-b) <= 0 }
@@ -0,0 +1,281 @@
+// Package stream provides reliable, ordered connections between nodes, like
+// TCP but without needing an IP stack, so that applications which embed a
+// node can talk to others by public key. Connections go to a port on the
+// remote node, so that many can share a session, and implement net.Conn.
+//
+// Once a Mux is created, the core receives stream packets by itself, so an
+// application doesn't need to call ReadFrom unless it wants the IP traffic
+// too.
+package stream
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+const (
+	defaultWindowSize = 1 << 20
+	maxSegmentSize    = 16 << 10
+	firstEphemeral    = 49152
+	acceptBacklog     = 64
+)
+
+var (
+	ErrRefused  = errors.New("connection refused")
+	ErrReset    = errors.New("connection reset by peer")
+	ErrTimedOut = errors.New("connection timed out")
+	ErrPortUsed = errors.New("port is already in use")
+)
+
+type keyArray [ed25519.PublicKeySize]byte
+
+// connID identifies a connection from the point of view of this node.
+type connID struct {
+	key    keyArray
+	local  uint16
+	remote uint16
+}
+
+// Mux sends and receives the stream packets for all connections on a node.
+// There can only be one for each core.
+type Mux struct {
+	core      *core.Core
+	log       core.Logger
+	mss       int // Largest amount of data to send in a segment
+	write     func(ed25519.PublicKey, []byte) error
+	mutex     sync.Mutex
+	closed    bool
+	conns     map[connID]*Conn
+	listeners map[uint16]*Listener
+	config    struct {
+		window WindowSize
+	}
+}
+
+// Addr is the address of one end of a connection.
+type Addr struct {
+	Key  ed25519.PublicKey
+	Port uint16
+}
+
+func (a *Addr) Network() string { return "yggdrasil" }
+func (a *Addr) String() string  { return fmt.Sprintf("%s:%d", hex.EncodeToString(a.Key), a.Port) }
+
+// New starts handling stream packets for the core.
+func New(c *core.Core, log core.Logger, opts ...SetupOption) (*Mux, error) {
+	m := &Mux{
+		core:      c,
+		log:       log,
+		write:     c.WriteStream,
+		conns:     make(map[connID]*Conn),
+		listeners: make(map[uint16]*Listener),
+	}
+	m.config.window = defaultWindowSize
+	for _, opt := range opts {
+		m._applyOption(opt)
+	}
+	if m.config.window < maxSegmentSize {
+		return nil, fmt.Errorf("window size must be at least %d", maxSegmentSize)
+	}
+	m.mss = int(c.MTU()) - headerSize
+	if m.mss > maxSegmentSize {
+		m.mss = maxSegmentSize
+	}
+	c.SetStreamHandler(m.handle)
+	return m, nil
+}
+
+// Close stops handling stream packets, closes all listeners and resets all
+// connections.
+func (m *Mux) Close() error {
+	if m == nil {
+		return nil
+	}
+	m.core.SetStreamHandler(nil)
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return net.ErrClosed
+	}
+	m.closed = true
+	listeners := make([]*Listener, 0, len(m.listeners))
+	for _, l := range m.listeners {
+		listeners = append(listeners, l)
+	}
+	conns := make([]*Conn, 0, len(m.conns))
+	for _, c := range m.conns {
+		conns = append(conns, c)
+	}
+	m.mutex.Unlock()
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+	for _, c := range conns {
+		c.abort(net.ErrClosed)
+	}
+	return nil
+}
+
+// Dial opens a connection to the port on the remote node, waiting until it
+// has accepted it or the context is done.
+func (m *Mux) Dial(ctx context.Context, key ed25519.PublicKey, port uint16) (net.Conn, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key")
+	}
+	var remote keyArray
+	copy(remote[:], key)
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return nil, net.ErrClosed
+	}
+	id := connID{key: remote, remote: port}
+	for {
+		id.local = uint16(firstEphemeral + rand.Intn(65536-firstEphemeral))
+		if _, ok := m.conns[id]; !ok && m.listeners[id.local] == nil {
+			break
+		}
+	}
+	c := m._newConn(id)
+	m.mutex.Unlock()
+	c.connect()
+	select {
+	case <-c.established:
+	case <-ctx.Done():
+		c.abort(ctx.Err())
+		return nil, ctx.Err()
+	}
+	if err := c.failed(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Listen accepts connections to the port, or to a random port if it is 0.
+func (m *Mux) Listen(port uint16) (net.Listener, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return nil, net.ErrClosed
+	}
+	for port == 0 {
+		port = uint16(firstEphemeral + rand.Intn(65536-firstEphemeral))
+		if m.listeners[port] != nil {
+			port = 0
+		}
+	}
+	if m.listeners[port] != nil {
+		return nil, ErrPortUsed
+	}
+	l := &Listener{
+		mux:    m,
+		port:   port,
+		accept: make(chan *Conn, acceptBacklog),
+		closed: make(chan struct{}),
+	}
+	m.listeners[port] = l
+	return l, nil
+}
+
+func (m *Mux) _newConn(id connID) *Conn {
+	c := &Conn{
+		mux:         m,
+		id:          id,
+		remote:      append(ed25519.PublicKey(nil), id.key[:]...),
+		window:      uint32(m.config.window),
+		readable:    make(chan struct{}, 1),
+		writable:    make(chan struct{}, 1),
+		established: make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	c.init()
+	m.conns[id] = c
+	return c
+}
+
+func (m *Mux) remove(c *Conn) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.conns[c.id] == c {
+		delete(m.conns, c.id)
+	}
+	m._established(c)
+}
+
+// established is called, with the connection's mutex held, once a connection
+// for a listener is established, so that it no longer counts as a SYN.
+func (m *Mux) established(c *Conn) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m._established(c)
+}
+
+func (m *Mux) _established(c *Conn) {
+	if c.listener != nil {
+		c.listener.syns--
+		c.listener = nil
+	}
+}
+
+// handle is called by the core with each stream packet in the order they
+// arrive, so it only passes them on to the connection that they are for.
+func (m *Mux) handle(key ed25519.PublicKey, bs []byte) {
+	var seg segment
+	if err := seg.unmarshal(bs); err != nil {
+		return
+	}
+	id := connID{local: seg.dstPort, remote: seg.srcPort}
+	copy(id.key[:], key)
+	m.mutex.Lock()
+	c, accepted := m.conns[id], false
+	if c == nil && !m.closed && seg.flags == flagSYN {
+		if l := m.listeners[seg.dstPort]; l != nil {
+			if l.syns >= acceptBacklog {
+				// Only so many connections can be waiting to be established
+				// for each listener. The remote end will send the SYN again.
+				m.mutex.Unlock()
+				return
+			}
+			c, accepted = m._newConn(id), true
+			c.listener = l
+			l.syns++
+		}
+	}
+	m.mutex.Unlock()
+	switch {
+	case c == nil:
+		m.reset(key, &seg)
+	case accepted:
+		c.accept(&seg)
+	default:
+		c.handle(&seg)
+	}
+}
+
+// reset answers a segment that isn't for any connection with a reset, so
+// that the remote end doesn't keep trying.
+func (m *Mux) reset(key ed25519.PublicKey, seg *segment) {
+	if seg.flags&flagRST != 0 {
+		return
+	}
+	rst := segment{
+		flags:   flagRST,
+		dstPort: seg.srcPort,
+		srcPort: seg.dstPort,
+	}
+	if seg.flags&flagACK != 0 {
+		rst.seq = seg.ack
+	} else {
+		rst.flags |= flagACK
+		rst.ack = seg.seq + seg.length()
+	}
+	_ = m.write(key, rst.marshal())
+}
@@ -0,0 +1,296 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/config"
+	"github.com/yggdrasil-network/yggdrasil-go/src/core"
+)
+
+// newMuxes creates two peered nodes with a Mux each. Nothing calls ReadFrom,
+// as the core receives stream packets by itself.
+func newMuxes(t *testing.T) (*Mux, *Mux) {
+	t.Helper()
+	logger := log.New(io.Discard, "", 0)
+	var nodes [2]*core.Core
+	var muxes [2]*Mux
+	for i := range nodes {
+		cfg := config.GenerateConfig()
+		node, err := core.New(cfg.Certificate, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(node.Stop)
+		if muxes[i], err = New(node, logger); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = muxes[i].Close() })
+		nodes[i] = node
+	}
+	l, err := nodes[0].Listen(&url.URL{Scheme: "tcp", Host: "127.0.0.1:0"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = nodes[1].CallPeer(&url.URL{Scheme: "tcp", Host: l.Addr().String()}, ""); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; len(nodes[0].GetTree()) < 2 || len(nodes[1].GetTree()) < 2; i++ {
+		if i == 50 {
+			t.Fatal("nodes didn't connect")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return muxes[0], muxes[1]
+}
+
+func dial(t *testing.T, m *Mux, key ed25519.PublicKey, port uint16) net.Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := m.Dial(ctx, key, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// echo sends data over a connection to an echo server and checks that the
+// same comes back, and that the connection then closes cleanly.
+func echo(t *testing.T, conn net.Conn, size int) error {
+	data := make([]byte, size)
+	_, _ = rand.Read(data)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(data)
+		errs <- err
+	}()
+	received := make([]byte, size)
+	if _, err := io.ReadFull(conn, received); err != nil {
+		return err
+	}
+	if err := <-errs; err != nil {
+		return err
+	}
+	if !bytes.Equal(data, received) {
+		return errors.New("echoed data is different")
+	}
+	return conn.Close()
+}
+
+func serveEcho(t *testing.T, m *Mux, port uint16) {
+	t.Helper()
+	l, err := m.Listen(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+}
+
+func TestStream(t *testing.T) {
+	server, client := newMuxes(t)
+	serveEcho(t, server, 7)
+
+	conn := dial(t, client, server.core.PublicKey(), 7)
+	if addr := conn.RemoteAddr().(*Addr); !addr.Key.Equal(server.core.PublicKey()) || addr.Port != 7 {
+		t.Fatalf("unexpected remote address %s", addr)
+	}
+	if err := echo(t, conn, 4<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	// Connections are multiplexed over the session.
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		conn := dial(t, client, server.core.PublicKey(), 7)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- echo(t, conn, 256<<10)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Closed connections are removed once both ends have closed.
+	for i := 0; ; i++ {
+		server.mutex.Lock()
+		open := len(server.conns)
+		server.mutex.Unlock()
+		if open == 0 {
+			break
+		} else if i == 50 {
+			t.Fatalf("%d connections weren't removed", open)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := client.Dial(ctx, server.core.PublicKey(), 8); !errors.Is(err, ErrRefused) {
+		t.Fatalf("expected the connection to be refused, got %v", err)
+	}
+	if _, err := server.Listen(7); !errors.Is(err, ErrPortUsed) {
+		t.Fatalf("expected the port to be in use, got %v", err)
+	}
+}
+
+func TestStreamLoss(t *testing.T) {
+	server, client := newMuxes(t)
+	serveEcho(t, server, 7)
+
+	// Drop some of the segments each way once the connection is established.
+	var dropping atomic.Bool
+	for _, m := range []*Mux{server, client} {
+		write := m.write
+		var mutex sync.Mutex
+		random := mrand.New(mrand.NewSource(1))
+		m.write = func(key ed25519.PublicKey, bs []byte) error {
+			mutex.Lock()
+			drop := dropping.Load() && random.Intn(20) == 0
+			mutex.Unlock()
+			if drop {
+				return nil
+			}
+			return write(key, bs)
+		}
+	}
+	conn := dial(t, client, server.core.PublicKey(), 7)
+	dropping.Store(true)
+	_ = conn.SetDeadline(time.Now().Add(time.Minute))
+	if err := echo(t, conn, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestConn makes an established connection which doesn't send anything.
+func newTestConn(t *testing.T, window WindowSize) *Conn {
+	m := &Mux{
+		mss:       1000,
+		write:     func(ed25519.PublicKey, []byte) error { return nil },
+		conns:     make(map[connID]*Conn),
+		listeners: make(map[uint16]*Listener),
+	}
+	m.config.window = window
+	c := m._newConn(connID{})
+	c.state = stateEstablished
+	c.sndUna, c.sndNxt, c.sndMax = c.iss+1, c.iss+1, c.iss+1
+	c.sndWnd = c.window
+	t.Cleanup(func() { c.abort(net.ErrClosed) })
+	return c
+}
+
+func TestStreamOutOfOrder(t *testing.T) {
+	c := newTestConn(t, 16<<10)
+	data := make([]byte, 12<<10)
+	_, _ = rand.Read(data)
+	// Everything but the first byte, overlapping and in pieces, more than
+	// once over.
+	for i := 0; i < 3; i++ {
+		for offset := 1; offset < len(data); offset += 7 {
+			end := min(offset+1000, len(data))
+			c.handle(&segment{seq: c.rcvNxt + uint32(offset), data: data[offset:end]})
+			if c.outOfOrderN > int(c.window) {
+				t.Fatalf("%d bytes are kept out of order", c.outOfOrderN)
+			}
+		}
+	}
+	if c.outOfOrderN != len(data)-1 {
+		t.Fatalf("expected %d bytes out of order, got %d", len(data)-1, c.outOfOrderN)
+	}
+	c.handle(&segment{seq: c.rcvNxt, data: data[:1]})
+	if !bytes.Equal(c.recvBuf, data) || c.outOfOrderN != 0 || len(c.outOfOrder) != 0 {
+		t.Fatalf("the data wasn't put back together")
+	}
+
+	// Nothing past the receive window is kept.
+	c = newTestConn(t, 16<<10)
+	for offset := 1; offset < 64<<10; offset += 1000 {
+		c.handle(&segment{seq: c.rcvNxt + uint32(offset), data: make([]byte, 1000)})
+	}
+	if c.outOfOrderN > int(c.window) {
+		t.Fatalf("%d bytes are kept out of order", c.outOfOrderN)
+	}
+}
+
+func TestStreamSYNBacklog(t *testing.T) {
+	c := newTestConn(t, defaultWindowSize)
+	m := c.mux
+	l := &Listener{mux: m, port: 7, accept: make(chan *Conn, acceptBacklog), closed: make(chan struct{})}
+	m.listeners[7] = l
+	key := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	for i := 0; i < 2*acceptBacklog; i++ {
+		seg := segment{flags: flagSYN, dstPort: 7, srcPort: uint16(firstEphemeral + i)}
+		m.handle(key, seg.marshal())
+	}
+	if l.syns != acceptBacklog || len(m.conns) != acceptBacklog+1 {
+		t.Fatalf("expected %d SYNs to be answered, got %d", acceptBacklog, l.syns)
+	}
+	for _, c := range m.conns {
+		c.abort(ErrReset)
+	}
+	if l.syns != 0 {
+		t.Fatalf("%d SYNs are still counted", l.syns)
+	}
+}
+
+func TestSegment(t *testing.T) {
+	seg := segment{
+		flags:   flagACK | flagFIN,
+		dstPort: 80,
+		srcPort: 50000,
+		seq:     0xfffffff0,
+		ack:     12345,
+		window:  1 << 20,
+		data:    []byte("hello"),
+	}
+	var decoded segment
+	if err := decoded.unmarshal(seg.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.flags != seg.flags || decoded.dstPort != seg.dstPort || decoded.srcPort != seg.srcPort ||
+		decoded.seq != seg.seq || decoded.ack != seg.ack || decoded.window != seg.window ||
+		!bytes.Equal(decoded.data, seg.data) {
+		t.Fatalf("unexpected segment %+v", decoded)
+	}
+	if seg.length() != 6 {
+		t.Fatalf("the FIN should take a sequence number")
+	}
+	if !seqLT(seg.seq, seg.seq+uint32(len(seg.data))+20) {
+		t.Fatalf("sequence numbers should wrap around")
+	}
+	if err := decoded.unmarshal(make([]byte, headerSize-1)); err == nil {
+		t.Fatalf("expected an error for a short segment")
+	}
+}
@@ -8,9 +8,22 @@ import (
 
 type GetTUNRequest struct{}
 type GetTUNResponse struct {
-	Enabled bool   `json:"enabled"`
-	Name    string `json:"name,omitempty"`
-	MTU     uint64 `json:"mtu,omitempty"`
+	Enabled bool            `json:"enabled"`
+	Name    string          `json:"name,omitempty"`
+	MTU     uint64          `json:"mtu,omitempty"`
+	Offload bool            `json:"offload,omitempty"` // GSO and GRO with virtio-net headers
+	Queues  []TUNQueueEntry `json:"queues,omitempty"`
+}
+
+type TUNQueueEntry struct {
+	RXPackets uint64         `json:"rx_packets"`
+	RXBytes   admin.DataUnit `json:"bytes_recvd"`
+	RXDropped uint64         `json:"rx_dropped"`
+	RXRate    admin.DataUnit `json:"rate_recvd"`
+	TXPackets uint64         `json:"tx_packets"`
+	TXBytes   admin.DataUnit `json:"bytes_sent"`
+	TXErrors  uint64         `json:"tx_errors"`
+	TXRate    admin.DataUnit `json:"rate_sent"`
 }
 
 type TUNEntry struct {
@@ -24,6 +37,19 @@ func (t *TunAdapter) getTUNHandler(req *GetTUNRequest, res *GetTUNResponse) erro
 	}
 	res.Name = t.Name()
 	res.MTU = t.MTU()
+	res.Offload = t.iface.BatchSize() > 1
+	for _, s := range t.QueueStatistics() {
+		res.Queues = append(res.Queues, TUNQueueEntry{
+			RXPackets: s.RXPackets,
+			RXBytes:   admin.DataUnit(s.RXBytes),
+			RXDropped: s.RXDropped,
+			RXRate:    admin.DataUnit(s.RXRate),
+			TXPackets: s.TXPackets,
+			TXBytes:   admin.DataUnit(s.TXBytes),
+			TXErrors:  s.TXErrors,
+			TXRate:    admin.DataUnit(s.TXRate),
+		})
+	}
 	return nil
 }
 
@@ -1,22 +1,24 @@
 package tun
 
 import (
+	"encoding/binary"
 	"errors"
+	"time"
 
 	wgtun "golang.zx2c4.com/wireguard/tun"
 )
 
 const TUN_OFFSET_BYTES = 80 // sizeof(virtio_net_hdr)
 
-func (tun *TunAdapter) read() {
-	vs := tun.iface.BatchSize()
+func (tun *TunAdapter) read(q *tunQueue) {
+	vs := q.iface.BatchSize()
 	bufs := make([][]byte, vs)
 	sizes := make([]int, vs)
 	for i := range bufs {
 		bufs[i] = make([]byte, TUN_OFFSET_BYTES+65535)
 	}
 	for {
-		n, err := tun.iface.Read(bufs, sizes, TUN_OFFSET_BYTES)
+		n, err := q.iface.Read(bufs, sizes, TUN_OFFSET_BYTES)
 		if err != nil {
 			if errors.Is(err, wgtun.ErrTooManySegments) {
 				tun.log.Debugln("TUN segments dropped: %v", err)
@@ -26,7 +28,10 @@ func (tun *TunAdapter) read() {
 			return
 		}
 		for i, b := range bufs[:n] {
+			q.stats.rxPackets.Add(1)
+			q.stats.rxBytes.Add(uint64(sizes[i]))
 			if _, err := tun.rwc.Write(b[TUN_OFFSET_BYTES : TUN_OFFSET_BYTES+sizes[i]]); err != nil {
+				q.stats.rxDropped.Add(1)
 				tun.log.Debugln("Unable to send packet:", err)
 			}
 		}
@@ -41,37 +46,104 @@ func (tun *TunAdapter) queue() {
 			tun.log.Errorln("Exiting TUN writer due to core read error:", err)
 			return
 		}
-		if tun.ch != nil {
-			tun.ch <- p[:n]
+		switch len(tun.queues) {
+		case 0:
+			bufPool.Put(p) // nolint:staticcheck
+		case 1:
+			tun.queues[0].ch <- p[:n]
+		default:
+			// Keep each flow on one queue, so that its packets stay in order
+			q := tun.queues[flowHash(p[:n])%uint32(len(tun.queues))]
+			q.ch <- p[:n]
 		}
 	}
 }
 
-func (tun *TunAdapter) write() {
-	vs := cap(tun.ch)
+func (tun *TunAdapter) write(q *tunQueue) {
+	vs := cap(q.ch)
 	bufs := make([][]byte, vs)
 	for i := range bufs {
 		bufs[i] = make([]byte, TUN_OFFSET_BYTES+65535)
 	}
 	for {
-		n := len(tun.ch)
+		n := len(q.ch)
 		if n == 0 {
 			n = 1 // Nothing queued up yet, wait for it instead
 		}
 		for i := 0; i < n; i++ {
-			msg := <-tun.ch
+			msg := <-q.ch
 			bufs[i] = append(bufs[i][:TUN_OFFSET_BYTES], msg...)
 			bufPool.Put(msg) // nolint:staticcheck
 		}
 		if !tun.isEnabled {
 			continue // Nothing to do, the tun isn't enabled
 		}
-		if _, err := tun.iface.Write(bufs[:n], TUN_OFFSET_BYTES); err != nil {
+		written, err := q.iface.Write(bufs[:n], TUN_OFFSET_BYTES)
+		if err != nil {
 			tun.Act(nil, func() {
 				if !tun.isOpen {
 					tun.log.Errorln("TUN iface write error:", err)
 				}
 			})
+		} else {
+			written = n
+		}
+		written = min(max(written, 0), n)
+		for _, b := range bufs[:written] {
+			q.stats.txBytes.Add(uint64(len(b) - TUN_OFFSET_BYTES))
+		}
+		q.stats.txPackets.Add(uint64(written))
+		q.stats.txErrors.Add(uint64(n - written))
+	}
+}
+
+// flowHash returns a hash of the addresses, protocol and, for TCP and UDP,
+// the ports of an IPv4 or IPv6 packet. Ports are left out of fragmented
+// packets, so that all of the fragments hash the same.
+func flowHash(bs []byte) uint32 {
+	var addrs, ports []byte
+	var protocol byte
+	switch {
+	case len(bs) >= 20 && bs[0]>>4 == 4:
+		addrs, protocol = bs[12:20], bs[9]
+		ihl := int(bs[0]&0x0f) * 4
+		if len(bs) >= ihl+4 && binary.BigEndian.Uint16(bs[6:8])&0x3fff == 0 {
+			ports = bs[ihl : ihl+4]
+		}
+	case len(bs) >= 40 && bs[0]>>4 == 6:
+		addrs, protocol = bs[8:40], bs[6]
+		if len(bs) >= 44 {
+			ports = bs[40:44]
 		}
+	default:
+		return 0
+	}
+	if protocol != 6 && protocol != 17 {
+		ports = nil
+	}
+	// FNV-1a
+	h := uint32(2166136261)
+	for _, b := range addrs {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	h = (h ^ uint32(protocol)) * 16777619
+	for _, b := range ports {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	return h
+}
+
+func (tun *TunAdapter) _updateRates() {
+	if !tun.isOpen {
+		return
+	}
+	for _, q := range tun.queues {
+		rx, tx := q.stats.rxBytes.Load(), q.stats.txBytes.Load()
+		q.stats.rxRate.Store(rx - q.lastRX)
+		q.stats.txRate.Store(tx - q.lastTX)
+		q.lastRX, q.lastTX = rx, tx
 	}
+	time.AfterFunc(time.Second, func() {
+		tun.Act(nil, tun._updateRates)
+	})
 }
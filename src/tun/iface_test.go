@@ -0,0 +1,48 @@
+package tun
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestFlowHash(t *testing.T) {
+	udp := func(version byte, srcPort, dstPort uint16) []byte {
+		var bs []byte
+		if version == 6 {
+			bs = make([]byte, 40+8)
+			bs[0], bs[6] = 0x60, 17
+			binary.BigEndian.PutUint16(bs[40:], srcPort)
+			binary.BigEndian.PutUint16(bs[42:], dstPort)
+		} else {
+			bs = make([]byte, 20+8)
+			bs[0], bs[9] = 0x45, 17
+			binary.BigEndian.PutUint16(bs[20:], srcPort)
+			binary.BigEndian.PutUint16(bs[22:], dstPort)
+		}
+		return bs
+	}
+	for _, version := range []byte{4, 6} {
+		a, b := udp(version, 1000, 53), udp(version, 1001, 53)
+		if flowHash(a) != flowHash(udp(version, 1000, 53)) {
+			t.Fatalf("IPv%d: the same flow should hash the same", version)
+		}
+		if flowHash(a) == flowHash(b) {
+			t.Fatalf("IPv%d: flows on different ports should hash differently", version)
+		}
+		a[len(a)-1], b[len(b)-1] = 1, 2 // Payload
+		if flowHash(a) != flowHash(udp(version, 1000, 53)) {
+			t.Fatalf("IPv%d: the payload shouldn't affect the hash", version)
+		}
+	}
+
+	// Fragments of a packet hash the same, with or without the ports.
+	first, later := udp(4, 1000, 53), udp(4, 2000, 80)
+	binary.BigEndian.PutUint16(first[6:8], 0x2000) // More fragments
+	binary.BigEndian.PutUint16(later[6:8], 0x0010) // Offset
+	if flowHash(first) != flowHash(later) {
+		t.Fatalf("fragments should hash the same")
+	}
+	if flowHash([]byte{0x60, 0}) != 0 || flowHash(nil) != 0 {
+		t.Fatalf("truncated packets should hash to 0")
+	}
+}
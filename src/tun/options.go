@@ -1,13 +1,19 @@
 package tun
 
+import "net/netip"
+
 func (m *TunAdapter) _applyOption(opt SetupOption) {
 	switch v := opt.(type) {
 	case InterfaceName:
 		m.config.name = v
 	case InterfaceMTU:
 		m.config.mtu = v
+	case InterfaceQueues:
+		m.config.queues = v
 	case FileDescriptor:
 		m.config.fd = int32(v)
+	case InterfaceRoute:
+		m.config.routes = append(m.config.routes, netip.Prefix(v))
 	}
 }
 
@@ -17,8 +23,12 @@ type SetupOption interface {
 
 type InterfaceName string
 type InterfaceMTU uint64
+type InterfaceQueues uint64 // Linux only, for reading and writing in parallel
 type FileDescriptor int32
+type InterfaceRoute netip.Prefix
 
-func (a InterfaceName) isSetupOption()  {}
-func (a InterfaceMTU) isSetupOption()   {}
-func (a FileDescriptor) isSetupOption() {}
+func (a InterfaceName) isSetupOption()   {}
+func (a InterfaceMTU) isSetupOption()    {}
+func (a InterfaceQueues) isSetupOption() {}
+func (a FileDescriptor) isSetupOption()  {}
+func (a InterfaceRoute) isSetupOption()  {}
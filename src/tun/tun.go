@@ -10,7 +10,9 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 
 	"github.com/Arceliar/phony"
 	wgtun "golang.zx2c4.com/wireguard/tun"
@@ -45,11 +47,57 @@ type TunAdapter struct {
 	isOpen      bool
 	isEnabled   bool // Used by the writer to drop sessionTraffic if not enabled
 	config      struct {
-		fd   int32
-		name InterfaceName
-		mtu  InterfaceMTU
+		fd     int32
+		name   InterfaceName
+		mtu    InterfaceMTU
+		queues InterfaceQueues
+		routes []netip.Prefix // Additional prefixes to route to the interface
+	}
+	queues []*tunQueue // Including iface, which is the first
+}
+
+// tunQueue is one queue of a multi-queue interface, or the only queue, with
+// its own reader and writer.
+type tunQueue struct {
+	iface wgtun.Device
+	ch    chan []byte // Packets to write to the interface
+	stats struct {
+		rxPackets atomic.Uint64 // Read from the interface
+		rxBytes   atomic.Uint64
+		rxDropped atomic.Uint64 // Read from the interface but couldn't be sent
+		txPackets atomic.Uint64 // Written to the interface
+		txBytes   atomic.Uint64
+		txErrors  atomic.Uint64 // Failed writes to the interface
+		rxRate    atomic.Uint64 // Bytes per second
+		txRate    atomic.Uint64
+	}
+	lastRX, lastTX uint64 // Only used by _updateRates
+}
+
+// Statistics contains packet counters for the TUN interface, from the point
+// of view of the interface, i.e. RX counts packets that the OS sent to us.
+type Statistics struct {
+	RXPackets uint64
+	RXBytes   uint64
+	RXDropped uint64
+	TXPackets uint64
+	TXBytes   uint64
+	TXErrors  uint64
+	RXRate    uint64 // Bytes per second
+	TXRate    uint64
+}
+
+func (q *tunQueue) statistics() Statistics {
+	return Statistics{
+		RXPackets: q.stats.rxPackets.Load(),
+		RXBytes:   q.stats.rxBytes.Load(),
+		RXDropped: q.stats.rxDropped.Load(),
+		TXPackets: q.stats.txPackets.Load(),
+		TXBytes:   q.stats.txBytes.Load(),
+		TXErrors:  q.stats.txErrors.Load(),
+		RXRate:    q.stats.rxRate.Load(),
+		TXRate:    q.stats.txRate.Load(),
 	}
-	ch chan []byte
 }
 
 // Gets the maximum supported MTU for the platform based on the defaults in
@@ -80,6 +128,33 @@ func (tun *TunAdapter) MTU() uint64 {
 	return getSupportedMTU(tun.mtu)
 }
 
+// Statistics returns the packet counters for the interface since startup,
+// for all queues together.
+func (tun *TunAdapter) Statistics() Statistics {
+	var total Statistics
+	for _, s := range tun.QueueStatistics() {
+		total.RXPackets += s.RXPackets
+		total.RXBytes += s.RXBytes
+		total.RXDropped += s.RXDropped
+		total.TXPackets += s.TXPackets
+		total.TXBytes += s.TXBytes
+		total.TXErrors += s.TXErrors
+		total.RXRate += s.RXRate
+		total.TXRate += s.TXRate
+	}
+	return total
+}
+
+// QueueStatistics returns the packet counters for each queue of the
+// interface since startup.
+func (tun *TunAdapter) QueueStatistics() []Statistics {
+	stats := make([]Statistics, 0, len(tun.queues))
+	for _, q := range tun.queues {
+		stats = append(stats, q.statistics())
+	}
+	return stats
+}
+
 // DefaultName gets the default TUN interface name for your platform.
 func DefaultName() string {
 	return config.GetDefaults().DefaultIfName
@@ -143,16 +218,33 @@ func (tun *TunAdapter) _start() error {
 	if err != nil {
 		return err
 	}
+	if tun.config.fd <= 0 {
+		// Routes for an existing file descriptor are up to whoever gave it to us
+		for _, prefix := range tun.config.routes {
+			if err = tun.setupRoute(prefix); err != nil {
+				return fmt.Errorf("failed to add route for %s: %w", prefix, err)
+			}
+		}
+	}
 	if tun.MTU() != mtu {
 		tun.log.Warnf("Warning: Interface MTU %d automatically adjusted to %d (supported range is 1280-%d)", tun.config.mtu, tun.MTU(), MaximumMTU())
 	}
 	tun.rwc.SetMTU(tun.MTU())
+	if len(tun.queues) == 0 {
+		tun.queues = []*tunQueue{{iface: tun.iface}}
+	}
+	if int(tun.config.queues) > len(tun.queues) {
+		tun.log.Warnf("Warning: Multiple TUN queues aren't supported on this platform, using %d", len(tun.queues))
+	}
 	tun.isOpen = true
 	tun.isEnabled = true
-	tun.ch = make(chan []byte, tun.iface.BatchSize())
+	for _, q := range tun.queues {
+		q.ch = make(chan []byte, q.iface.BatchSize())
+		go tun.read(q)
+		go tun.write(q)
+	}
 	go tun.queue()
-	go tun.read()
-	go tun.write()
+	tun.Act(nil, tun._updateRates)
 	return nil
 }
 
@@ -182,6 +274,11 @@ func (tun *TunAdapter) _stop() error {
 		// Just in case we failed to start up the iface for some reason, this can apparently happen on Windows
 		tun.iface.Close()
 	}
+	for _, q := range tun.queues {
+		if q.iface != tun.iface {
+			q.iface.Close()
+		}
+	}
 	return nil
 }
 
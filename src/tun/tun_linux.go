@@ -6,8 +6,12 @@ package tun
 
 import (
 	"fmt"
+	"net"
+	"net/netip"
+	"os"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	wgtun "golang.zx2c4.com/wireguard/tun"
 )
 
@@ -16,8 +20,18 @@ func (tun *TunAdapter) setup(ifname string, addr string, mtu uint64) error {
 	if ifname == "auto" {
 		ifname = "\000"
 	}
-	iface, err := wgtun.CreateTUN(ifname, int(mtu))
-	if err != nil {
+	var iface wgtun.Device
+	var err error
+	if tun.config.queues > 1 {
+		var devices []wgtun.Device
+		if devices, err = createMultiQueueTUN(ifname, int(mtu), int(tun.config.queues)); err != nil {
+			return fmt.Errorf("failed to create multi-queue TUN: %w", err)
+		}
+		for _, device := range devices {
+			tun.queues = append(tun.queues, &tunQueue{iface: device})
+		}
+		iface = devices[0]
+	} else if iface, err = wgtun.CreateTUN(ifname, int(mtu)); err != nil {
 		return fmt.Errorf("failed to create TUN: %w", err)
 	}
 	tun.iface = iface
@@ -32,6 +46,62 @@ func (tun *TunAdapter) setup(ifname string, addr string, mtu uint64) error {
 	return nil
 }
 
+// createMultiQueueTUN creates a TUN interface with the given number of
+// queues, returning a device for each, so that packets can be read and
+// written on several cores at once. Only the first device is monitored for
+// events and is used to set the MTU. Like CreateTUN, GSO and GRO offloads are
+// enabled with virtio-net headers.
+func createMultiQueueTUN(name string, mtu int, queues int) ([]wgtun.Device, error) {
+	devices := make([]wgtun.Device, 0, queues)
+	fail := func(err error) ([]wgtun.Device, error) {
+		for _, device := range devices {
+			_ = device.Close()
+		}
+		return nil, err
+	}
+	for i := 0; i < queues; i++ {
+		fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return fail(err)
+		}
+		ifr, err := unix.NewIfreq(name)
+		if err != nil {
+			unix.Close(fd)
+			return fail(err)
+		}
+		ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI | unix.IFF_VNET_HDR | unix.IFF_MULTI_QUEUE)
+		if err = unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+			unix.Close(fd)
+			return fail(err)
+		}
+		// The kernel picks a name if none was given, which the other queues
+		// need to attach to the same interface
+		name = ifr.Name()
+		// CreateUnmonitoredTUNFromFD does this too, but if it fails there
+		// then it returns before the fd is handed to an os.File, leaving
+		// nothing to close it
+		if err = unix.SetNonblock(fd, true); err != nil {
+			unix.Close(fd)
+			return fail(err)
+		}
+		var device wgtun.Device
+		if i == 0 {
+			file := os.NewFile(uintptr(fd), "/dev/net/tun")
+			if device, err = wgtun.CreateTUNFromFile(file, mtu); err != nil {
+				_ = file.Close()
+				return fail(err)
+			}
+		} else if device, _, err = wgtun.CreateUnmonitoredTUNFromFD(fd); err != nil {
+			// Any later failure is after the fd was handed to an os.File,
+			// which owns it now and closes it when it is collected, so it
+			// mustn't be closed here as well
+			return fail(err)
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
 // Configures the "utun" adapter from an existing file descriptor.
 func (tun *TunAdapter) setupFD(fd int32, addr string, mtu uint64) error {
 	return fmt.Errorf("setup via FD not supported on this platform")
@@ -65,3 +135,23 @@ func (tun *TunAdapter) setupAddress(addr string) error {
 	tun.log.Infof("Interface MTU: %d", tun.mtu)
 	return nil
 }
+
+// Routes the prefix to the TUN adapter, replacing any existing route for it.
+func (tun *TunAdapter) setupRoute(prefix netip.Prefix) error {
+	nlintf, err := netlink.LinkByName(tun.Name())
+	if err != nil {
+		return fmt.Errorf("failed to find link by name: %w", err)
+	}
+	route := &netlink.Route{
+		LinkIndex: nlintf.Attrs().Index,
+		Dst: &net.IPNet{
+			IP:   prefix.Addr().AsSlice(),
+			Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+		},
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return fmt.Errorf("failed to add route to link: %w", err)
+	}
+	tun.log.Infof("Interface route: %s", prefix)
+	return nil
+}
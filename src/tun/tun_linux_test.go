@@ -0,0 +1,223 @@
+//go:build linux
+
+package tun
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gologme/log"
+	"golang.org/x/sys/unix"
+
+	"github.com/yggdrasil-network/yggdrasil-go/src/address"
+)
+
+// echoRWC stands in for the rest of the node, sending UDP packets that were
+// read from the interface straight back to it with the addresses and ports
+// swapped, so that they arrive at the socket that sent them.
+type echoRWC struct {
+	addr    address.Address
+	packets chan []byte
+	dropped atomic.Uint64
+}
+
+func (e *echoRWC) Write(bs []byte) (int, error) {
+	if len(bs) < 48 || bs[0]>>4 != 6 || bs[6] != 17 {
+		return len(bs), nil // Only UDP without extension headers
+	}
+	packet := append([]byte(nil), bs...)
+	var addr [16]byte
+	copy(addr[:], packet[8:24])
+	copy(packet[8:24], packet[24:40])
+	copy(packet[24:40], addr[:])
+	packet[40], packet[41], packet[42], packet[43] = packet[42], packet[43], packet[40], packet[41]
+	select {
+	case e.packets <- packet:
+	default:
+		e.dropped.Add(1)
+	}
+	return len(bs), nil
+}
+
+func (e *echoRWC) Read(bs []byte) (int, error) {
+	packet, ok := <-e.packets
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(bs, packet), nil
+}
+
+func (e *echoRWC) Close() error             { return nil }
+func (e *echoRWC) Address() address.Address { return e.addr }
+func (e *echoRWC) Subnet() address.Subnet   { return address.Subnet{} }
+func (e *echoRWC) MaxMTU() uint64           { return 65535 }
+func (e *echoRWC) SetMTU(uint64)            {}
+
+// startEcho creates an interface with the given number of queues in a new
+// network namespace, and a UDP socket for each flow which is connected to a
+// remote address that is routed to it. The test is skipped if we aren't
+// allowed to do this, i.e. when not running as root.
+func startEcho(tb testing.TB, queues, flows int) (*TunAdapter, []*net.UDPConn) {
+	tb.Helper()
+	type result struct {
+		tun   *TunAdapter
+		conns []*net.UDPConn
+		err   error
+		skip  bool
+	}
+	results, done := make(chan result), make(chan struct{})
+	go func() {
+		// The thread is never unlocked, so that it exits along with the
+		// goroutine instead of being reused in the wrong namespace
+		runtime.LockOSThread()
+		var res result
+		defer func() {
+			results <- res
+			<-done
+		}()
+		if res.err = unix.Unshare(unix.CLONE_NEWNET); res.err != nil {
+			res.skip = true
+			return
+		}
+		// Otherwise the address can't be used until duplicate address
+		// detection has finished
+		for _, conf := range []string{"all", "default"} {
+			path := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/accept_dad", conf)
+			if res.err = os.WriteFile(path, []byte("0"), 0644); res.err != nil {
+				return
+			}
+		}
+		local, _, _ := ed25519.GenerateKey(nil)
+		remote, _, _ := ed25519.GenerateKey(nil)
+		rwc := &echoRWC{
+			addr:    *address.AddrForKey(local),
+			packets: make(chan []byte, 1024),
+		}
+		logger := log.New(io.Discard, "", 0)
+		res.tun, res.err = New(rwc, logger, InterfaceName("auto"), InterfaceMTU(1500), InterfaceQueues(queues))
+		if res.err != nil {
+			res.skip = errors.Is(res.err, unix.EPERM) || errors.Is(res.err, os.ErrNotExist)
+			return
+		}
+		ip := net.IP(address.AddrForKey(remote)[:])
+		for i := 0; i < flows; i++ {
+			conn, err := net.DialUDP("udp6", nil, &net.UDPAddr{IP: ip, Port: 9000 + i})
+			if err != nil {
+				res.err = err
+				return
+			}
+			res.conns = append(res.conns, conn)
+		}
+	}()
+	res := <-results
+	tb.Cleanup(func() {
+		for _, conn := range res.conns {
+			_ = conn.Close()
+		}
+		if res.tun != nil {
+			_ = res.tun.Stop()
+		}
+		close(done)
+	})
+	switch {
+	case res.skip:
+		tb.Skipf("can't create a TUN interface in a network namespace: %v", res.err)
+	case res.err != nil:
+		tb.Fatal(res.err)
+	}
+	return res.tun, res.conns
+}
+
+// echo sends packets on the connection, with up to window of them waiting
+// for a reply at a time, and returns how many of them weren't echoed.
+func echo(conn *net.UDPConn, packets, size, window int) int {
+	outstanding, stop := make(chan struct{}, window), make(chan struct{})
+	lost := make(chan int, 1)
+	go func() {
+		defer close(stop)
+		buf := make([]byte, size+1)
+		received := 0
+		for received < packets {
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Read(buf); err != nil {
+				break
+			}
+			received++
+			<-outstanding
+		}
+		lost <- packets - received
+	}()
+	payload := make([]byte, size)
+	for i := 0; i < packets; i++ {
+		select {
+		case outstanding <- struct{}{}:
+			_, _ = conn.Write(payload)
+		case <-stop:
+		}
+	}
+	return <-lost
+}
+
+func TestMultiQueue(t *testing.T) {
+	const queues, flows, packets = 4, 8, 100
+	tun, conns := startEcho(t, queues, flows)
+	if n := len(tun.QueueStatistics()); n != queues {
+		t.Fatalf("expected %d queues, got %d", queues, n)
+	}
+	for _, conn := range conns {
+		if lost := echo(conn, packets, 1200, 1); lost > 0 {
+			t.Fatalf("%d of %d packets weren't echoed", lost, packets)
+		}
+	}
+	stats := tun.Statistics()
+	if stats.RXPackets < flows*packets || stats.TXPackets < flows*packets {
+		t.Fatalf("unexpected statistics %+v", stats)
+	}
+	var used int
+	for _, q := range tun.QueueStatistics() {
+		if q.RXPackets > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Fatalf("expected %d flows to use more than one queue", flows)
+	}
+}
+
+// BenchmarkEcho measures the throughput of the interface, with packets going
+// both ways, for a number of flows in parallel.
+func BenchmarkEcho(b *testing.B) {
+	const flows, size, window = 8, 1200, 64
+	for _, queues := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("queues=%d", queues), func(b *testing.B) {
+			_, conns := startEcho(b, queues, flows)
+			var lost atomic.Int64
+			var wg sync.WaitGroup
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i, conn := range conns {
+				packets := b.N / flows
+				if i < b.N%flows {
+					packets++
+				}
+				wg.Add(1)
+				go func(conn *net.UDPConn) {
+					defer wg.Done()
+					lost.Add(int64(echo(conn, packets, size, window)))
+				}(conn)
+			}
+			wg.Wait()
+			b.StopTimer()
+			b.ReportMetric(float64(lost.Load())/float64(b.N), "lost/op")
+		})
+	}
+}
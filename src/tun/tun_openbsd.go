@@ -5,6 +5,7 @@ package tun
 import (
 	"fmt"
 	"net"
+	"net/netip"
 	"syscall"
 	"unsafe"
 
@@ -119,3 +120,10 @@ func (tun *TunAdapter) setupAddress(addr string) error {
 
 	return nil
 }
+
+// OpenBSD needs a gateway address for interface routes, which we don't have
+// for IPv4, so leave adding them to the administrator.
+func (tun *TunAdapter) setupRoute(prefix netip.Prefix) error {
+	tun.log.Warnln("Warning: You must route", prefix, "to", tun.Name())
+	return nil
+}
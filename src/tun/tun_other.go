@@ -7,6 +7,7 @@ package tun
 
 import (
 	"fmt"
+	"net/netip"
 
 	wgtun "golang.zx2c4.com/wireguard/tun"
 )
@@ -40,3 +41,9 @@ func (tun *TunAdapter) setupAddress(addr string) error {
 	tun.log.Warnln("Warning: Platform not supported, you must set the address of", tun.Name(), "to", addr)
 	return nil
 }
+
+// We don't know how to add routes on an unknown platform either.
+func (tun *TunAdapter) setupRoute(prefix netip.Prefix) error {
+	tun.log.Warnln("Warning: Platform not supported, you must route", prefix, "to", tun.Name())
+	return nil
+}
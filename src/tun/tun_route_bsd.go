@@ -0,0 +1,26 @@
+//go:build darwin || ios || freebsd
+
+package tun
+
+import (
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// Routes the prefix to the TUN adapter using the route command.
+func (tun *TunAdapter) setupRoute(prefix netip.Prefix) error {
+	family := "-inet"
+	if prefix.Addr().Is6() {
+		family = "-inet6"
+	}
+	cmd := exec.Command("route", "-n", "add", family, "-net", prefix.String(), "-interface", tun.Name())
+	tun.log.Debugf("Adding route: %s", strings.Join(cmd.Args, " "))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		tun.log.Traceln(string(output))
+		return fmt.Errorf("route command failed: %w", err)
+	}
+	tun.log.Infof("Interface route: %s", prefix)
+	return nil
+}
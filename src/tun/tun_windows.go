@@ -124,6 +124,30 @@ func (tun *TunAdapter) setupAddress(addr string) error {
 	return nil
 }
 
+// Routes the prefix to the TUN adapter.
+func (tun *TunAdapter) setupRoute(prefix netip.Prefix) error {
+	if tun.iface == nil || tun.Name() == "" {
+		return errors.New("Can't configure route as TUN adapter is not present")
+	}
+	intf, ok := tun.iface.(*wgtun.NativeTun)
+	if !ok {
+		return errors.New("unable to get NativeTUN")
+	}
+	nextHop := netip.IPv6Unspecified()
+	if prefix.Addr().Is4() {
+		nextHop = netip.IPv4Unspecified()
+	}
+	luid := winipcfg.LUID(intf.LUID())
+	err := elevate.DoAsSystem(func() error {
+		return luid.AddRoute(prefix, nextHop, 0)
+	})
+	if err != nil && err != windows.ERROR_OBJECT_ALREADY_EXISTS {
+		return err
+	}
+	tun.log.Infof("Interface route: %s", prefix)
+	return nil
+}
+
 /*
  * cleanupAddressesOnDisconnectedInterfaces
  * SPDX-License-Identifier: MIT